@@ -2,44 +2,70 @@ package main
 
 import (
 	"bytes"
+	"flag"
 	"fmt"
 	"io/ioutil"
+	"log/slog"
 	"net/http"
 	"os"
-	"path/filepath"
 	"strings"
+
+	"http_server/logging"
+	"http_server/mimetype"
 )
 
+// mimeTypes is the registry used to find the Content-Type of uploaded files.
+var mimeTypes = mimetype.New()
+
+/*
+The main program sends one request to the server, given by the arguments after the flags:
+"GET" downloads the start page, "POST file" and "PUT file" upload a file from Lab1/files_to_POST,
+as the user given with -user when the server asks for authentication.
+*/
 func main() {
+	logLevel := flag.String("log-level", "info", "lowest level of the messages that are logged: debug, info, warn or error")
+	logFormat := flag.String("log-format", "text", "format of the log messages: text or json")
+	user := flag.String("user", "", "user:password sent with Basic authentication for uploads")
+	flag.Parse()
+
+	if err := logging.Setup(*logLevel, *logFormat); err != nil {
+		slog.Error("Setting up the log", "err", err)
+		os.Exit(2)
+	}
+	args := flag.Args()
+	if len(args) < 1 || (args[0] != "GET" && len(args) < 2) {
+		slog.Error("Usage: client [flags] GET | POST file | PUT file")
+		os.Exit(2)
+	}
 
 	serverURL := "http://localhost:8080"
 
-	if os.Args[1] == "GET" {
+	if args[0] == "GET" {
 
 		//for i := 0; i < 12; i++ {
 
 		response, err := http.Get(serverURL)
 		if err != nil {
-			fmt.Println("Fel vid GET-förfrågan:", err)
+			slog.Error("Sending the GET request", "url", serverURL, "err", err)
 			return
 		}
 
 		body, err := ioutil.ReadAll(response.Body)
 		if err != nil {
-			fmt.Println("Fel vid läsning av svar: ", err, " Body = ", body)
+			slog.Error("Reading the response", "err", err)
 			return
 		}
 
 		contentType := response.Header.Get("Content-Type")
 
-		print(contentType)
+		slog.Debug("Response", "status", response.Status, "content_type", contentType)
 
 		switch contentType {
 
 		case "image/jpeg":
 			err = ioutil.WriteFile("downloaded.jpg", body, 0644)
 			if err != nil {
-				fmt.Println("Fel vid sparande av JPG-fil:", err)
+				slog.Error("Saving the JPG file", "err", err)
 				return
 			}
 			fmt.Println("JPG-filen har laddats ner och sparats som 'downloaded.jpg'.")
@@ -47,7 +73,7 @@ func main() {
 		case "image/gif":
 			err = ioutil.WriteFile("downloaded.gif", body, 0644)
 			if err != nil {
-				fmt.Println("Fel vid sparande av GIF-fil:", err)
+				slog.Error("Saving the GIF file", "err", err)
 				return
 			}
 			fmt.Println("GIF-filen har laddats ner och sparats som 'downloaded.gif'.")
@@ -59,24 +85,36 @@ func main() {
 
 		//} //end for-loop
 
-	} else if os.Args[1] == "POST" {
+	} else if args[0] == "POST" {
 
-		filePath := "Lab1/files_to_POST/" + os.Args[2]
-		serverURL = serverURL + "/" + os.Args[2]
+		filePath := "Lab1/files_to_POST/" + args[1]
+		serverURL = serverURL + "/" + args[1]
 
 		fileContent, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			slog.Error("Reading the file to upload", "path", filePath, "err", err)
+			return
+		}
 		fileReaderdata := bytes.NewReader(fileContent)
 		contentType := getContentType(filePath)
 
-		response, err := http.Post(serverURL, contentType, fileReaderdata)
+		req, err := http.NewRequest("POST", serverURL, fileReaderdata)
+		if err != nil {
+			slog.Error("Creating the POST request", "err", err)
+			return
+		}
+		req.Header.Set("Content-Type", contentType)
+		setUser(req, *user)
+
+		response, err := http.DefaultClient.Do(req)
 		if err != nil {
-			fmt.Println("Fel vid POST-förfrågan:", err)
+			slog.Error("Sending the POST request", "url", serverURL, "err", err)
 			return
 		}
 
 		body, err := ioutil.ReadAll(response.Body)
 		if err != nil {
-			fmt.Println("Fel vid läsning av svar: ", err, " Body = ", body)
+			slog.Error("Reading the response", "err", err)
 			return
 		}
 
@@ -84,28 +122,33 @@ func main() {
 
 		defer response.Body.Close()
 
-	} else if os.Args[1] == "PUT" { //Gives not implemented
+	} else if args[0] == "PUT" {
 
-		filePath := "Lab1/files_to_POST/" + os.Args[2]
-		serverURL = serverURL + "/" + os.Args[2]
+		filePath := "Lab1/files_to_POST/" + args[1]
+		serverURL = serverURL + "/" + args[1]
 
 		fileContent, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			slog.Error("Reading the file to upload", "path", filePath, "err", err)
+			return
+		}
 		fileReaderdata := bytes.NewReader(fileContent)
-		//contentType := getContentType(filePath)
+		contentType := getContentType(filePath)
 
 		client := &http.Client{}
 
 		req, err := http.NewRequest("PUT", serverURL, fileReaderdata)
 		if err != nil {
-			fmt.Println("Fel vid skapande av PUT-förfrågan:", err)
+			slog.Error("Creating the PUT request", "err", err)
 			return
 		}
 
-		req.Header.Set("Content-Type", "text/plain")
+		req.Header.Set("Content-Type", contentType)
+		setUser(req, *user)
 
 		resp, err := client.Do(req)
 		if err != nil {
-			fmt.Println("Fel vid utförande av PUT-förfrågan:", err)
+			slog.Error("Sending the PUT request", "url", serverURL, "err", err)
 			return
 		}
 		defer resp.Body.Close()
@@ -116,20 +159,18 @@ func main() {
 
 }
 
+// getContentType returns the MIME type of a file, from its extension or else from its first bytes.
 func getContentType(filePath string) string {
-	extension := strings.ToLower(filepath.Ext(filePath))
-	switch extension {
-	case ".html":
-		return "text/html"
-	case ".txt":
-		return "text/plain"
-	case ".gif":
-		return "image/gif"
-	case ".jpeg", ".jpg":
-		return "image/jpeg"
-	case ".css":
-		return "text/css"
-	default:
+	contentType, known, err := mimeTypes.DetectFile(filePath)
+	if err != nil || !known {
 		return ""
 	}
+	return contentType
+}
+
+// setUser adds the Basic credentials of user, written as "name:password", to a request. No user sends none.
+func setUser(req *http.Request, user string) {
+	if name, password, found := strings.Cut(user, ":"); found {
+		req.SetBasicAuth(name, password)
+	}
 }
@@ -0,0 +1,7 @@
+module client
+
+go 1.24
+
+require http_server v0.0.0
+
+replace http_server => ../src
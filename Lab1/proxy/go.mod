@@ -0,0 +1,7 @@
+module myproxy
+
+go 1.24
+
+require http_server v0.0.0
+
+replace http_server => ../src
@@ -2,63 +2,240 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
-	"path/filepath"
+	"os/signal"
 	"regexp"
 	"strings"
 	"sync"
-	"sync/atomic"
+	"syscall"
+	"time"
+
+	"http_server/accesslog"
+	"http_server/admission"
+	"http_server/health"
+	"http_server/ipfilter"
+	"http_server/logging"
+	"http_server/metrics"
+	"http_server/mimetype"
 )
 
 const maxConcurrentRequests = 10
 
+// maxQueuedRequests is how many connections may wait for a free slot, more are answered 503.
+const maxQueuedRequests = 50
+
+// queueTimeout is how long a connection may wait for a free slot before it is answered 503.
+const queueTimeout = 5 * time.Second
+
+// accessFilter decides by the -access-rules which clients may have a request forwarded. It allows everything by default.
+var accessFilter = &ipfilter.Filter{}
+
+// shutdownTimeout is how long active connections may finish after SIGTERM before the proxy exits anyway.
+const shutdownTimeout = 10 * time.Second
+
 /*
 The main program, first checks if the port-number given as start-argument is valid. Then start a listener on that port.
-Creates a waitGroup, and sets activeGoRoutines = 0. Then spawns for each connection creates a proxyConnectionHandler.
-Limits the number of parallel connections to maxConcurrentRequests. If maxConcurrentRequests reached,
-the connection awaits another to finish.
+Then spawns for each connection a Go-routine that waits for the admission controller and runs a proxyConnectionHandler.
+Limits the number of parallel connections to maxConcurrentRequests. If maxConcurrentRequests is reached,
+the connection waits in a queue of maxQueuedRequests for at most queueTimeout. When the queue is full or the
+wait times out, the client is answered 503 Service Unavailable with a Retry-After header.
+Every request is written to the access log, to stdout unless -access-log gives a file.
+Clients that the -access-rules do not allow a request are answered 403 Forbidden.
+On SIGTERM or SIGINT the proxy stops accepting and lets the active connections finish, for at most shutdownTimeout.
+It exits with status 0 when they all finished and 1 when some were cut off.
 */
 func main() {
+	accessLogPath := flag.String("access-log", "-", `file the access log is written to, "-" for stdout or "off"`)
+	accessLogFormat := flag.String("access-log-format", "combined", "format of the access log: common, combined or json")
+	accessLogMaxSize := flag.Int64("access-log-max-size", 100<<20, "size in bytes at which the access log file is rotated (0 never rotates)")
+	accessLogBackups := flag.Int("access-log-backups", 5, "number of rotated access log files that are kept")
+	upstream := flag.String("upstream", "", "host:port of the server, which must be reachable for the proxy to be ready (default not checked)")
+	logLevel := flag.String("log-level", "info", "lowest level of the messages that are logged: debug, info, warn or error")
+	logFormat := flag.String("log-format", "text", "format of the log messages: text or json")
+	accessRules := flag.String("access-rules", "", `IP rules separated by ";", the first that holds the client decides, such as "allow 10.0.0.0/8 GET;deny all" (default all allowed)`)
+	trustedProxies := flag.String("trusted-proxies", "", "comma separated networks of proxies in front of this one, whose X-Forwarded-For header tells the client")
+	flag.Parse()
 
-	if !checkPort(os.Args) {
-		return
+	if err := logging.Setup(*logLevel, *logFormat); err != nil {
+		slog.Error("Setting up the log", "err", err)
+		os.Exit(2)
 	}
 
-	port := ":" + os.Args[1]
-	listener, error_lis := net.Listen("tcp", port)
+	// The port is the argument after the flags
+	args := append([]string{os.Args[0]}, flag.Args()...)
+	if !checkPort(args) {
+		os.Exit(1)
+	}
 
-	defer listener.Close()
+	filter, err := ipfilter.New(strings.Split(*accessRules, ";"), strings.Split(*trustedProxies, ","))
+	if err != nil {
+		slog.Error("Reading -access-rules", "err", err)
+		os.Exit(2)
+	}
+	accessFilter = filter
 
-	if checkError(error_lis, "During net.listen()") {
-		fmt.Printf("\x1b[31mFailed to start Proxy-server on port %s\x1b[0m\n", port)
-		return
+	format, err := accesslog.ParseFormat(*accessLogFormat)
+	if err != nil {
+		slog.Error("Reading -access-log-format", "err", err)
+		os.Exit(2)
 	}
+	accessLog, err = accesslog.Open(*accessLogPath, format, *accessLogMaxSize, *accessLogBackups)
+	if err != nil {
+		slog.Error("Opening the access log", "err", err)
+		os.Exit(2)
+	}
+	defer accessLog.Close()
 
-	fmt.Printf("\x1b[32mProxy-server started on port %s\x1b[0m\n", port)
+	port := ":" + args[1]
+	listener, error_lis := net.Listen("tcp", port)
+	if error_lis != nil {
+		slog.Error("Failed to start Proxy-server", "port", args[1], "err", error_lis)
+		os.Exit(1)
+	}
 
+	slog.Info("Proxy-server started", "port", args[1])
+
+	// ctx is cancelled on shutdown, which answers the connections waiting for admission with 503
+	ctx, cancel := context.WithCancel(context.Background())
+	controller := admission.New(maxConcurrentRequests, maxQueuedRequests, queueTimeout)
+	registerAdmissionMetrics(controller)
+	readinessChecks["admission"] = health.Admission(controller)
+	if *upstream != "" {
+		readinessChecks["upstream"] = health.Reachable(*upstream, time.Second)
+	}
 	var waitGroup = sync.WaitGroup{}
-	var activeGoRoutines int32 = 0
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		received := <-signals
+		slog.Info("Shutting down", "signal", received, "timeout", shutdownTimeout)
+		listener.Close()
+		cancel()
+	}()
 
 	for {
 		connection, error_acc := listener.Accept()
 
-		if checkError(error_acc, "During listener.accept()") {
-			continue
+		if errors.Is(error_acc, net.ErrClosed) {
+			break
 		}
-
-		if atomic.LoadInt32(&activeGoRoutines) >= maxConcurrentRequests {
-			fmt.Println("Max concurrent requests reached. Waiting for a request to finish.")
-			waitGroup.Wait() // Wait until a Go-routine is done.
+		if error_acc != nil {
+			slog.Error("Accepting a connection", "err", error_acc)
+			continue
 		}
 
 		waitGroup.Add(1)
-		atomic.AddInt32(&activeGoRoutines, 1) // Threadsafe increment of activeGoRoutines.
-		fmt.Println("activeGoRoutines", activeGoRoutines)
-		go proxyConnectionHandler(connection, &waitGroup, &activeGoRoutines)
+		go admitConnection(ctx, connection, controller, &waitGroup)
+	}
+
+	status := waitForConnections(&waitGroup, shutdownTimeout)
+	if err := accessLog.Close(); err != nil {
+		slog.Error("Closing the access log", "err", err)
+	}
+	os.Exit(status)
+}
+
+/*
+waitForConnections waits at most timeout for the active connections to finish after the listener was closed.
+It returns the exit status, 0 when they all finished and 1 when some were still busy.
+*/
+func waitForConnections(waitGroup *sync.WaitGroup, timeout time.Duration) int {
+	done := make(chan struct{})
+	go func() {
+		waitGroup.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		slog.Info("Proxy-server stopped")
+		return 0
+	case <-time.After(timeout):
+		slog.Error("Connections were still busy when the shutdown timeout ran out, closing them", "timeout", timeout)
+		return 1
+	}
+}
+
+/*
+admitConnection waits until the admission controller lets the connection in and then runs the proxyConnectionHandler.
+A connection that is refused, also because the proxy shuts down while it waits,
+gets 503 Service Unavailable with a Retry-After header.
+*/
+func admitConnection(ctx context.Context, connection net.Conn, controller *admission.Controller, waitGroup *sync.WaitGroup) {
+	defer waitGroup.Done() // Notify the wait group that this Go routine is done
+
+	release, err := controller.Acquire(ctx)
+	stats := controller.Stats()
+	if err != nil {
+		slog.Warn("Refusing connection", "remote_addr", connection.RemoteAddr().String(), "err", err,
+			"active", stats.Active, "limit", stats.Limit, "queued", stats.Waiting, "queue_size", stats.QueueSize)
+		rejectConnection(connection, controller.RetryAfter())
+		return
+	}
+	defer release()
+
+	slog.Debug("Connection established", "remote_addr", connection.RemoteAddr().String(), "active", stats.Active, "queued", stats.Waiting)
+	proxyConnectionHandler(connection)
+}
+
+/*
+rejectConnection reads the request from a connection the proxy has no room for, answers
+503 Service Unavailable and closes it. The request is read first, as closing a connection with
+unread data resets it and the client could lose the response.
+*/
+func rejectConnection(connection net.Conn, retryAfter int) {
+	defer connection.Close()
+	start := time.Now()
+	connection.SetReadDeadline(time.Now().Add(time.Second))
+	request, error_read := http.ReadRequest(bufio.NewReader(connection))
+	if error_read == nil && request.RequestURI == healthPath && allowed(connection, request, slog.Default()) {
+		// A busy proxy is still alive
+		status, bytes := answerEndpoint(connection, request)
+		logAccess(connection, request, status, bytes, start)
+		recordRequest(request, status, bytes, start)
+		return
+	}
+
+	message := "503 Service Unavailable\n"
+	headerstring := "HTTP/1.1 503 Service Unavailable\r\nRetry-After: " + fmt.Sprint(retryAfter) + "\r\nContent-Length: " + fmt.Sprint(len(message)) + "\r\nContent-Type: text/plain\r\nConnection: close\r\n\r\n" + message
+	if _, err := connection.Write([]byte(headerstring)); err != nil {
+		slog.Debug("Sending 503 response", "remote_addr", connection.RemoteAddr().String(), "err", err)
+	}
+	if error_read == nil {
+		logAccess(connection, request, 503, int64(len(message)), start)
+		recordRequest(request, 503, int64(len(message)), start)
+	}
+}
+
+// accessLog records every request the proxy answers, it is opened by main.
+var accessLog = accesslog.New(io.Discard, accesslog.Combined)
+
+// logAccess writes the line of a request to the access log, with the status and the body bytes that were sent.
+func logAccess(connection net.Conn, request *http.Request, status int, bytes int64, start time.Time) {
+	err := accessLog.Log(accesslog.Entry{
+		Time:       start,
+		RemoteAddr: connection.RemoteAddr().String(),
+		Method:     request.Method,
+		URI:        request.RequestURI,
+		Proto:      request.Proto,
+		Status:     status,
+		Bytes:      bytes,
+		Duration:   time.Since(start),
+		Referer:    request.Referer(),
+		UserAgent:  request.UserAgent(),
+	})
+	if err != nil {
+		slog.Error("Writing the access log", "err", err)
 	}
 }
 
@@ -66,68 +243,131 @@ func main() {
 proxyConnectionHandler handles each request (separately) to the proxy-server.
 Creates a reader and reads the request from the requester. If the request-method is GET it will
 forward the request to the server, and then return the answer to the requester with appropriate header.
+Its log lines carry an ID for the request and the address of the requester.
+A request for a path rather than a URL is for the proxy itself, its metrics, health and readiness endpoints.
 */
-func proxyConnectionHandler(connection net.Conn, waitGroup *sync.WaitGroup, activeGoRoutines *int32) {
-	fmt.Printf("\x1b[33mRequst happend: Connection established: \x1b[0m\n")
-
-	// Ensure that the following deferred statements are executed even in case of errors
-	defer atomic.AddInt32(activeGoRoutines, -1) // Decrease the count of active Go routines
-	defer connection.Close()                    // Close the connection
-	defer waitGroup.Done()                      // Notify the wait group that this Go routine is done
+func proxyConnectionHandler(connection net.Conn) {
+	// Ensure that the connection is closed even in case of errors
+	defer connection.Close()
+	logger := slog.With("request_id", logging.NewRequestID(), "remote_addr", connection.RemoteAddr().String())
 	// Create a reader to read the incoming request
 	reader := bufio.NewReader(connection)
+	start := time.Now()
 	request, error_read := http.ReadRequest(reader)
-	if checkError(error_read, "During http.readRequest") {
+	if error_read != nil {
+		logger.Info("Reading a request", "err", error_read)
+		return
+	}
+	logger.Debug("Request", "method", request.Method, "uri", request.RequestURI)
+	// The rules also cover the endpoints of the proxy, so they can keep clients from the metrics
+	if !allowed(connection, request, logger) {
+		bytes := giveResponse(connection, nil, 403, logger)
+		logAccess(connection, request, 403, bytes, start)
+		recordRequest(request, 403, bytes, start)
+		return
+	}
+	if strings.HasPrefix(request.RequestURI, "/") {
+		// A request for the proxy itself rather than one to forward, which has an absolute URL
+		status, bytes := answerEndpoint(connection, request)
+		logAccess(connection, request, status, bytes, start)
+		recordRequest(request, status, bytes, start)
 		return
 	}
 	// Extract the requested URL from the request
 	url := request.RequestURI
 	// Check if the requested URL has a valid extension for proxying
 	isValid := checkValid(url)
-	// Print information about the request
-	fmt.Println("this is requestURI " + request.RequestURI)
-	fmt.Println("this is isValid ", isValid)
 	// Handle GET requests
 
+	status := 501
 	if request.Method == "GET" {
 
 		if isValid { //if .html and other valid. OK to continue
 
-			response, err := http.Get(url)
-			if checkError(err, "During http.Get(url)") {
-				return
+			response, err := forward(request, connection)
+			if err != nil {
+				logger.Error("Fetching from the server", "url", url, "err", err)
+				status = 502 //The server could not be reached
+			} else {
+				defer response.Body.Close()
+				status = 200 //Send header 200 OK + file
 			}
-			defer response.Body.Close()
-
-			giveResponse(connection, response, 200) //Send header 200 OK + file
+			bytes := giveResponse(connection, response, status, logger)
+			logAccess(connection, request, status, bytes, start)
+			recordRequest(request, status, bytes, start)
+			return
 
 		} else {
-			giveResponse(connection, nil, 400) //Send header, 400 Bad Req
+			status = 400 //Send header, 400 Bad Req
 		}
 
-	} else {
-		giveResponse(connection, nil, 501) //Send header, 501 Not implemented
-		return
 	}
+	bytes := giveResponse(connection, nil, status, logger) //Send header, 400 Bad Req or 501 Not implemented
+	logAccess(connection, request, status, bytes, start)
+	recordRequest(request, status, bytes, start)
+}
+
+// allowed reports whether the access rules let the client of a request make it.
+func allowed(connection net.Conn, request *http.Request, logger *slog.Logger) bool {
+	client, err := accessFilter.ClientAddr(connection.RemoteAddr().String(), request.Header)
+	if err == nil && accessFilter.Allowed(client, request.Method, request.URL.Path) {
+		return true
+	}
+	logger.Info("Client is not allowed", "client", client, "method", request.Method, "url", request.RequestURI)
+	return false
+}
+
+/*
+forward sends a GET request to the server it is for, with the address of the client appended to X-Forwarded-For,
+so a server that trusts the proxy can tell who the client is.
+*/
+func forward(request *http.Request, connection net.Conn) (*http.Response, error) {
+	outgoing, err := http.NewRequest("GET", request.RequestURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	forwardedFor := connection.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(forwardedFor); err == nil {
+		forwardedFor = host
+	}
+	if prior := strings.Join(request.Header.Values("X-Forwarded-For"), ", "); prior != "" {
+		forwardedFor = prior + ", " + forwardedFor
+	}
+	outgoing.Header.Set("X-Forwarded-For", forwardedFor)
+	return http.DefaultClient.Do(outgoing)
 }
 
 /*
 responseType takes in the connection,pointer to the response and rtype (responsetype) and creates a http-header depending on the rtype given.
-If rtype = 400, 501 it just sends a header.
+If rtype = 400, 403, 501, 502 it just sends a header and a short message.
 If rtype = 200, it sends the header and the attached file/data
+It returns the number of body bytes sent, for the access log. A failed write is logged with logger.
 */
-func giveResponse(connection net.Conn, response *http.Response, rtype int) {
+func giveResponse(connection net.Conn, response *http.Response, rtype int, logger *slog.Logger) int64 {
 	var cont = false
 	var sendFile = false
 	var headerstring string
+	var messageLength int64
 	switch rtype {
 	case 400:
 		message := "400 Bad Request. No such content type\n"
 		headerstring = "HTTP/1.1 400 Bad Request\r\nContent-Length:" + fmt.Sprint(len(message)) + "\r\nContent-Type: text/plain\r\n\r\n" + message
+		messageLength = int64(len(message))
+		cont = true
+	case 403:
+		message := "403 Forbidden\n"
+		headerstring = "HTTP/1.1 403 Forbidden\r\nContent-Length: " + fmt.Sprint(len(message)) + "\r\nContent-Type: text/plain\r\n\r\n" + message
+		messageLength = int64(len(message))
 		cont = true
 	case 501:
 		message := "Not Implemented\n"
 		headerstring = "HTTP/1.1 501 Not Implemented\r\nContent-Length:" + fmt.Sprint(len(message)) + "\r\n\r\n" + message
+		messageLength = int64(len(message))
+		cont = true
+	case 502:
+		message := "502 Bad Gateway\n"
+		headerstring = "HTTP/1.1 502 Bad Gateway\r\nContent-Length: " + fmt.Sprint(len(message)) + "\r\nContent-Type: text/plain\r\n\r\n" + message
+		messageLength = int64(len(message))
 		cont = true
 	case 200:
 		contentLength := response.Header.Get("Content-Length")
@@ -139,14 +379,16 @@ func giveResponse(connection net.Conn, response *http.Response, rtype int) {
 	}
 	if cont {
 		_, err := connection.Write([]byte(headerstring))
-		if checkError(err, "during sendig respons-header:") {
-			return
+		if err != nil {
+			logger.Debug("Sending the response header", "err", err)
+			return 0
 		}
 	}
 	if sendFile {
-		io.Copy(connection, response.Body)
+		written, _ := io.Copy(connection, response.Body)
+		return written
 	}
-
+	return messageLength
 }
 
 /*
@@ -158,60 +400,125 @@ If not all above, returns false. If all tests passes, returns true.
 */
 func checkPort(args []string) bool {
 	if len(args) < 2 { //Checks if it contains at least 1 argument
-		fmt.Printf("\x1b[31mError: Please give an Port-number as start-arg.\x1b[0m\n") // "\x1b[31m  makes the text red for error messages
+		slog.Error("Please give a port number as start argument")
 		return false
 	}
 	regex := regexp.MustCompile("^[0-9]+$")
 
 	if regex.MatchString(args[1]) { //Checks if the first argument given contains only numbers.
-		fmt.Printf("\x1b[33mGiven Port is: %s \x1b[0m\n", args[1])
-
 		//test is port free?
 		conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%s", args[1])) //Testing if the port is available
 		if err != nil {
-			fmt.Printf("\x1b[33mPort %s is available.\x1b[0m\n", args[1]) //"\x1b[33m green text
+			slog.Debug("Port is available", "port", args[1])
 			return true
 		}
 		conn.Close() //Closing the connection for the test Dial
 	} else {
-		fmt.Printf("\x1b[31mError: Only numbers can be given :%s: is incorrect input.\x1b[0m\n", args[1])
+		slog.Error("Only numbers can be given as port", "port", args[1])
 		return false
 	}
-	fmt.Printf("\x1b[31mPort %s is NOT available.\x1b[0m\n", args[1])
-	fmt.Printf("\x1b[31mShuting down Server\x1b[0m\n")
+	slog.Error("Port is not available", "port", args[1])
 	return false
 }
 
+// metricsPath is the path the metrics of the proxy are served at, in the text format of Prometheus.
+const metricsPath = "/metrics"
+
+// metricsRegistry holds the metrics of the proxy.
+var metricsRegistry = metrics.NewRegistry()
+
+var (
+	requestsTotal = metricsRegistry.NewCounter("http_requests_total",
+		"Requests answered, by method and status.", "method", "status")
+	requestDuration = metricsRegistry.NewHistogram("http_request_duration_seconds",
+		"Time from reading the headers of a request to having answered it, by method.", metrics.DurationBuckets, "method")
+	responseBodyBytes = metricsRegistry.NewCounter("http_response_body_bytes_total",
+		"Bytes of response bodies sent.")
+)
+
+// registerAdmissionMetrics adds gauges of the connections the controller lets in and of its queue.
+func registerAdmissionMetrics(controller *admission.Controller) {
+	metricsRegistry.NewGaugeFunc("http_connections_active", "Connections being handled.",
+		func() float64 { return float64(controller.Stats().Active) })
+	metricsRegistry.NewGaugeFunc("http_connections_limit", "Most connections handled at the same time.",
+		func() float64 { return float64(controller.Stats().Limit) })
+	metricsRegistry.NewGaugeFunc("http_admission_queue_length", "Connections waiting for a free slot.",
+		func() float64 { return float64(controller.Stats().Waiting) })
+	metricsRegistry.NewGaugeFunc("http_admission_queue_size", "Most connections that may wait for a free slot.",
+		func() float64 { return float64(controller.Stats().QueueSize) })
+	metricsRegistry.NewCounterFunc("http_admission_rejected_total", "Connections answered 503 because the queue was full or the wait too long.",
+		func() float64 { return float64(controller.Stats().Rejected) })
+}
+
+// recordRequest counts an answered request, its duration and the bytes of its response body.
+func recordRequest(request *http.Request, status int, bytes int64, start time.Time) {
+	method := request.Method
+	if method != "GET" && method != "HEAD" {
+		method = "OTHER" // The proxy only forwards GET, other methods are not counted by name so clients can not create series at will
+	}
+	requestsTotal.Inc(method, fmt.Sprint(status))
+	requestDuration.Observe(time.Since(start).Seconds(), method)
+	responseBodyBytes.Add(float64(bytes))
+}
+
+// healthPath answers 200 OK as long as the proxy is running, for liveness probes.
+const healthPath = "/healthz"
+
+// readyPath answers 200 OK when the proxy can forward requests and 503 Service Unavailable when it can not, for readiness probes.
+const readyPath = "/readyz"
+
+// readinessChecks are the checks of readyPath, set up by main.
+var readinessChecks = map[string]health.Check{}
+
 /*
-CheckError checks if an error has occurred and prints an error message.
-It takes an error and a location description as arguments.
-If the error is != nil, it indicates an error occurred, then it
-prints an error-message with an explanation and returns true.
-If error = nil, it returns false to indicate no error.
+answerEndpoint answers a request for a path of the proxy itself: metricsPath, healthPath or readyPath.
+Other paths get 404 Not Found. Only GET is allowed. It returns the status and body bytes sent.
 */
-func checkError(error error, desc string) bool {
-	if error != nil {
-		fmt.Printf("\x1b[31mError during:%s.\x1b[0m \n", desc)       //Printing the locational description
-		fmt.Printf("\x1b[31mExplanation Err =:%s.\x1b[0m \n", error) //Printing the error
-		return true
-	} else {
-		return false
+func answerEndpoint(connection net.Conn, request *http.Request) (int, int64) {
+	var status int
+	var contentType string
+	var body bytes.Buffer
+	switch request.URL.Path {
+	case metricsPath:
+		status, contentType = 200, metrics.ContentType
+		metricsRegistry.Write(&body)
+	case healthPath, readyPath:
+		report := health.Live()
+		if request.URL.Path == readyPath {
+			report = health.Run(readinessChecks)
+		}
+		status, contentType = 200, "application/json"
+		if !report.OK() {
+			status = 503
+		}
+		json.NewEncoder(&body).Encode(report)
+	default:
+		status, contentType = 404, "text/plain"
+		body.WriteString("404 Not Found\n")
 	}
+	statusLine := fmt.Sprint(status, " ", http.StatusText(status))
+	extraHeader := "Cache-Control: no-store\r\n"
+	if status != 404 && request.Method != "GET" {
+		status, statusLine, contentType, extraHeader = 405, "405 Method Not Allowed", "text/plain", "Allow: GET\r\n"
+		body.Reset()
+		body.WriteString("405 Method Not Allowed\n")
+	}
+	headerstring := "HTTP/1.1 " + statusLine + "\r\nContent-Length: " + fmt.Sprint(body.Len()) + "\r\nContent-Type: " + contentType + "\r\n" + extraHeader + "\r\n"
+	connection.Write(append([]byte(headerstring), body.Bytes()...))
+	return status, int64(body.Len())
 }
 
+// mimeTypes is the registry of file types the proxy lets through to the server.
+var mimeTypes = mimetype.New()
+
 /*
 CheckValid takes in a filename to check.
-If the filename ends with ".html", ".txt", ".gif", ".jpeg", ".jpg", ".css" -
+If the filename has an extension the MIME registry knows (".html", ".txt", ".gif", ".jpeg", ".jpg", ".css", ...)
 it returns true, if it does not, it returns false.
 */
 //In the context of the proxy server, this function serves as a filter to screen out requests to the server it is working with.
 //Not really necessary, just added for increased functionality.
 func checkValid(filename string) bool {
-	extension := strings.ToLower(filepath.Ext(filename)) //Extrahera filändelse  så som .html
-	switch extension {
-	case ".html", ".txt", ".gif", ".jpeg", ".jpg", ".css":
-		return true
-	default:
-		return false
-	}
+	_, known := mimeTypes.TypeByPath(filename)
+	return known
 }
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"http_server/health"
+)
+
+func TestMain(m *testing.M) {
+	// Run as the proxy itself, the tests start it as a separate process like it is run
+	if os.Getenv("PROXY_TEST_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// startProxyProcess starts the proxy on a free port with the flags in args, and returns it with its address.
+func startProxyProcess(t *testing.T, args ...string) (*exec.Cmd, string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error finding a free port: %v", err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+	_, port, _ := net.SplitHostPort(address)
+
+	cmd := exec.Command(os.Args[0], append(args, port)...)
+	cmd.Env = append(os.Environ(), "PROXY_TEST_MAIN=1")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Error starting the proxy: %v", err)
+	}
+	t.Cleanup(func() { cmd.Process.Kill() })
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		if conn, err := net.Dial("tcp", address); err == nil {
+			conn.Close()
+			return cmd, address
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("The proxy did not start listening on %s", address)
+		}
+	}
+}
+
+// upstream is a server behind the proxy, which remembers the X-Forwarded-For header of the last request.
+type upstream struct {
+	*httptest.Server
+	mutex        sync.Mutex
+	forwardedFor string
+}
+
+// startUpstream starts a server that answers every path with a short page, and /slow.html in two parts a second apart.
+func startUpstream(t *testing.T) *upstream {
+	u := &upstream{}
+	u.Server = httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		u.mutex.Lock()
+		u.forwardedFor = request.Header.Get("X-Forwarded-For")
+		u.mutex.Unlock()
+		response.Header().Set("Content-Type", "text/html")
+		if request.URL.Path == "/slow.html" {
+			response.Header().Set("Content-Length", "10")
+			io.WriteString(response, "first")
+			response.(http.Flusher).Flush()
+			time.Sleep(time.Second)
+			io.WriteString(response, "other")
+			return
+		}
+		io.WriteString(response, "page "+request.URL.Path)
+	}))
+	t.Cleanup(u.Close)
+	return u
+}
+
+// lastForwardedFor returns the X-Forwarded-For header of the last request the upstream server got.
+func (u *upstream) lastForwardedFor() string {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.forwardedFor
+}
+
+/*
+send sends a request for uri to the proxy on a new connection, with the extra header lines in header,
+and returns the response with its body read. A uri that is a path is for the proxy itself, a URL is forwarded.
+*/
+func send(t *testing.T, address string, method string, uri string, header string) (*http.Response, string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("Error connecting to the proxy: %v", err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, method+" "+uri+" HTTP/1.1\r\nHost: localhost\r\n"+header+"\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("Error reading the response to %s %s: %v", method, uri, err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	return resp, string(body)
+}
+
+func Test_Forwarding(t *testing.T) {
+	server := startUpstream(t)
+	_, address := startProxyProcess(t)
+
+	resp, body := send(t, address, "GET", server.URL+"/site.html", "")
+	if resp.StatusCode != 200 || body != "page /site.html" {
+		t.Errorf("Expected the page of the server, got %d %q", resp.StatusCode, body)
+	}
+	if forwardedFor := server.lastForwardedFor(); forwardedFor != "127.0.0.1" {
+		t.Errorf("Expected the proxy to add its client to X-Forwarded-For, got %q", forwardedFor)
+	}
+	if resp, _ := send(t, address, "GET", server.URL+"/program.exe", ""); resp.StatusCode != 400 {
+		t.Errorf("Expected an unknown type to get 400, got %d", resp.StatusCode)
+	}
+	if resp, _ := send(t, address, "POST", server.URL+"/site.html", "Content-Length: 0\r\n"); resp.StatusCode != 501 {
+		t.Errorf("Expected POST to get 501, got %d", resp.StatusCode)
+	}
+}
+
+func Test_Endpoints(t *testing.T) {
+	server := startUpstream(t)
+	_, address := startProxyProcess(t, "-upstream", server.Listener.Addr().String())
+	send(t, address, "GET", server.URL+"/site.html", "")
+
+	t.Run("Test /metrics counts the forwarded requests and the connections", func(t *testing.T) {
+		// The request is counted once its response is sent, which may be just after the client read it
+		resp, body := send(t, address, "GET", "/metrics", "")
+		for deadline := time.Now().Add(time.Second); !strings.Contains(body, `status="200"`) && time.Now().Before(deadline); {
+			time.Sleep(20 * time.Millisecond)
+			resp, body = send(t, address, "GET", "/metrics", "")
+		}
+		if resp.StatusCode != 200 || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+			t.Fatalf("Expected the metrics, got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		for _, expected := range []string{
+			"# TYPE http_requests_total counter\n",
+			`http_requests_total{method="GET",status="200"} 1`,
+			"http_request_duration_seconds_bucket",
+			"http_connections_limit 10",
+			"http_admission_queue_size 50",
+			"http_admission_rejected_total 0",
+		} {
+			if !strings.Contains(body, expected) {
+				t.Errorf("Expected the metrics to contain %q, got\n%s", expected, body)
+			}
+		}
+	})
+
+	t.Run("Test /healthz and /readyz", func(t *testing.T) {
+		var report health.Report
+		resp, body := send(t, address, "GET", "/healthz", "")
+		json.Unmarshal([]byte(body), &report)
+		if resp.StatusCode != 200 || report.Status != "ok" {
+			t.Errorf("Expected the proxy to be alive, got %d %s", resp.StatusCode, body)
+		}
+		resp, body = send(t, address, "GET", "/readyz", "")
+		json.Unmarshal([]byte(body), &report)
+		if resp.StatusCode != 200 || !report.Checks["upstream"].OK || !report.Checks["admission"].OK {
+			t.Errorf("Expected the proxy to be ready, got %d %s", resp.StatusCode, body)
+		}
+		if resp, _ := send(t, address, "POST", "/healthz", "Content-Length: 0\r\n"); resp.StatusCode != 405 || resp.Header.Get("Allow") != "GET" {
+			t.Errorf("Expected POST to get 405 with Allow: GET, got %d %v", resp.StatusCode, resp.Header)
+		}
+		if resp, _ := send(t, address, "GET", "/other", ""); resp.StatusCode != 404 {
+			t.Errorf("Expected another path of the proxy to get 404, got %d", resp.StatusCode)
+		}
+
+		// Without the server the proxy is alive but not ready
+		server.Close()
+		if resp, _ := send(t, address, "GET", "/healthz", ""); resp.StatusCode != 200 {
+			t.Errorf("Expected the proxy to stay alive without the server, got %d", resp.StatusCode)
+		}
+		resp, body = send(t, address, "GET", "/readyz", "")
+		report = health.Report{}
+		json.Unmarshal([]byte(body), &report)
+		if resp.StatusCode != 503 || report.Checks["upstream"].OK {
+			t.Errorf("Expected the proxy not to be ready without the server, got %d %s", resp.StatusCode, body)
+		}
+	})
+}
+
+func Test_AccessLog(t *testing.T) {
+	server := startUpstream(t)
+	logFile := filepath.Join(t.TempDir(), "access.log")
+	_, address := startProxyProcess(t, "-access-log", logFile, "-access-log-format", "json")
+
+	send(t, address, "GET", server.URL+"/site.html", "User-Agent: proxy-test\r\n")
+	send(t, address, "GET", "/healthz", "")
+
+	var lines []string
+	for deadline := time.Now().Add(2 * time.Second); len(lines) < 2 && time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		data, _ := os.ReadFile(logFile)
+		lines = strings.Split(strings.TrimSpace(string(data)), "\n")
+	}
+	if len(lines) != 2 {
+		t.Fatalf("Expected a line per request, got %q", lines)
+	}
+	// The line is written once the response is sent, so the lines of two requests may come in any order
+	var entry, endpoint struct {
+		RemoteIP  string `json:"remote_ip"`
+		Method    string `json:"method"`
+		URI       string `json:"uri"`
+		Status    int    `json:"status"`
+		Bytes     int64  `json:"bytes"`
+		UserAgent string `json:"user_agent"`
+	}
+	for _, line := range lines {
+		if err := json.Unmarshal([]byte(line), &endpoint); err != nil {
+			t.Fatalf("Error reading the line %q: %v", line, err)
+		}
+		if endpoint.URI != "/healthz" {
+			entry = endpoint
+		}
+	}
+	if entry.RemoteIP != "127.0.0.1" || entry.Method != "GET" || entry.URI != server.URL+"/site.html" || entry.Status != 200 ||
+		entry.Bytes != int64(len("page /site.html")) || entry.UserAgent != "proxy-test" {
+		t.Errorf("Unexpected access log lines %q", lines)
+	}
+	if !strings.Contains(strings.Join(lines, "\n"), `"uri":"/healthz"`) {
+		t.Errorf("Expected the endpoints to be logged too, got %q", lines)
+	}
+}
+
+func Test_AdmissionControl(t *testing.T) {
+	_, address := startProxyProcess(t)
+
+	// Connections that send nothing hold all slots and fill the queue
+	var held []net.Conn
+	defer func() {
+		for _, conn := range held {
+			conn.Close()
+		}
+	}()
+	for i := 0; i < maxConcurrentRequests+maxQueuedRequests; i++ {
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			t.Fatalf("Error connecting: %v", err)
+		}
+		held = append(held, conn)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	resp, _ := send(t, address, "GET", "http://localhost:1/site.html", "")
+	if resp.StatusCode != 503 || resp.Header.Get("Retry-After") != "5" {
+		t.Errorf("Expected 503 with Retry-After: 5 from a saturated proxy, got %d %v", resp.StatusCode, resp.Header)
+	}
+	// A busy proxy is still alive
+	if resp, _ := send(t, address, "GET", "/healthz", ""); resp.StatusCode != 200 {
+		t.Errorf("Expected /healthz to be answered by a saturated proxy, got %d", resp.StatusCode)
+	}
+
+	for _, conn := range held {
+		conn.Close()
+	}
+	held = nil
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		resp, body := send(t, address, "GET", "/metrics", "")
+		if resp.StatusCode == 200 {
+			// The request and /healthz above were refused, and so are tries before the connections are gone
+			var rejected int
+			if _, after, found := strings.Cut(body, "\nhttp_admission_rejected_total "); found {
+				fmt.Sscan(after, &rejected)
+			}
+			if rejected < 2 {
+				t.Errorf("Expected the refused connections to be counted, got\n%s", body)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the proxy to answer again once the connections closed, got %d", resp.StatusCode)
+		}
+	}
+}
+
+func Test_GracefulShutdown(t *testing.T) {
+	server := startUpstream(t)
+	cmd, address := startProxyProcess(t)
+
+	// A response is being relayed when SIGTERM arrives
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET "+server.URL+"/slow.html HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("Expected 200 OK, got %v, %v", resp, err)
+	}
+
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatalf("Error sending SIGTERM: %v", err)
+	}
+	// No new connections are accepted
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		newConn, err := net.Dial("tcp", address)
+		if err != nil {
+			break
+		}
+		newConn.Close()
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the proxy to stop accepting connections")
+		}
+	}
+
+	// The response in progress is completed before the proxy exits
+	body, err := io.ReadAll(resp.Body)
+	if err != nil || string(body) != "firstother" {
+		t.Errorf("Expected the whole response, got %q, %v", body, err)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Errorf("Expected the proxy to exit with status 0, got %v", err)
+	}
+}
+
+func Test_AccessRules(t *testing.T) {
+	server := startUpstream(t)
+	rules := "deny all GET /metrics;allow 10.0.0.0/8 GET /private;deny all GET /private"
+
+	t.Run("Test the rules cover the endpoints of the proxy", func(t *testing.T) {
+		_, address := startProxyProcess(t, "-access-rules", rules)
+		if resp, body := send(t, address, "GET", "/metrics", ""); resp.StatusCode != 403 || body != "403 Forbidden\n" {
+			t.Errorf("Expected the metrics to be forbidden, got %d %q", resp.StatusCode, body)
+		}
+		if resp, _ := send(t, address, "GET", "/healthz", ""); resp.StatusCode != 200 {
+			t.Errorf("Expected a path without a rule to be allowed, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("Test deny and allow by the address of the client", func(t *testing.T) {
+		_, address := startProxyProcess(t, "-access-rules", rules)
+		if resp, _ := send(t, address, "GET", server.URL+"/private/a.html", ""); resp.StatusCode != 403 {
+			t.Errorf("Expected a client outside the allowed network to get 403, got %d", resp.StatusCode)
+		}
+		if resp, body := send(t, address, "GET", server.URL+"/site.html", ""); resp.StatusCode != 200 || body != "page /site.html" {
+			t.Errorf("Expected a path without a rule to be forwarded, got %d %q", resp.StatusCode, body)
+		}
+		// Without a trusted proxy the header is the client's own claim
+		if resp, _ := send(t, address, "GET", server.URL+"/private/a.html", "X-Forwarded-For: 10.1.2.3\r\n"); resp.StatusCode != 403 {
+			t.Errorf("Expected X-Forwarded-For from an untrusted client to be ignored, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("Test the client is found in X-Forwarded-For from a trusted proxy", func(t *testing.T) {
+		_, address := startProxyProcess(t, "-access-rules", rules, "-trusted-proxies", "127.0.0.1")
+		resp, body := send(t, address, "GET", server.URL+"/private/a.html", "X-Forwarded-For: 10.1.2.3\r\n")
+		if resp.StatusCode != 200 || body != "page /private/a.html" {
+			t.Errorf("Expected a client in the allowed network to be forwarded, got %d %q", resp.StatusCode, body)
+		}
+		if forwardedFor := server.lastForwardedFor(); forwardedFor != "10.1.2.3, 127.0.0.1" {
+			t.Errorf("Expected the proxy to append its client to X-Forwarded-For, got %q", forwardedFor)
+		}
+		if resp, _ := send(t, address, "GET", server.URL+"/private/a.html", "X-Forwarded-For: 192.168.1.1\r\n"); resp.StatusCode != 403 {
+			t.Errorf("Expected a client outside the allowed network to get 403, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("Test the rules match the cleaned path", func(t *testing.T) {
+		_, address := startProxyProcess(t, "-access-rules", rules)
+		for _, uri := range []string{
+			server.URL + "//private/a.html",
+			server.URL + "/x/../private/a.html",
+			server.URL + "/./private/a.html",
+			"//metrics",
+		} {
+			if resp, _ := send(t, address, "GET", uri, ""); resp.StatusCode != 403 {
+				t.Errorf("Expected %s to be forbidden, got %d", uri, resp.StatusCode)
+			}
+		}
+	})
+}
@@ -0,0 +1,233 @@
+/*
+Package accesslog writes one line per request for the server and the proxy.
+
+Three formats are supported. Common is the Common Log Format of Apache and nginx:
+
+	127.0.0.1 - - [17/Oct/2026:13:55:36 +0200] "GET /site.html HTTP/1.1" 200 2326
+
+Combined adds the Referer and User-Agent headers:
+
+	127.0.0.1 - - [17/Oct/2026:13:55:36 +0200] "GET /site.html HTTP/1.1" 200 2326 "-" "curl/8.5.0"
+
+JSON writes an object per line with all fields, including the duration of the request.
+The log is written to any io.Writer, such as stdout, or to a file that is rotated when it grows too large.
+*/
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Format is the format of the log lines.
+type Format int
+
+const (
+	Common Format = iota
+	Combined
+	JSON
+)
+
+// String returns the name of the format, as accepted by ParseFormat.
+func (f Format) String() string {
+	switch f {
+	case Common:
+		return "common"
+	case Combined:
+		return "combined"
+	case JSON:
+		return "json"
+	default:
+		return "Format(" + strconv.Itoa(int(f)) + ")"
+	}
+}
+
+// ParseFormat returns the format with the name "common", "combined" or "json".
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "common":
+		return Common, nil
+	case "combined":
+		return Combined, nil
+	case "json":
+		return JSON, nil
+	default:
+		return 0, fmt.Errorf("unknown access log format %q, expected common, combined or json", name)
+	}
+}
+
+// Entry is one request in the access log.
+type Entry struct {
+	Time       time.Time     // when the request arrived
+	RemoteAddr string        // address of the client, with or without the port
+	User       string        // authenticated user, if any
+	Method     string        // request method
+	URI        string        // request URI as sent by the client
+	Proto      string        // protocol, such as "HTTP/1.1"
+	Status     int           // status code of the response
+	Bytes      int64         // bytes of the response body that were sent
+	Duration   time.Duration // time from the request arriving to the response being written
+	Referer    string        // Referer header
+	UserAgent  string        // User-Agent header
+}
+
+// ClientIP returns the IP address of the client, RemoteAddr without the port.
+func (e Entry) ClientIP() string {
+	if host, _, err := net.SplitHostPort(e.RemoteAddr); err == nil {
+		return host
+	}
+	return e.RemoteAddr
+}
+
+// Logger writes entries to a writer in one format. It is safe for concurrent use.
+type Logger struct {
+	mutex  sync.Mutex
+	out    io.Writer
+	format Format
+}
+
+// New returns a Logger writing entries to out in format.
+func New(out io.Writer, format Format) *Logger {
+	return &Logger{out: out, format: format}
+}
+
+/*
+Open returns a Logger for the destination path: "-" logs to stdout, "off" or "" disables the log,
+and anything else is a file that is rotated when it is larger than maxSize, keeping maxBackups old files.
+*/
+func Open(path string, format Format, maxSize int64, maxBackups int) (*Logger, error) {
+	switch path {
+	case "", "off":
+		return New(io.Discard, format), nil
+	case "-":
+		return New(os.Stdout, format), nil
+	}
+	file, err := OpenRotatingFile(path, maxSize, maxBackups)
+	if err != nil {
+		return nil, err
+	}
+	return New(file, format), nil
+}
+
+// Log writes the entry as one line.
+func (l *Logger) Log(entry Entry) error {
+	if l == nil || l.out == io.Discard {
+		return nil
+	}
+	var line bytes.Buffer
+	switch l.format {
+	case JSON:
+		writeJSON(&line, entry)
+	default:
+		writeCommon(&line, entry, l.format == Combined)
+	}
+	line.WriteByte('\n')
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	_, err := l.out.Write(line.Bytes())
+	return err
+}
+
+// Close closes the destination of the log, when it is a file.
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if closer, ok := l.out.(io.Closer); ok && l.out != os.Stdout {
+		return closer.Close()
+	}
+	return nil
+}
+
+// writeCommon writes an entry in the Common Log Format, with the Referer and User-Agent when combined is true.
+func writeCommon(line *bytes.Buffer, entry Entry, combined bool) {
+	line.WriteString(dash(entry.ClientIP()))
+	line.WriteString(" - ")
+	line.WriteString(dash(strings.ReplaceAll(entry.User, " ", "_")))
+	line.WriteString(entry.Time.Format(" [02/Jan/2006:15:04:05 -0700] "))
+	quote(line, entry.Method+" "+entry.URI+" "+entry.Proto)
+	line.WriteString(" " + strconv.Itoa(entry.Status) + " ")
+	if entry.Bytes > 0 {
+		line.WriteString(strconv.FormatInt(entry.Bytes, 10))
+	} else {
+		line.WriteString("-")
+	}
+	if combined {
+		line.WriteByte(' ')
+		quote(line, dash(entry.Referer))
+		line.WriteByte(' ')
+		quote(line, dash(entry.UserAgent))
+	}
+}
+
+// writeJSON writes an entry as a JSON object.
+func writeJSON(line *bytes.Buffer, entry Entry) {
+	encoded, _ := json.Marshal(struct {
+		Time       string  `json:"time"`
+		RemoteIP   string  `json:"remote_ip"`
+		User       string  `json:"user,omitempty"`
+		Method     string  `json:"method"`
+		URI        string  `json:"uri"`
+		Proto      string  `json:"proto"`
+		Status     int     `json:"status"`
+		Bytes      int64   `json:"bytes"`
+		DurationMS float64 `json:"duration_ms"`
+		Referer    string  `json:"referer,omitempty"`
+		UserAgent  string  `json:"user_agent,omitempty"`
+	}{
+		Time:       entry.Time.Format(time.RFC3339Nano),
+		RemoteIP:   entry.ClientIP(),
+		User:       entry.User,
+		Method:     entry.Method,
+		URI:        entry.URI,
+		Proto:      entry.Proto,
+		Status:     entry.Status,
+		Bytes:      entry.Bytes,
+		DurationMS: float64(entry.Duration.Microseconds()) / 1000,
+		Referer:    entry.Referer,
+		UserAgent:  entry.UserAgent,
+	})
+	line.Write(encoded)
+}
+
+// dash returns "-" for an empty value, as the log formats write missing fields.
+func dash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+/*
+quote writes a value between double quotes, escaping quotes, backslashes and control characters
+the way Apache does, so a client can not break up a line or forge one with its headers.
+*/
+func quote(line *bytes.Buffer, value string) {
+	line.WriteByte('"')
+	for i := 0; i < len(value); {
+		r, size := utf8.DecodeRuneInString(value[i:])
+		switch {
+		case r == '"' || r == '\\':
+			line.WriteByte('\\')
+			line.WriteByte(value[i])
+		case r == utf8.RuneError && size == 1, r < 0x20, r == 0x7f:
+			fmt.Fprintf(line, "\\x%02x", value[i])
+		default:
+			line.WriteString(value[i : i+size])
+		}
+		i += size
+	}
+	line.WriteByte('"')
+}
@@ -0,0 +1,113 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormats(t *testing.T) {
+	entry := Entry{
+		Time:       time.Date(2026, 10, 17, 13, 55, 36, 0, time.FixedZone("", 2*60*60)),
+		RemoteAddr: "127.0.0.1:54321",
+		Method:     "GET",
+		URI:        "/site.html?q=1",
+		Proto:      "HTTP/1.1",
+		Status:     200,
+		Bytes:      2326,
+		Duration:   1500 * time.Microsecond,
+		UserAgent:  "curl/8.5.0 \"quoted\"\n",
+	}
+	tests := map[Format]string{
+		Common:   `127.0.0.1 - - [17/Oct/2026:13:55:36 +0200] "GET /site.html?q=1 HTTP/1.1" 200 2326` + "\n",
+		Combined: `127.0.0.1 - - [17/Oct/2026:13:55:36 +0200] "GET /site.html?q=1 HTTP/1.1" 200 2326 "-" "curl/8.5.0 \"quoted\"\x0a"` + "\n",
+	}
+	for format, expected := range tests {
+		var out bytes.Buffer
+		New(&out, format).Log(entry)
+		if out.String() != expected {
+			t.Errorf("%s format:\n got %q\nwant %q", format, out.String(), expected)
+		}
+	}
+
+	var out bytes.Buffer
+	New(&out, JSON).Log(entry)
+	var decoded map[string]any
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil {
+		t.Fatalf("Error decoding the JSON line %q: %v", out.String(), err)
+	}
+	if decoded["remote_ip"] != "127.0.0.1" || decoded["status"] != 200.0 || decoded["bytes"] != 2326.0 ||
+		decoded["duration_ms"] != 1.5 || decoded["user_agent"] != "curl/8.5.0 \"quoted\"\n" {
+		t.Errorf("Unexpected JSON line %s", out.String())
+	}
+
+	// A response without a body and a user with a space
+	out.Reset()
+	entry.Bytes, entry.User = 0, "some user"
+	New(&out, Common).Log(entry)
+	if !strings.HasPrefix(out.String(), "127.0.0.1 - some_user [") || !strings.HasSuffix(out.String(), " 200 -\n") {
+		t.Errorf("Unexpected line %q", out.String())
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	for _, format := range []Format{Common, Combined, JSON} {
+		if parsed, err := ParseFormat(strings.ToUpper(format.String())); err != nil || parsed != format {
+			t.Errorf("ParseFormat(%q) = %v, %v", format, parsed, err)
+		}
+	}
+	if _, err := ParseFormat("xml"); err == nil {
+		t.Errorf("Expected an error for an unknown format")
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	file, err := OpenRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := file.Write([]byte(line)); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	file.Close()
+
+	// Every line is larger than half the limit, so each starts a new file and the first is dropped
+	expected := map[string]string{path: "fourth\n", path + ".1": "third\n", path + ".2": "second\n"}
+	for name, content := range expected {
+		if data, err := os.ReadFile(name); err != nil || string(data) != content {
+			t.Errorf("Expected %s to contain %q, got %q, %v", name, content, data, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expected at most 2 backups")
+	}
+
+	// Reopening appends to the existing file
+	file, _ = OpenRotatingFile(path, 100, 2)
+	file.Write([]byte("fifth\n"))
+	file.Close()
+	if data, _ := os.ReadFile(path); string(data) != "fourth\nfifth\n" {
+		t.Errorf("Expected the reopened file to be appended to, got %q", data)
+	}
+
+	// A file that fails to close is still rotated, and the next lines go to the new file
+	file, _ = OpenRotatingFile(path, 10, 2)
+	file.file.Close()
+	if _, err := file.Write([]byte("sixth\n")); err != nil {
+		t.Errorf("Expected the write after a failed close to succeed, got %v", err)
+	}
+	file.Close()
+	if data, _ := os.ReadFile(path); string(data) != "sixth\n" {
+		t.Errorf("Expected a new file after a failed close, got %q", data)
+	}
+	if data, _ := os.ReadFile(path + ".1"); string(data) != "fourth\nfifth\n" {
+		t.Errorf("Expected the old file to be rotated after a failed close, got %q", data)
+	}
+}
@@ -0,0 +1,108 @@
+package accesslog
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+/*
+RotatingFile is a log file that is rotated when a write would make it larger than its maximum size.
+The file is renamed to path.1, an older path.1 to path.2 and so on, keeping at most maxBackups old files,
+and a new file is started at path. It is safe for concurrent use.
+*/
+type RotatingFile struct {
+	mutex      sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// OpenRotatingFile opens the log file at path for appending. A maxSize of 0 never rotates.
+func OpenRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	r := &RotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Write appends data to the file, rotating it first when data does not fit.
+func (r *RotatingFile) Write(data []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.file == nil {
+		return 0, os.ErrClosed
+	}
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(data)) > r.maxSize {
+		// When the rotation fails the line is still written, to the file that could not be moved away
+		if err := r.rotate(); err != nil && r.file == nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(data)
+	r.size += int64(n)
+	return n, err
+}
+
+// Close syncs and closes the file.
+func (r *RotatingFile) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	r.file.Sync()
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+// open opens the file at path for appending, and finds out how large it already is.
+func (r *RotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file = file
+	r.size = info.Size()
+	return nil
+}
+
+/*
+rotate moves the current file to the first backup, shifting older backups up, and starts a new file.
+A file that fails to close is still given up and rotated, so the log does not stay stuck on it.
+*/
+func (r *RotatingFile) rotate() error {
+	closeErr := r.file.Close()
+	r.file = nil
+	var err error
+	if r.maxBackups < 1 {
+		err = os.Remove(r.path)
+	} else {
+		os.Remove(r.backup(r.maxBackups))
+		for i := r.maxBackups - 1; i >= 1; i-- {
+			os.Rename(r.backup(i), r.backup(i+1)) // Missing backups are skipped
+		}
+		err = os.Rename(r.path, r.backup(1))
+	}
+	if openErr := r.open(); openErr != nil {
+		return openErr
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	return err
+}
+
+// backup returns the path of the i-th old file.
+func (r *RotatingFile) backup(i int) string {
+	return fmt.Sprintf("%s.%d", r.path, i)
+}
@@ -0,0 +1,150 @@
+/*
+Package admission limits how many connections the server and the proxy handle at the same time.
+
+A Controller has a number of slots. A connection that finds all slots taken waits in a
+bounded queue for at most the queue timeout. The queue is first in, first out: a slot that is given back
+goes to the caller that has waited longest, so no caller is overtaken. When the queue is full, or the wait times out,
+the connection is refused, and the caller answers 503 Service Unavailable with a Retry-After header,
+instead of leaving the client waiting without an answer.
+*/
+package admission
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrQueueFull is returned by Acquire when all slots are taken and the wait queue is full.
+var ErrQueueFull = errors.New("admission queue is full")
+
+// ErrTimeout is returned by Acquire when no slot became free within the queue timeout.
+var ErrTimeout = errors.New("timed out waiting for admission")
+
+// Controller hands out a limited number of slots. It is safe for concurrent use.
+type Controller struct {
+	mutex     sync.Mutex
+	limit     int
+	active    int
+	queue     []chan struct{} // a ticket per waiting caller in arrival order, closed when the caller gets a slot
+	queueSize int
+	timeout   time.Duration
+	rejected  int64
+}
+
+// Stats is a snapshot of the state of a Controller.
+type Stats struct {
+	Active    int   `json:"active"`     // slots in use
+	Limit     int   `json:"limit"`      // number of slots
+	Waiting   int   `json:"waiting"`    // callers in the wait queue
+	QueueSize int   `json:"queue_size"` // maximum number of waiting callers
+	Rejected  int64 `json:"rejected"`   // callers refused since the Controller was created
+}
+
+// Saturated reports whether all slots are taken and the queue is full, so a new caller would be refused at once.
+func (s Stats) Saturated() bool {
+	return s.Active >= s.Limit && s.Waiting >= s.QueueSize
+}
+
+/*
+New returns a Controller with limit slots, where at most queueSize callers wait for at most timeout.
+With a queueSize of 0 a caller is refused as soon as all slots are taken.
+*/
+func New(limit int, queueSize int, timeout time.Duration) *Controller {
+	return &Controller{
+		limit:     limit,
+		queueSize: queueSize,
+		timeout:   timeout,
+	}
+}
+
+/*
+Acquire takes a slot, waiting in the queue when all are taken, and returns the function that gives it back.
+It returns ErrQueueFull when the queue is full, ErrTimeout when the wait took longer than the queue timeout,
+and the error of ctx when it is done first.
+*/
+func (c *Controller) Acquire(ctx context.Context) (func(), error) {
+	c.mutex.Lock()
+	if c.active < c.limit && len(c.queue) == 0 {
+		c.active++
+		c.mutex.Unlock()
+		return c.release, nil
+	}
+	if len(c.queue) >= c.queueSize {
+		c.rejected++
+		c.mutex.Unlock()
+		return nil, ErrQueueFull
+	}
+	ticket := make(chan struct{})
+	c.queue = append(c.queue, ticket)
+	c.mutex.Unlock()
+
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-ticket:
+		return c.release, nil
+	case <-timer.C:
+		err = ErrTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.rejected++
+	for i, waiting := range c.queue {
+		if waiting == ticket {
+			c.queue = append(c.queue[:i], c.queue[i+1:]...)
+			return nil, err
+		}
+	}
+	// The slot was handed over while the wait ended, it goes on to the next caller
+	c.handOver()
+	return nil, err
+}
+
+// release gives a slot back, to the caller that has waited longest when there is one.
+func (c *Controller) release() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.handOver()
+}
+
+// handOver passes a slot that is given back to the first caller in the queue, or frees it. The mutex must be held.
+func (c *Controller) handOver() {
+	if len(c.queue) == 0 {
+		c.active--
+		return
+	}
+	ticket := c.queue[0]
+	c.queue = c.queue[1:]
+	close(ticket)
+}
+
+// Stats returns the number of slots in use, the queue depth and the number of refused callers.
+func (c *Controller) Stats() Stats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return Stats{
+		Active:    c.active,
+		Limit:     c.limit,
+		Waiting:   len(c.queue),
+		QueueSize: c.queueSize,
+		Rejected:  c.rejected,
+	}
+}
+
+/*
+RetryAfter returns the number of seconds a refused client is asked to wait before trying again,
+the queue timeout rounded up to whole seconds and at least 1.
+*/
+func (c *Controller) RetryAfter() int {
+	seconds := int((c.timeout + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		return 1
+	}
+	return seconds
+}
@@ -0,0 +1,168 @@
+package admission
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestController(t *testing.T) {
+	controller := New(2, 1, 50*time.Millisecond)
+
+	releaseFirst, err := controller.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	releaseSecond, err := controller.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if stats := controller.Stats(); stats.Active != 2 || stats.Limit != 2 || stats.Saturated() {
+		t.Errorf("Expected 2 of 2 slots in use and room in the queue, got %+v", stats)
+	}
+
+	// All slots are taken, a caller waits and times out
+	start := time.Now()
+	if _, err := controller.Acquire(context.Background()); err != ErrTimeout {
+		t.Errorf("Expected ErrTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Expected to wait for the queue timeout, waited %v", elapsed)
+	}
+
+	// A caller in the queue gets the slot that is released
+	acquired := make(chan error)
+	go func() {
+		release, err := controller.Acquire(context.Background())
+		if err == nil {
+			release()
+		}
+		acquired <- err
+	}()
+	for controller.Stats().Waiting != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if !controller.Stats().Saturated() {
+		t.Errorf("Expected full slots and a full queue to be saturated, got %+v", controller.Stats())
+	}
+	// The queue holds one caller, so the next is refused at once
+	if _, err := controller.Acquire(context.Background()); err != ErrQueueFull {
+		t.Errorf("Expected ErrQueueFull, got %v", err)
+	}
+	releaseFirst()
+	if err := <-acquired; err != nil {
+		t.Errorf("Expected the waiting caller to get the slot, got %v", err)
+	}
+
+	// A cancelled context stops the wait
+	releaseThird, _ := controller.Acquire(context.Background())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := controller.Acquire(ctx); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	releaseSecond()
+	releaseThird()
+
+	if stats := controller.Stats(); stats.Active != 0 || stats.Waiting != 0 || stats.Rejected != 3 {
+		t.Errorf("Expected no slots in use and 3 rejected, got %+v", stats)
+	}
+}
+
+func TestControllerIsFirstInFirstOut(t *testing.T) {
+	controller := New(1, 5, time.Second)
+	release, _ := controller.Acquire(context.Background())
+
+	// The callers queue one after the other, and get the slot in that order as it is passed on
+	order := make(chan int, 5)
+	for i := 0; i < 5; i++ {
+		go func() {
+			release, err := controller.Acquire(context.Background())
+			if err != nil {
+				t.Errorf("Caller %d: unexpected error: %v", i, err)
+				order <- -1
+				return
+			}
+			order <- i
+			release()
+		}()
+		for controller.Stats().Waiting != i+1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	release()
+	for i := 0; i < 5; i++ {
+		if got := <-order; got != i {
+			t.Errorf("Expected caller %d to get the slot next, got %d", i, got)
+		}
+	}
+	if stats := controller.Stats(); stats.Active != 0 || stats.Waiting != 0 {
+		t.Errorf("Expected no slots in use, got %+v", stats)
+	}
+}
+
+func TestQueueTimeoutUnderContention(t *testing.T) {
+	controller := New(1, 1, 200*time.Millisecond)
+	release, _ := controller.Acquire(context.Background())
+
+	// A waiting caller is not overtaken by callers that keep arriving and taking the slot
+	acquired := make(chan error)
+	go func() {
+		release, err := controller.Acquire(context.Background())
+		if err == nil {
+			release()
+		}
+		acquired <- err
+	}()
+	for controller.Stats().Waiting != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	stop := make(chan bool)
+	stopped := make(chan bool)
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if release, err := controller.Acquire(context.Background()); err == nil {
+				release()
+			}
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	release()
+	if err := <-acquired; err != nil {
+		t.Errorf("Expected the waiting caller to get the released slot before its timeout, got %v", err)
+	}
+	close(stop)
+	<-stopped
+
+	// A caller whose wait times out leaves the queue, and the slot goes to the next one
+	release, _ = controller.Acquire(context.Background())
+	start := time.Now()
+	if _, err := controller.Acquire(context.Background()); err != ErrTimeout || time.Since(start) < 200*time.Millisecond {
+		t.Errorf("Expected ErrTimeout after the queue timeout, got %v after %v", err, time.Since(start))
+	}
+	if stats := controller.Stats(); stats.Waiting != 0 || stats.Active != 1 {
+		t.Errorf("Expected the timed out caller to leave the queue, got %+v", stats)
+	}
+	release()
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := map[time.Duration]int{
+		0:                       1,
+		300 * time.Millisecond:  1,
+		time.Second:             1,
+		1500 * time.Millisecond: 2,
+		5 * time.Second:         5,
+	}
+	for timeout, expected := range tests {
+		if seconds := New(1, 1, timeout).RetryAfter(); seconds != expected {
+			t.Errorf("RetryAfter with timeout %v = %d, expected %d", timeout, seconds, expected)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"http_server/htpasswd"
+)
+
+/*
+ruleMap maps path prefixes to the methods that need authentication below them, written as
+"/=POST PUT DELETE,/private=*" on the command line. "*" stands for every method, no methods make a path public.
+The longest prefix that matches a path decides, "/private" matches /private and /private/notes.txt but not /privateer.
+*/
+type ruleMap map[string]stringList
+
+func (m *ruleMap) String() string {
+	var items []string
+	for prefix, methods := range *m {
+		items = append(items, prefix+"="+strings.Join(methods, " "))
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
+
+func (m *ruleMap) Set(value string) error {
+	*m = ruleMap{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		prefix, methods, found := strings.Cut(item, "=")
+		if !found {
+			return fmt.Errorf("invalid rule %q, expected path=METHOD METHOD", item)
+		}
+		(*m)[strings.TrimSpace(prefix)] = stringList(strings.Fields(strings.ToUpper(methods)))
+	}
+	return nil
+}
+
+// validateAuth checks the htpasswd file and the rules of who has to authenticate, and returns all problems found.
+func (c serverConfig) validateAuth() []error {
+	var errs []error
+	if c.Htpasswd != "" {
+		if _, err := htpasswd.Open(c.Htpasswd); err != nil {
+			errs = append(errs, fmt.Errorf("htpasswd: %v", err))
+		}
+	}
+	if strings.Contains(c.AuthRealm, `"`) {
+		errs = append(errs, fmt.Errorf("auth realm can not contain quotes, got %s", c.AuthRealm))
+	}
+	known := strings.Split(allowedMethods, ", ")
+	for prefix, methods := range c.AuthRules {
+		if !strings.HasPrefix(prefix, "/") {
+			errs = append(errs, fmt.Errorf("auth rule path must start with /, got %q", prefix))
+		}
+		for _, method := range methods {
+			if method != "*" && !contains(known, method) {
+				errs = append(errs, fmt.Errorf("auth rule for %s: unknown method %q", prefix, method))
+			}
+		}
+	}
+	return errs
+}
+
+// contains reports whether list has the value.
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// credentials are the users of the -htpasswd file, loaded by main. Without a file nobody has to authenticate.
+var credentials atomic.Pointer[htpasswd.File]
+
+/*
+needsAuthentication reports whether a request has to be made by a user of the htpasswd file,
+by the rule with the longest path prefix that matches. HEAD follows the rule of GET.
+The rules are matched against the cleaned path, so "//private" or "/x/../private" can not get around them.
+*/
+func needsAuthentication(request *http.Request) bool {
+	method := request.Method
+	if method == "HEAD" {
+		method = "GET"
+	}
+	longest := ""
+	var methods stringList
+	for prefix, ruleMethods := range config.AuthRules {
+		if len(prefix) >= len(longest) && matchesPrefix(requestPath(request), prefix) {
+			longest, methods = prefix, ruleMethods
+		}
+	}
+	return contains(methods, "*") || contains(methods, method)
+}
+
+// matchesPrefix reports whether path is prefix or below it, whole path segments are compared.
+func matchesPrefix(path string, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+/*
+authenticate checks the Basic credentials of a request that needs authentication and reports whether it may go on.
+It returns the user when the credentials were checked and are right, and "" for a request that needs none.
+*/
+func authenticate(request *http.Request) (string, bool) {
+	users := credentials.Load()
+	if users == nil || !needsAuthentication(request) {
+		return "", true
+	}
+	user, password, ok := request.BasicAuth()
+	if ok && users.Authenticate(user, password) {
+		return user, true
+	}
+	if ok {
+		requestLogger(request).Info("Authentication failed", "user", user, "method", request.Method, "uri", request.RequestURI)
+	}
+	return "", false
+}
+
+// challenge answers 401 Unauthorized with a WWW-Authenticate header, which makes browsers ask for a user and password.
+func challenge(response http.ResponseWriter) error {
+	response.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s", charset="UTF-8"`, config.AuthRealm))
+	return giveResponse(response, 401)
+}
+
+// authenticatedUser returns the user name a request was sent with for the access log, which like Apache's
+// does not tell whether the password was right, the status does.
+func authenticatedUser(request *http.Request) string {
+	if credentials.Load() == nil {
+		return ""
+	}
+	user, _, _ := request.BasicAuth()
+	return user
+}
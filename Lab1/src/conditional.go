@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+/*
+fileETag creates the entity tag of a file from its modification time and size.
+The tag is strong, except for a file changed within the last second: it could change
+again without getting a new modification time, so it only gets a weak tag.
+*/
+func fileETag(fileInfo os.FileInfo) string {
+	tag := fmt.Sprintf(`"%x-%x"`, fileInfo.ModTime().UnixNano(), fileInfo.Size())
+	if time.Since(fileInfo.ModTime()) < time.Second {
+		return "W/" + tag
+	}
+	return tag
+}
+
+// setValidators adds the ETag and Last-Modified headers for a file to the response.
+func setValidators(response http.ResponseWriter, etag string, modTime time.Time) {
+	response.Header().Set("ETag", etag)
+	response.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+}
+
+/*
+checkPreconditions evaluates the conditional headers of a request in the order of RFC 9110 section 13.2.2,
+for a resource with the given entity tag and modification time. An empty etag means the resource does not exist.
+Returns 0 if the request should be performed, 304 (Not Modified) or 412 (Precondition Failed) otherwise.
+*/
+func checkPreconditions(request *http.Request, etag string, modTime time.Time) int {
+	safe := request.Method == "GET" || request.Method == "HEAD"
+
+	if ifMatch := request.Header.Get("If-Match"); ifMatch != "" {
+		if !etagListMatches(ifMatch, etag, true) {
+			return 412
+		}
+	} else if ifUnmodifiedSince := request.Header.Get("If-Unmodified-Since"); ifUnmodifiedSince != "" && etag != "" {
+		date, err := http.ParseTime(ifUnmodifiedSince)
+		if err == nil && modTime.Truncate(time.Second).After(date) {
+			return 412
+		}
+	}
+
+	if ifNoneMatch := request.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if etagListMatches(ifNoneMatch, etag, false) {
+			if safe {
+				return 304
+			}
+			return 412
+		}
+	} else if ifModifiedSince := request.Header.Get("If-Modified-Since"); ifModifiedSince != "" && safe && etag != "" {
+		date, err := http.ParseTime(ifModifiedSince)
+		if err == nil && !modTime.Truncate(time.Second).After(date) {
+			return 304
+		}
+	}
+	return 0
+}
+
+/*
+etagListMatches reports whether a header value such as `"a", W/"b"` or `*` matches etag.
+The strong comparison used by If-Match and If-Range requires both tags to be strong,
+the weak comparison used by If-None-Match ignores the W/ prefix.
+*/
+func etagListMatches(list string, etag string, strong bool) bool {
+	if etag == "" {
+		return false
+	}
+	if strings.TrimSpace(list) == "*" {
+		return true
+	}
+	for list != "" {
+		list = strings.TrimLeft(list, " \t,")
+		if list == "" {
+			break
+		}
+		candidate, rest, ok := scanETag(list)
+		if !ok {
+			return false
+		}
+		if etagsEqual(candidate, etag, strong) {
+			return true
+		}
+		list = rest
+	}
+	return false
+}
+
+// scanETag reads one entity tag from the start of s and returns it and the rest of s.
+func scanETag(s string) (string, string, bool) {
+	start := 0
+	if strings.HasPrefix(s, "W/") {
+		start = 2
+	}
+	if len(s) <= start || s[start] != '"' {
+		return "", "", false
+	}
+	end := strings.IndexByte(s[start+1:], '"')
+	if end < 0 {
+		return "", "", false
+	}
+	end += start + 2
+	return s[:end], s[end:], true
+}
+
+// etagsEqual compares two entity tags with the strong or the weak comparison.
+func etagsEqual(a string, b string, strong bool) bool {
+	if strong {
+		return a == b && !strings.HasPrefix(a, "W/")
+	}
+	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
@@ -0,0 +1,579 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"http_server/accesslog"
+	"http_server/ipfilter"
+	"http_server/logging"
+	"http_server/mimetype"
+	"http_server/tlsconfig"
+)
+
+/*
+serverConfig holds the settings of the server.
+The settings are read in this order, where later ones override earlier ones:
+the defaults, a JSON config file, environment variables (SERVER_ROOT, SERVER_PORT, ...) and command-line flags.
+*/
+type serverConfig struct {
+	Root             string         `json:"root"`
+	UploadDir        string         `json:"upload_dir"`
+	Host             string         `json:"host"`
+	Port             int            `json:"port"`
+	MaxConnections   int            `json:"max_connections"`
+	QueueSize        int            `json:"queue_size"`
+	QueueTimeout     duration       `json:"queue_timeout"`
+	IdleTimeout      duration       `json:"idle_timeout"`
+	HeaderTimeout    duration       `json:"header_timeout"`
+	BodyTimeout      duration       `json:"body_timeout"`
+	MinBodyRate      byteSize       `json:"min_body_rate"`
+	WriteTimeout     duration       `json:"write_timeout"`
+	ShutdownTimeout  duration       `json:"shutdown_timeout"`
+	AllowedTypes     stringList     `json:"allowed_types"`
+	MimeTypes        string         `json:"mime_types"`
+	MaxUploadSize    byteSize       `json:"max_upload_size"`
+	UploadLimits     sizeMap        `json:"upload_limits"`
+	AccessLog        string         `json:"access_log"`
+	AccessLogFormat  string         `json:"access_log_format"`
+	AccessLogMaxSize byteSize       `json:"access_log_max_size"`
+	AccessLogBackups int            `json:"access_log_backups"`
+	LogLevel         string         `json:"log_level"`
+	LogFormat        string         `json:"log_format"`
+	MetricsPath      string         `json:"metrics_path"`
+	TLSCert          string         `json:"tls_cert"`
+	TLSKey           string         `json:"tls_key"`
+	DevTLS           bool           `json:"dev_tls"`
+	TLSMinVersion    string         `json:"tls_min_version"`
+	TLSCipherSuites  stringList     `json:"tls_cipher_suites"`
+	RedirectPort     int            `json:"redirect_port"`
+	HTTP2            bool           `json:"http2"`
+	Sites            siteMap        `json:"sites"`
+	UnknownHost      string         `json:"unknown_host"`
+	Htpasswd         string         `json:"htpasswd"`
+	AuthRealm        string         `json:"auth_realm"`
+	AuthRules        ruleMap        `json:"auth_rules"`
+	RateLimits       rateLimitMap   `json:"rate_limits"`
+	AccessRules      accessRuleList `json:"access_rules"`
+	TrustedProxies   stringList     `json:"trusted_proxies"`
+}
+
+// config is the configuration the server is running with.
+var config = defaultConfig()
+
+// mimeTypes maps file names to the content types the server sends.
+var mimeTypes = mimetype.New()
+
+// accessLog records every request, it is opened by main from the configuration.
+var accessLog = accesslog.New(io.Discard, accesslog.Combined)
+
+// mimeOverrideFile is the name of the files in the document root that change MIME types for their directory.
+const mimeOverrideFile = ".mime.types"
+
+// defaultConfig returns the configuration used when nothing else is given.
+func defaultConfig() serverConfig {
+	return serverConfig{
+		Root:            "Lab1/files",
+		Host:            "",
+		Port:            8080,
+		MaxConnections:  10,
+		QueueSize:       50,
+		QueueTimeout:    duration{5 * time.Second},
+		IdleTimeout:     duration{5 * time.Second},
+		HeaderTimeout:   duration{10 * time.Second},
+		BodyTimeout:     duration{30 * time.Second},
+		MinBodyRate:     1 << 10,
+		WriteTimeout:    duration{30 * time.Second},
+		ShutdownTimeout: duration{10 * time.Second},
+		AllowedTypes: stringList{
+			"text/html", "text/plain", "text/css", "text/javascript", "application/json",
+			"image/gif", "image/jpeg", "image/png", "image/svg+xml", "image/webp", "image/x-icon",
+			"application/pdf", "font/woff", "font/woff2", "video/mp4",
+		},
+		MaxUploadSize:    10 << 20,
+		UploadLimits:     sizeMap{},
+		AccessLog:        "-",
+		AccessLogFormat:  "combined",
+		AccessLogMaxSize: 100 << 20,
+		AccessLogBackups: 5,
+		LogLevel:         "info",
+		LogFormat:        "text",
+		MetricsPath:      "/metrics",
+		TLSMinVersion:    "1.2",
+		HTTP2:            true,
+		Sites:            siteMap{},
+		UnknownHost:      "default",
+		AuthRealm:        "http_server",
+		AuthRules:        ruleMap{"/": {"POST", "PUT", "DELETE"}},
+		RateLimits:       rateLimitMap{},
+	}
+}
+
+/*
+loadConfig reads the configuration from the command-line arguments (without the program name)
+and the environment, through getenv. A single argument after the flags is taken as the port,
+so the server can still be started as "myserver 8080".
+It returns the configuration, whether --print-config was given, and an error if a setting is invalid.
+*/
+func loadConfig(args []string, getenv func(string) string) (serverConfig, bool, error) {
+	configFile := getenv("SERVER_CONFIG")
+	printConfig := false
+
+	// The first pass over the flags only finds the config file, and reports unknown flags
+	scratch := defaultConfig()
+	if err := newFlagSet(&scratch, &configFile, &printConfig).Parse(args); err != nil {
+		return scratch, false, err
+	}
+
+	loaded := defaultConfig()
+	if configFile != "" {
+		if err := readConfigFile(configFile, &loaded); err != nil {
+			return loaded, printConfig, err
+		}
+	}
+
+	// Environment variables and flags are set through the same flag set, flags last
+	flags := newFlagSet(&loaded, new(string), new(bool))
+	var errs []error
+	flags.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" || f.Name == "print-config" {
+			return
+		}
+		name := envName(f.Name)
+		if value := getenv(name); value != "" {
+			if err := flags.Set(f.Name, value); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", name, err))
+			}
+		}
+	})
+	if err := flags.Parse(args); err != nil {
+		return loaded, printConfig, err
+	}
+
+	switch flags.NArg() {
+	case 0:
+	case 1:
+		port, err := strconv.Atoi(flags.Arg(0))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("only numbers can be given as port, %q is incorrect input", flags.Arg(0)))
+		}
+		loaded.Port = port
+	default:
+		errs = append(errs, fmt.Errorf("unexpected arguments %v", flags.Args()[1:]))
+	}
+
+	if loaded.UploadDir == "" {
+		loaded.UploadDir = loaded.Root
+	}
+	if loaded.MetricsPath == "off" {
+		loaded.MetricsPath = ""
+	}
+	errs = append(errs, loaded.validate())
+	return loaded, printConfig, errors.Join(errs...)
+}
+
+// newFlagSet creates the command-line flags, which write their values to c.
+func newFlagSet(c *serverConfig, configFile *string, printConfig *bool) *flag.FlagSet {
+	flags := flag.NewFlagSet("http_server", flag.ContinueOnError)
+	flags.StringVar(configFile, "config", *configFile, "path of a JSON config file")
+	flags.BoolVar(printConfig, "print-config", false, "print the configuration as JSON and exit")
+	flags.StringVar(&c.Root, "root", c.Root, "document root to serve files from")
+	flags.StringVar(&c.UploadDir, "upload-dir", c.UploadDir, "directory uploaded files are saved to (default the document root)")
+	flags.StringVar(&c.Host, "host", c.Host, "host or IP address to bind to (default all interfaces)")
+	flags.IntVar(&c.Port, "port", c.Port, "port to listen on")
+	flags.IntVar(&c.MaxConnections, "max-connections", c.MaxConnections, "maximum number of connections handled at the same time")
+	flags.IntVar(&c.QueueSize, "queue-size", c.QueueSize, "maximum number of connections waiting for a free slot, more are answered 503")
+	flags.Var(&c.QueueTimeout, "queue-timeout", "how long a connection may wait for a free slot before it is answered 503")
+	flags.Var(&c.IdleTimeout, "idle-timeout", "how long a keep-alive connection may wait for its next request")
+	flags.Var(&c.HeaderTimeout, "header-timeout", "how long the headers of a request may take to arrive once it has started")
+	flags.Var(&c.BodyTimeout, "body-timeout", "how long a read of a request body may wait for data")
+	flags.Var(&c.MinBodyRate, "min-body-rate", "slowest average rate per second a request body may arrive at, on top of the body timeout, such as 1KB (0 for no minimum)")
+	flags.Var(&c.WriteTimeout, "write-timeout", "how long a write to a client that does not read may stall")
+	flags.Var(&c.ShutdownTimeout, "shutdown-timeout", "how long active connections may finish after SIGTERM before they are closed")
+	flags.Var(&c.AllowedTypes, "allowed-types", "comma separated list of MIME types that may be served and uploaded")
+	flags.StringVar(&c.MimeTypes, "mime-types", c.MimeTypes, "path of a mime.types file with more extensions")
+	flags.Var(&c.MaxUploadSize, "max-upload-size", "largest upload accepted, such as 512KB or 10MB")
+	flags.Var(&c.UploadLimits, "upload-limits", "upload size limits per type, such as image/jpeg=5MB,video/mp4=100MB")
+	flags.StringVar(&c.AccessLog, "access-log", c.AccessLog, `file the access log is written to, "-" for stdout or "off"`)
+	flags.StringVar(&c.AccessLogFormat, "access-log-format", c.AccessLogFormat, "format of the access log: common, combined or json")
+	flags.Var(&c.AccessLogMaxSize, "access-log-max-size", "size at which the access log file is rotated (0 never rotates)")
+	flags.IntVar(&c.AccessLogBackups, "access-log-backups", c.AccessLogBackups, "number of rotated access log files that are kept")
+	flags.StringVar(&c.LogLevel, "log-level", c.LogLevel, "lowest level of the messages that are logged: debug, info, warn or error")
+	flags.StringVar(&c.LogFormat, "log-format", c.LogFormat, "format of the log messages: text or json")
+	flags.StringVar(&c.MetricsPath, "metrics-path", c.MetricsPath, `path the Prometheus metrics are served at, or "off"`)
+	flags.StringVar(&c.TLSCert, "tls-cert", c.TLSCert, "PEM certificate file, serves HTTPS together with -tls-key, reloaded when it changes")
+	flags.StringVar(&c.TLSKey, "tls-key", c.TLSKey, "PEM private key file of the -tls-cert certificate")
+	flags.BoolVar(&c.DevTLS, "dev-tls", c.DevTLS, "serve HTTPS with a self-signed certificate for localhost, created at startup")
+	flags.StringVar(&c.TLSMinVersion, "tls-min-version", c.TLSMinVersion, "oldest TLS version accepted: 1.0, 1.1, 1.2 or 1.3")
+	flags.Var(&c.TLSCipherSuites, "tls-cipher-suites", "comma separated cipher suites for TLS 1.2 and older, such as TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 (default chosen by Go)")
+	flags.IntVar(&c.RedirectPort, "redirect-port", c.RedirectPort, "port of a plain HTTP listener that redirects to HTTPS (default none)")
+	flags.BoolVar(&c.HTTP2, "http2", c.HTTP2, "serve HTTP/2, negotiated with ALPN over TLS and with prior knowledge (h2c) over plain HTTP")
+	flags.Var(&c.Sites, "sites", "virtual hosts with their document roots, such as example.com=/srv/example,*.example.org=/srv/org")
+	flags.StringVar(&c.UnknownHost, "unknown-host", c.UnknownHost, `what requests for other hosts than the sites get: "default" serves -root, "reject" answers 421 Misdirected Request`)
+	flags.StringVar(&c.Htpasswd, "htpasswd", c.Htpasswd, "htpasswd file with the users that may make the requests of -auth-rules, bcrypt or SHA hashed (default nobody has to authenticate)")
+	flags.StringVar(&c.AuthRealm, "auth-realm", c.AuthRealm, "realm of the WWW-Authenticate header, shown by browsers when they ask for a password")
+	flags.Var(&c.AuthRules, "auth-rules", `methods that need authentication per path prefix, such as "/=POST PUT DELETE,/private=*" (default uploads need it)`)
+	flags.Var(&c.RateLimits, "rate-limits", "requests per second and burst per client and path prefix, with upload bytes per second and burst, such as /=10:20,/upload=2:5:1MB:10MB (default none)")
+	flags.Var(&c.AccessRules, "access-rules", `IP rules separated by ";", the first that holds the client decides, such as "allow 10.0.0.0/8 POST,PUT,DELETE /;deny all POST,PUT,DELETE /" (default all allowed)`)
+	flags.Var(&c.TrustedProxies, "trusted-proxies", "comma separated networks of proxies whose X-Forwarded-For header tells the client, such as 127.0.0.1,10.0.0.0/8")
+	return flags
+}
+
+// envName returns the environment variable for a flag, "idle-timeout" is read from SERVER_IDLE_TIMEOUT.
+func envName(flagName string) string {
+	return "SERVER_" + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// readConfigFile reads the JSON config file at path into c. Settings missing from the file keep their value.
+func readConfigFile(path string, c *serverConfig) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(c); err != nil {
+		return fmt.Errorf("config file %s: %v", path, err)
+	}
+	return nil
+}
+
+// validate checks that the settings can be used and returns all problems found.
+func (c serverConfig) validate() error {
+	var errs []error
+	for name, dir := range map[string]string{"root": c.Root, "upload directory": c.UploadDir} {
+		if err := checkDir(dir); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", name, err))
+		}
+	}
+	if c.Port < 1 || c.Port > 65535 {
+		errs = append(errs, fmt.Errorf("port %d is not between 1 and 65535", c.Port))
+	}
+	if c.MaxConnections < 1 {
+		errs = append(errs, fmt.Errorf("max connections must be at least 1, got %d", c.MaxConnections))
+	}
+	if c.QueueSize < 0 {
+		errs = append(errs, fmt.Errorf("queue size can not be negative, got %d", c.QueueSize))
+	}
+	if c.QueueTimeout.Duration <= 0 {
+		errs = append(errs, fmt.Errorf("queue timeout must be positive, got %s", c.QueueTimeout))
+	}
+	if c.IdleTimeout.Duration <= 0 {
+		errs = append(errs, fmt.Errorf("idle timeout must be positive, got %s", c.IdleTimeout))
+	}
+	for name, timeout := range map[string]duration{"header": c.HeaderTimeout, "body": c.BodyTimeout, "write": c.WriteTimeout} {
+		if timeout.Duration <= 0 {
+			errs = append(errs, fmt.Errorf("%s timeout must be positive, got %s", name, timeout))
+		}
+	}
+	if c.MinBodyRate < 0 {
+		errs = append(errs, fmt.Errorf("min body rate can not be negative, got %s", c.MinBodyRate))
+	}
+	if c.ShutdownTimeout.Duration < 0 {
+		errs = append(errs, fmt.Errorf("shutdown timeout can not be negative, got %s", c.ShutdownTimeout))
+	}
+	if len(c.AllowedTypes) == 0 {
+		errs = append(errs, errors.New("at least one allowed type is needed"))
+	}
+	if c.MaxUploadSize <= 0 {
+		errs = append(errs, fmt.Errorf("max upload size must be positive, got %s", c.MaxUploadSize))
+	}
+	for contentType, limit := range c.UploadLimits {
+		if limit <= 0 {
+			errs = append(errs, fmt.Errorf("upload limit for %s must be positive, got %s", contentType, limit))
+		}
+	}
+	if _, err := accesslog.ParseFormat(c.AccessLogFormat); err != nil {
+		errs = append(errs, err)
+	}
+	if c.AccessLogMaxSize < 0 || c.AccessLogBackups < 0 {
+		errs = append(errs, fmt.Errorf("access log max size and backups can not be negative, got %s and %d", c.AccessLogMaxSize, c.AccessLogBackups))
+	}
+	if _, err := logging.ParseLevel(c.LogLevel); err != nil {
+		errs = append(errs, err)
+	}
+	if err := logging.CheckFormat(c.LogFormat); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.validateTLS(); err != nil {
+		errs = append(errs, err)
+	}
+	errs = append(errs, c.validateSites()...)
+	errs = append(errs, c.validateAuth()...)
+	errs = append(errs, c.validateRateLimits()...)
+	if _, err := ipfilter.New(c.AccessRules, c.TrustedProxies); err != nil {
+		errs = append(errs, fmt.Errorf("access rules: %v", err))
+	}
+	if c.MetricsPath != "" && !strings.HasPrefix(c.MetricsPath, "/") {
+		errs = append(errs, fmt.Errorf("metrics path must start with /, got %q", c.MetricsPath))
+	}
+	if len(errs) == 0 {
+		_, err := newMimeRegistry(c)
+		errs = append(errs, err)
+		_, err = newVirtualHosts(c)
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// checkDir returns an error if dir does not exist or is not a directory.
+func checkDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	return nil
+}
+
+/*
+newMimeRegistry creates the MIME type registry for the configuration: the built-in types,
+the types from the mime.types file, and the overrides in .mime.types files in the document root.
+Every allowed type must be known to the registry.
+*/
+func newMimeRegistry(c serverConfig) (*mimetype.Registry, error) {
+	registry := mimetype.New()
+	if c.MimeTypes != "" {
+		if err := registry.LoadFile(c.MimeTypes); err != nil {
+			return nil, err
+		}
+	}
+	err := filepath.WalkDir(c.Root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.Name() != mimeOverrideFile || entry.IsDir() {
+			return err
+		}
+		return registry.LoadOverrideFile(filepath.Dir(path), path)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	for _, contentType := range c.AllowedTypes {
+		if _, known := registry.Lookup(contentType); !known {
+			errs = append(errs, fmt.Errorf("allowed type %q is not a known type", contentType))
+		}
+	}
+	for contentType := range c.UploadLimits {
+		if _, known := registry.Lookup(contentType); !known {
+			errs = append(errs, fmt.Errorf("upload limit for %q, which is not a known type", contentType))
+		}
+	}
+	return registry, errors.Join(errs...)
+}
+
+// validateTLS checks the HTTPS settings. The certificate files are only read when the server starts.
+func (c serverConfig) validateTLS() error {
+	var errs []error
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		errs = append(errs, errors.New("tls-cert and tls-key must be given together"))
+	}
+	if c.DevTLS && c.TLSCert != "" {
+		errs = append(errs, errors.New("dev-tls creates its own certificate, it can not be used with tls-cert"))
+	}
+	if _, err := tlsconfig.ParseVersion(c.TLSMinVersion); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := tlsconfig.ParseCipherSuites(c.TLSCipherSuites); err != nil {
+		errs = append(errs, err)
+	}
+	if c.RedirectPort != 0 {
+		if c.RedirectPort < 1 || c.RedirectPort > 65535 || c.RedirectPort == c.Port {
+			errs = append(errs, fmt.Errorf("redirect port %d is not between 1 and 65535 or is the port itself", c.RedirectPort))
+		}
+		if !c.tlsEnabled() {
+			errs = append(errs, errors.New("redirect-port needs HTTPS, with tls-cert and tls-key or dev-tls"))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// tlsEnabled reports whether the server serves HTTPS.
+func (c serverConfig) tlsEnabled() bool {
+	return c.TLSCert != "" || c.DevTLS
+}
+
+/*
+uploadLimit returns the largest upload accepted for a content type:
+the limit configured for the type, or else the general max upload size.
+*/
+func (c serverConfig) uploadLimit(contentType string) int64 {
+	if limit, ok := c.UploadLimits[mimetype.MediaType(contentType)]; ok {
+		return int64(limit)
+	}
+	return int64(c.MaxUploadSize)
+}
+
+// allowsType reports whether the content type may be served and uploaded, parameters such as charset are ignored.
+func (c serverConfig) allowsType(contentType string) bool {
+	mediaType := mimetype.MediaType(contentType)
+	for _, allowed := range c.AllowedTypes {
+		if mimetype.MediaType(allowed) == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// duration is a time.Duration written as "5s" in the config file and on the command line.
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) Set(value string) error {
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	return d.Set(value)
+}
+
+// stringList is a list written as "a,b,c" on the command line and as an array in the config file.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// byteSize is a number of bytes written as "512KB", "10MB" or "1GB" (powers of 1024), or as a plain number.
+type byteSize int64
+
+// byteUnits are the units of byteSize from the largest to the smallest.
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}}
+
+func (b byteSize) String() string {
+	for _, unit := range byteUnits {
+		if b != 0 && int64(b)%unit.size == 0 {
+			return strconv.FormatInt(int64(b)/unit.size, 10) + unit.suffix
+		}
+	}
+	return strconv.FormatInt(int64(b), 10)
+}
+
+func (b *byteSize) Set(value string) error {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	value = strings.Replace(value, "IB", "B", 1) // MiB is read as MB
+	multiplier := int64(1)
+	for _, unit := range byteUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			multiplier = unit.size
+			break
+		}
+	}
+	number, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid size %q", value)
+	}
+	if number < 0 || number > math.MaxInt64/multiplier {
+		return fmt.Errorf("size %q is out of range", value)
+	}
+	*b = byteSize(number * multiplier)
+	return nil
+}
+
+func (b byteSize) MarshalJSON() ([]byte, error) {
+	return json.Marshal(b.String())
+}
+
+func (b *byteSize) UnmarshalJSON(data []byte) error {
+	var number int64
+	if err := json.Unmarshal(data, &number); err == nil {
+		if number < 0 {
+			return fmt.Errorf("size %d is out of range", number)
+		}
+		*b = byteSize(number)
+		return nil
+	}
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	return b.Set(value)
+}
+
+// sizeMap maps content types to sizes, written as "image/jpeg=5MB,video/mp4=100MB" on the command line.
+type sizeMap map[string]byteSize
+
+func (m *sizeMap) String() string {
+	var items []string
+	for key, size := range *m {
+		items = append(items, key+"="+size.String())
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
+
+func (m *sizeMap) Set(value string) error {
+	*m = sizeMap{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		key, sizeText, found := strings.Cut(item, "=")
+		if !found {
+			return fmt.Errorf("invalid limit %q, expected type=size", item)
+		}
+		var size byteSize
+		if err := size.Set(sizeText); err != nil {
+			return err
+		}
+		(*m)[mimetype.MediaType(key)] = size
+	}
+	return nil
+}
+
+// UnmarshalJSON reads the limits of a config file, whose types are written like those of the flag,
+// so "Text/Plain; charset=utf-8" is the limit of text/plain.
+func (m *sizeMap) UnmarshalJSON(data []byte) error {
+	var limits map[string]byteSize
+	if err := json.Unmarshal(data, &limits); err != nil {
+		return err
+	}
+	*m = sizeMap{}
+	for key, size := range limits {
+		(*m)[mimetype.MediaType(key)] = size
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+)
+
+/*
+fileLocks hands out a reader/writer lock per file path.
+Many requests can read the same file at the same time, while a request that writes a file
+has it to itself. Requests for different files never wait for each other.
+A lock only exists while someone holds or waits for it, the entry is removed when the last one releases it.
+*/
+type fileLocks struct {
+	mutex sync.Mutex
+	locks map[string]*fileLock
+}
+
+// fileLock is the lock of one path, with the number of requests holding or waiting for it.
+type fileLock struct {
+	sync.RWMutex
+	references int
+}
+
+// locks are the locks of the files the server reads and writes.
+var locks = newFileLocks()
+
+// newFileLocks creates an empty lock manager.
+func newFileLocks() *fileLocks {
+	return &fileLocks{locks: make(map[string]*fileLock)}
+}
+
+// readLock locks path for reading and returns the function that unlocks it.
+func (l *fileLocks) readLock(path string) func() {
+	key, lock := l.acquire(path)
+	lock.RLock()
+	return func() {
+		lock.RUnlock()
+		l.release(key, lock)
+	}
+}
+
+// writeLock locks path for writing and returns the function that unlocks it.
+func (l *fileLocks) writeLock(path string) func() {
+	key, lock := l.acquire(path)
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		l.release(key, lock)
+	}
+}
+
+// acquire returns the lock of path, creating it if needed, and counts one more reference to it.
+func (l *fileLocks) acquire(path string) (string, *fileLock) {
+	key := filepath.Clean(path)
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	lock, ok := l.locks[key]
+	if !ok {
+		lock = &fileLock{}
+		l.locks[key] = lock
+	}
+	lock.references++
+	return key, lock
+}
+
+// release counts one reference less to a lock and removes it when nobody uses it anymore.
+func (l *fileLocks) release(key string, lock *fileLock) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	lock.references--
+	if lock.references == 0 {
+		delete(l.locks, key)
+	}
+}
+
+// size returns the number of locks in use.
+func (l *fileLocks) size() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return len(l.locks)
+}
@@ -0,0 +1,80 @@
+/*
+Package filewatch loads files again when they change, so the server picks up new users or a renewed
+certificate without a restart. A change is noticed by the modification times and sizes of the files,
+which are looked at when the files are used, at most once per check interval.
+*/
+package filewatch
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// DefaultCheckInterval is how often a Watcher looks at its files, at most.
+const DefaultCheckInterval = time.Second
+
+/*
+Watcher keeps track of when its files were loaded. It does not lock, the type it is part of
+calls it with its own mutex held, so loading the files and using what was loaded are not mixed up.
+*/
+type Watcher struct {
+	CheckInterval time.Duration
+
+	paths   []string
+	stamp   string    // modification times and sizes of the files that were loaded
+	checked time.Time // when the files were last looked at
+}
+
+// New returns a Watcher of the files at paths, which are checked every DefaultCheckInterval.
+func New(paths ...string) Watcher {
+	return Watcher{CheckInterval: DefaultCheckInterval, paths: paths}
+}
+
+// Load calls load to read the files, and when it succeeds remembers them as they are now.
+func (w *Watcher) Load(load func() error) error {
+	stamp, err := w.fileStamp()
+	if err != nil {
+		return err
+	}
+	if err := load(); err != nil {
+		return err
+	}
+	w.stamp = stamp
+	w.checked = time.Now()
+	return nil
+}
+
+/*
+Reload calls load when the check interval has passed and the files changed since they were loaded,
+and reports whether it did. When load fails the files are tried again at the next check, what was
+loaded before is kept by the caller. The error is that of looking at the files or of load.
+*/
+func (w *Watcher) Reload(load func() error) (bool, error) {
+	if time.Since(w.checked) < w.CheckInterval {
+		return false, nil
+	}
+	w.checked = time.Now()
+	stamp, err := w.fileStamp()
+	if err != nil || stamp == w.stamp {
+		return false, err
+	}
+	if err := load(); err != nil {
+		return true, err
+	}
+	w.stamp = stamp
+	return true, nil
+}
+
+// fileStamp returns the modification times and sizes of the files, which change when any of them is replaced or edited.
+func (w *Watcher) fileStamp() (string, error) {
+	var stamp string
+	for _, path := range w.paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		stamp += fmt.Sprintf("%d/%d;", info.ModTime().UnixNano(), info.Size())
+	}
+	return stamp, nil
+}
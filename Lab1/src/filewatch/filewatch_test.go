@@ -0,0 +1,57 @@
+package filewatch
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWatcher(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "watched")
+	os.WriteFile(path, []byte("first"), 0600)
+
+	loads := 0
+	load := func() error {
+		loads++
+		return nil
+	}
+	watcher := New(path)
+	if err := watcher.Load(load); err != nil || loads != 1 {
+		t.Fatalf("Expected the file to be loaded, got %d loads, %v", loads, err)
+	}
+
+	// Within the check interval the file is not looked at, even when it changed
+	os.WriteFile(path, []byte("second"), 0600)
+	if reloaded, err := watcher.Reload(load); reloaded || err != nil || loads != 1 {
+		t.Errorf("Expected no reload within the check interval, got %v, %v", reloaded, err)
+	}
+
+	watcher.CheckInterval = 0
+	if reloaded, err := watcher.Reload(load); !reloaded || err != nil || loads != 2 {
+		t.Errorf("Expected the changed file to be loaded again, got %v, %v", reloaded, err)
+	}
+	if reloaded, _ := watcher.Reload(load); reloaded || loads != 2 {
+		t.Errorf("Expected an unchanged file not to be loaded again")
+	}
+
+	// A load that fails is tried again at the next check
+	os.WriteFile(path, []byte("third"), 0600)
+	broken := errors.New("broken")
+	if reloaded, err := watcher.Reload(func() error { return broken }); !reloaded || err != broken {
+		t.Errorf("Expected the error of the failed load, got %v, %v", reloaded, err)
+	}
+	if reloaded, err := watcher.Reload(load); !reloaded || err != nil || loads != 3 {
+		t.Errorf("Expected the file to be tried again, got %v, %v", reloaded, err)
+	}
+
+	// A file that can not be looked at is an error, but not a reload
+	os.Remove(path)
+	if reloaded, err := watcher.Reload(load); reloaded || err == nil {
+		t.Errorf("Expected an error for a missing file, got %v, %v", reloaded, err)
+	}
+	missing := New(path)
+	if err := missing.Load(load); err == nil {
+		t.Errorf("Expected an error loading a missing file")
+	}
+}
@@ -1,3 +1,5 @@
 module http_server
 
-go 1.21.3
+go 1.24
+
+require golang.org/x/crypto v0.36.0
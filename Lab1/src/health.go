@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"http_server/health"
+)
+
+// healthPath answers 200 OK as long as the server is running, for liveness probes.
+const healthPath = "/healthz"
+
+// readyPath answers 200 OK when the server can serve requests and 503 Service Unavailable when it can not, for readiness probes.
+const readyPath = "/readyz"
+
+/*
+endpointHandler returns the handler of a path that the server answers itself rather than with a file,
+or nil if the path is not one of them.
+*/
+func endpointHandler(path string) func(http.ResponseWriter, *http.Request) error {
+	switch {
+	case path == healthPath:
+		return handleHealth
+	case path == readyPath:
+		return handleReady
+	case config.MetricsPath != "" && path == config.MetricsPath:
+		return handleMetrics
+	}
+	return nil
+}
+
+// handleHealth answers that the server is alive, it is answered even when all connection slots are taken.
+func handleHealth(response http.ResponseWriter, request *http.Request) error {
+	return sendReport(response, request, health.Live())
+}
+
+/*
+handleReady answers whether the server is ready for requests: the document root can be read,
+the upload directory can be written to, the same for every site, the admission queue is not full and the server is not shutting down.
+The JSON body shows the outcome of every check.
+*/
+func handleReady(response http.ResponseWriter, request *http.Request) error {
+	checks := map[string]health.Check{
+		"document_root": health.Readable(config.Root),
+		"upload_dir":    health.Writable(config.UploadDir, uploadTempPrefix+"ready-*.tmp"),
+	}
+	for _, vhost := range virtualHosts {
+		checks["document_root:"+vhost.name] = health.Readable(vhost.config.Root)
+		checks["upload_dir:"+vhost.name] = health.Writable(vhost.config.UploadDir, uploadTempPrefix+"ready-*.tmp")
+	}
+	if s := watchedServer.Load(); s != nil {
+		checks["admission"] = health.Admission(s.admission)
+		checks["shutdown"] = func() (any, error) {
+			if s.isClosing() {
+				return nil, errors.New("the server is shutting down")
+			}
+			return nil, nil
+		}
+	}
+	return sendReport(response, request, health.Run(checks))
+}
+
+// sendReport answers a GET or HEAD request with a health report as JSON, with 503 Service Unavailable if a check failed.
+func sendReport(response http.ResponseWriter, request *http.Request, report health.Report) error {
+	if request.Method != "GET" && request.Method != "HEAD" {
+		response.Header().Set("Allow", "GET, HEAD")
+		return giveResponse(response, 405)
+	}
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	body = append(body, '\n')
+	status := 200
+	if !report.OK() {
+		status = 503
+		requestLogger(request).Warn("Not ready", "report", string(body))
+	}
+	response.Header().Set("Content-Type", "application/json")
+	response.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	response.Header().Set("Cache-Control", "no-store")
+	response.WriteHeader(status)
+	_, err = response.Write(body)
+	return err
+}
@@ -0,0 +1,110 @@
+/*
+Package health runs the readiness checks of the server and the proxy, for the /healthz and /readyz endpoints
+that container orchestrators probe. A check returns an error when its condition does not hold,
+and details that are shown either way. The report of all checks is written as JSON:
+
+	{"status":"unavailable","checks":{"admission":{"ok":true,"detail":{"active":3,...}},"upload_dir":{"ok":false,"error":"..."}}}
+*/
+package health
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"http_server/admission"
+)
+
+// Check is one condition of readiness. It returns details to show, or nil, and an error when the condition does not hold.
+type Check func() (any, error)
+
+// Result is the outcome of one check.
+type Result struct {
+	OK     bool   `json:"ok"`
+	Error  string `json:"error,omitempty"`
+	Detail any    `json:"detail,omitempty"`
+}
+
+// Report is the outcome of all checks, with the status "ok" when all of them passed and "unavailable" otherwise.
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]Result `json:"checks,omitempty"`
+}
+
+// OK reports whether all checks passed.
+func (r Report) OK() bool {
+	return r.Status == "ok"
+}
+
+// Live returns the report of a process that is running, which has no checks.
+func Live() Report {
+	return Report{Status: "ok"}
+}
+
+// Run runs the checks by name and returns their report.
+func Run(checks map[string]Check) Report {
+	report := Report{Status: "ok", Checks: make(map[string]Result, len(checks))}
+	for name, check := range checks {
+		detail, err := check()
+		result := Result{OK: err == nil, Detail: detail}
+		if err != nil {
+			result.Error = err.Error()
+			report.Status = "unavailable"
+		}
+		report.Checks[name] = result
+	}
+	return report
+}
+
+// Readable checks that dir is a directory whose entries can be listed.
+func Readable(dir string) Check {
+	return func() (any, error) {
+		directory, err := os.Open(dir)
+		if err != nil {
+			return nil, err
+		}
+		defer directory.Close()
+		if _, err := directory.Readdirnames(1); err != nil && err != io.EOF {
+			return nil, err
+		}
+		return nil, nil
+	}
+}
+
+// Writable checks that a file can be created in dir, by creating and removing a temporary file named with pattern.
+func Writable(dir string, pattern string) Check {
+	return func() (any, error) {
+		file, err := os.CreateTemp(dir, pattern)
+		if err != nil {
+			return nil, err
+		}
+		file.Close()
+		return nil, os.Remove(file.Name())
+	}
+}
+
+// Admission checks that the controller is not saturated, so a new connection would not be refused at once.
+func Admission(controller *admission.Controller) Check {
+	return func() (any, error) {
+		stats := controller.Stats()
+		if stats.Saturated() {
+			return stats, errors.New("all connection slots are taken and the queue is full")
+		}
+		return stats, nil
+	}
+}
+
+// Reachable checks that a TCP connection to address can be made within timeout.
+func Reachable(address string, timeout time.Duration) Check {
+	return func() (any, error) {
+		connection, err := net.DialTimeout("tcp", address, timeout)
+		if err != nil {
+			return address, fmt.Errorf("can not reach %s: %w", address, err)
+		}
+		connection.Close()
+		return address, nil
+	}
+}
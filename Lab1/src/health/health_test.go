@@ -0,0 +1,75 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"http_server/admission"
+)
+
+func TestRun(t *testing.T) {
+	report := Run(map[string]Check{
+		"fine":   func() (any, error) { return map[string]int{"n": 1}, nil },
+		"broken": func() (any, error) { return nil, errors.New("out of order") },
+	})
+	if report.OK() || !report.Checks["fine"].OK || report.Checks["broken"].OK {
+		t.Errorf("Unexpected report %+v", report)
+	}
+	encoded, _ := json.Marshal(report)
+	expected := `{"status":"unavailable","checks":{"broken":{"ok":false,"error":"out of order"},"fine":{"ok":true,"detail":{"n":1}}}}`
+	if string(encoded) != expected {
+		t.Errorf("Unexpected JSON\n got %s\nwant %s", encoded, expected)
+	}
+	if !Run(nil).OK() || !Live().OK() {
+		t.Errorf("Expected no checks to be ok")
+	}
+}
+
+func TestChecks(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := Readable(dir)(); err != nil {
+		t.Errorf("Expected %s to be readable: %v", dir, err)
+	}
+	if _, err := Readable(filepath.Join(dir, "missing"))(); err == nil {
+		t.Errorf("Expected a missing directory not to be readable")
+	}
+	if _, err := Writable(dir, ".ready-*.tmp")(); err != nil {
+		t.Errorf("Expected %s to be writable: %v", dir, err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("The writable check left %d files behind", len(entries))
+	}
+	if _, err := Writable(filepath.Join(dir, "missing"), ".ready-*.tmp")(); err == nil {
+		t.Errorf("Expected a missing directory not to be writable")
+	}
+
+	controller := admission.New(1, 0, time.Second)
+	if _, err := Admission(controller)(); err != nil {
+		t.Errorf("Expected a free controller to pass: %v", err)
+	}
+	release, _ := controller.Acquire(context.Background())
+	if detail, err := Admission(controller)(); err == nil || detail.(admission.Stats).Active != 1 {
+		t.Errorf("Expected a saturated controller to fail with its stats, got %v, %v", detail, err)
+	}
+	release()
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	address := listener.Addr().String()
+	if _, err := Reachable(address, time.Second)(); err != nil {
+		t.Errorf("Expected %s to be reachable: %v", address, err)
+	}
+	listener.Close()
+	if _, err := Reachable(address, time.Second)(); err == nil || !strings.Contains(err.Error(), address) {
+		t.Errorf("Expected %s not to be reachable, got %v", address, err)
+	}
+}
@@ -0,0 +1,145 @@
+/*
+Package htpasswd checks user names and passwords against a file in the format of Apache's htpasswd,
+one "user:hash" per line. Passwords hashed with bcrypt (htpasswd -B) and with SHA-1 (htpasswd -s) are supported.
+The file is loaded again when it changes, so users can be added without restarting the server.
+*/
+package htpasswd
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"http_server/filewatch"
+)
+
+/*
+dummyHash is compared with the password of an unknown user, so the answer takes as long as for a
+known user and does not tell which user names exist.
+*/
+var dummyHash = "$2a$10$CvdnsDQVnUugB6QmeIJWeuEU7z3/BkstjcHzKhaJKHxUDb1eEExqu"
+
+/*
+File holds the users of an htpasswd file, and loads the file again when it changes. The file is checked
+during Authenticate, at most once per CheckInterval. When the changed file can not be loaded, the old users
+are kept and the file is tried again at the next check. It is safe for concurrent use.
+*/
+type File struct {
+	filewatch.Watcher
+
+	path string
+
+	mutex sync.Mutex
+	users map[string]string // user -> password hash
+}
+
+// Open loads the users of the htpasswd file at path.
+func Open(path string) (*File, error) {
+	f := &File{Watcher: filewatch.New(path), path: path}
+	if err := f.Load(f.load); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Authenticate reports whether the file has the user with this password.
+func (f *File) Authenticate(user string, password string) bool {
+	hash, found := f.lookup(user)
+	if !found {
+		Verify(dummyHash, password)
+		return false
+	}
+	return Verify(hash, password)
+}
+
+// Users returns the number of users in the file.
+func (f *File) Users() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return len(f.users)
+}
+
+// lookup returns the password hash of a user, after loading the file again if it changed.
+func (f *File) lookup(user string) (string, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	reloaded, err := f.Reload(f.load)
+	switch {
+	case err != nil && !reloaded:
+		slog.Error("Checking the htpasswd file", "err", err)
+	case err != nil:
+		slog.Error("Reloading the htpasswd file, keeping the old users", "file", f.path, "err", err)
+	case reloaded:
+		slog.Info("Reloaded the htpasswd file", "file", f.path, "users", len(f.users))
+	}
+	hash, found := f.users[user]
+	return hash, found
+}
+
+// load reads the file, and when it can be parsed uses its users from now on.
+func (f *File) load() error {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	users, err := Parse(file)
+	if err != nil {
+		return fmt.Errorf("%s: %v", f.path, err)
+	}
+	f.users = users
+	return nil
+}
+
+/*
+Parse reads the users of an htpasswd file, mapped to their password hashes. Empty lines and lines
+starting with # are skipped. A line that is not "user:hash", or whose hash is of a kind that is not
+supported, such as the MD5 of htpasswd -m, is an error.
+*/
+func Parse(reader io.Reader) (map[string]string, error) {
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(reader)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, found := strings.Cut(line, ":")
+		if !found || user == "" {
+			return nil, fmt.Errorf("line %d: expected user:hash", number)
+		}
+		if !supported(hash) {
+			return nil, fmt.Errorf("line %d: the password of %s is not hashed with bcrypt or SHA", number, user)
+		}
+		users[user] = hash
+	}
+	return users, scanner.Err()
+}
+
+// supported reports whether hash is of a kind Verify can check.
+func supported(hash string) bool {
+	if encoded, found := strings.CutPrefix(hash, "{SHA}"); found {
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		return err == nil && len(decoded) == sha1.Size
+	}
+	_, err := bcrypt.Cost([]byte(hash))
+	return err == nil
+}
+
+// Verify reports whether password matches hash, a bcrypt hash ($2a$, $2b$ or $2y$) or "{SHA}" with the base64 of its SHA-1.
+func Verify(hash string, password string) bool {
+	if encoded, found := strings.CutPrefix(hash, "{SHA}"); found {
+		sum := sha1.Sum([]byte(password))
+		return subtle.ConstantTimeCompare([]byte(encoded), []byte(base64.StdEncoding.EncodeToString(sum[:]))) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
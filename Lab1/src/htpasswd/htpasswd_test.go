@@ -0,0 +1,81 @@
+package htpasswd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// bcryptHash hashes password with the lowest cost, which keeps the tests fast.
+func bcryptHash(t *testing.T, password string) string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Error hashing the password: %v", err)
+	}
+	return string(hash)
+}
+
+func TestVerify(t *testing.T) {
+	hash := bcryptHash(t, "secret")
+	if !Verify(hash, "secret") || Verify(hash, "Secret") {
+		t.Errorf("Expected only the right password to match the bcrypt hash")
+	}
+	// Made with htpasswd -nbs alice secret
+	if !Verify("{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "secret") || Verify("{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "secret ") {
+		t.Errorf("Expected only the right password to match the SHA hash")
+	}
+	if Verify("secret", "secret") {
+		t.Errorf("Expected a password in plain text not to match")
+	}
+}
+
+func TestParse(t *testing.T) {
+	users, err := Parse(strings.NewReader("# users\nalice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n\nbob:" + bcryptHash(t, "pw") + "\n"))
+	if err != nil || len(users) != 2 || users["alice"] != "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=" {
+		t.Fatalf("Unexpected users %v, %v", users, err)
+	}
+	for _, file := range []string{"alice", ":{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "carol:$apr1$salt$hash", "dave:plain"} {
+		if _, err := Parse(strings.NewReader(file)); err == nil {
+			t.Errorf("Expected an error for %q", file)
+		}
+	}
+}
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".htpasswd")
+	os.WriteFile(path, []byte("alice:"+bcryptHash(t, "first")+"\n"), 0600)
+
+	file, err := Open(path)
+	if err != nil {
+		t.Fatalf("Error opening the file: %v", err)
+	}
+	file.CheckInterval = 0
+	if !file.Authenticate("alice", "first") || file.Authenticate("alice", "second") || file.Authenticate("bob", "first") {
+		t.Errorf("Expected only alice with her password to be authenticated")
+	}
+
+	// The password is changed and a user added
+	os.WriteFile(path, []byte("alice:"+bcryptHash(t, "second")+"\nbob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"), 0600)
+	later := time.Now().Add(time.Second)
+	os.Chtimes(path, later, later)
+	if file.Authenticate("alice", "first") || !file.Authenticate("alice", "second") || !file.Authenticate("bob", "secret") {
+		t.Errorf("Expected the changed file to be used")
+	}
+
+	// A broken file keeps the old users
+	os.WriteFile(path, []byte("alice\n"), 0600)
+	later = later.Add(time.Second)
+	os.Chtimes(path, later, later)
+	if !file.Authenticate("alice", "second") || file.Users() != 2 {
+		t.Errorf("Expected the old users to be kept while the file is broken")
+	}
+
+	if _, err := Open(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Errorf("Expected an error for a missing file")
+	}
+}
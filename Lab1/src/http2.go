@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"http_server/logging"
+)
+
+// http2Preface is what a client sends first on a connection that speaks HTTP/2.
+const http2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+/*
+http2Server serves the connections that speak HTTP/2: those that negotiated h2 with ALPN during the
+TLS handshake, and plain connections that start with the HTTP/2 preface (h2c with prior knowledge).
+The framing, HPACK and flow control are done by the HTTP/2 implementation of net/http, which is given the
+connections once the server has accepted them. The streams are answered by handleRequest, like HTTP/1.1 requests.
+The h2c upgrade from HTTP/1.1 is not supported, RFC 9113 deprecated it; a request with "Upgrade: h2c" is answered with HTTP/1.1.
+*/
+type http2Server struct {
+	server   *http.Server
+	incoming chan net.Conn
+	closed   chan struct{}
+	stop     sync.Once
+
+	mutex sync.Mutex
+	done  map[net.Conn]chan struct{} // connection -> closed when net/http is finished with it
+}
+
+/*
+newHTTP2Server creates the HTTP/2 server of s. Every stream waits for a slot of the admission controller of its own,
+and a connection may have at most as many streams open as the controller lets in or queues, more would be refused anyway.
+*/
+func newHTTP2Server(s *server) *http2Server {
+	h := &http2Server{
+		incoming: make(chan net.Conn),
+		closed:   make(chan struct{}),
+		done:     make(map[net.Conn]chan struct{}),
+	}
+	stats := s.admission.Stats()
+	var protocols http.Protocols
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+	h.server = &http.Server{
+		Handler:     http.HandlerFunc(s.serveStream),
+		Protocols:   &protocols,
+		HTTP2:       &http.HTTP2Config{MaxConcurrentStreams: stats.Limit + stats.QueueSize},
+		IdleTimeout: config.IdleTimeout.Duration,
+		ConnState:   h.connState,
+		ErrorLog:    slog.NewLogLogger(slog.Default().Handler(), slog.LevelDebug),
+	}
+	go h.server.Serve(h)
+	return h
+}
+
+/*
+serve lets net/http speak HTTP/2 on connection and returns when it is done with the connection.
+The reader holds what was read from the connection already, such as the preface.
+*/
+func (h *http2Server) serve(connection net.Conn, reader *bufio.Reader) {
+	if reader.Buffered() > 0 {
+		connection = &bufferedConn{Conn: connection, reader: reader}
+	}
+	done := make(chan struct{})
+	h.mutex.Lock()
+	h.done[connection] = done
+	h.mutex.Unlock()
+
+	select {
+	case h.incoming <- connection:
+		<-done
+	case <-h.closed:
+		h.mutex.Lock()
+		delete(h.done, connection)
+		h.mutex.Unlock()
+	}
+}
+
+// connState notices when net/http is finished with a connection.
+func (h *http2Server) connState(connection net.Conn, state http.ConnState) {
+	if state != http.StateClosed && state != http.StateHijacked {
+		return
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if done, found := h.done[connection]; found {
+		close(done)
+		delete(h.done, connection)
+	}
+}
+
+/*
+shutdown sends GOAWAY on every HTTP/2 connection, so clients open no new streams. The streams in progress
+may finish, after which the connections are closed.
+*/
+func (h *http2Server) shutdown() {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel() // Only starts the graceful shutdown, the server waits for the connections itself
+	h.server.Shutdown(ctx)
+}
+
+// Accept returns the next connection for net/http, the http2Server is the listener of its http.Server.
+func (h *http2Server) Accept() (net.Conn, error) {
+	select {
+	case connection := <-h.incoming:
+		return connection, nil
+	case <-h.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops handing connections to net/http.
+func (h *http2Server) Close() error {
+	h.stop.Do(func() { close(h.closed) })
+	return nil
+}
+
+// Addr returns no real address, the connections come from the listeners of the server.
+func (h *http2Server) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+// bufferedConn is a connection of which some bytes were already read into reader.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// Read reads what is buffered first, and then from the connection.
+func (c *bufferedConn) Read(data []byte) (int, error) {
+	return c.reader.Read(data)
+}
+
+/*
+speaksHTTP2 reports whether the client of a connection that was not read from yet speaks HTTP/2.
+Over TLS it does the handshake and looks at the protocol the client chose, otherwise it looks for the preface in reader.
+*/
+func speaksHTTP2(connection net.Conn, reader *bufio.Reader) bool {
+	if tlsConnection, ok := connection.(*tls.Conn); ok {
+		return tlsConnection.Handshake() == nil && tlsConnection.ConnectionState().NegotiatedProtocol == "h2"
+	}
+	if _, redirect := connection.(redirectConn); redirect {
+		return false
+	}
+	return hasHTTP2Preface(reader)
+}
+
+/*
+hasHTTP2Preface reports whether a connection starts with the HTTP/2 preface. It peeks one byte more at a time,
+so an HTTP/1.1 request shorter than the preface is recognized as soon as it differs, without waiting for more.
+This is the only way a plain connection becomes HTTP/2: a request with "Upgrade: h2c" stays an HTTP/1.1
+request and is answered as one, never with 101 Switching Protocols.
+*/
+func hasHTTP2Preface(reader *bufio.Reader) bool {
+	for n := 1; n <= len(http2Preface); n++ {
+		peeked, err := reader.Peek(n)
+		if err != nil || peeked[n-1] != http2Preface[n-1] {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+serveStream answers a request on a stream of HTTP/2. It waits for a slot of the admission controller first,
+so HTTP/1.1 connections and HTTP/2 streams share the same limit and queue, and is answered 503 Service Unavailable
+when it gets none. Liveness probes are answered without a slot. The request is logged and counted like one of HTTP/1.1,
+and its body and response have the same timeouts.
+*/
+func (s *server) serveStream(response http.ResponseWriter, request *http.Request) {
+	start := time.Now()
+	logger := slog.With("request_id", logging.NewRequestID(), "remote_addr", request.RemoteAddr)
+	request = request.WithContext(logging.NewContext(request.Context(), logger))
+	logger.Debug("Request", "method", request.Method, "uri", request.RequestURI, "proto", request.Proto)
+
+	controller := http.NewResponseController(response)
+	stream := &streamWriter{ResponseWriter: response, controller: controller}
+	body := newTimeoutBody(request.Body, controller)
+	request.Body = body
+	defer func() {
+		logAccess(request, stream.status, stream.written, start)
+		recordRequest(request, stream.status, stream.written, start)
+		requestBodyBytes.Add(float64(body.read))
+	}()
+
+	if request.URL.Path != healthPath {
+		// The stream also stops waiting when it is reset or the server shuts down
+		ctx, cancel := context.WithCancel(request.Context())
+		defer context.AfterFunc(s.ctx, cancel)()
+		release, err := s.admission.Acquire(ctx)
+		cancel()
+		if err != nil {
+			logger.Warn("Refusing stream", "err", err)
+			response.Header().Set("Retry-After", strconv.Itoa(s.admission.RetryAfter()))
+			giveResponse(stream, 503)
+			return
+		}
+		defer release()
+	}
+	s.activeRequests.Add(1)
+	defer s.activeRequests.Add(-1)
+	handleRequest(stream, request)
+}
+
+/*
+streamWriter is the response of an HTTP/2 stream. It keeps the status and the body bytes written for the
+access log and metrics, and gives every write the write timeout, like timeoutConn does for HTTP/1.1.
+*/
+type streamWriter struct {
+	http.ResponseWriter
+	controller *http.ResponseController
+	status     int
+	written    int64
+}
+
+// WriteHeader sends the headers with status, only the first call has an effect.
+func (w *streamWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write writes data with a deadline of the write timeout from now.
+func (w *streamWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(200)
+	}
+	w.controller.SetWriteDeadline(time.Now().Add(config.WriteTimeout.Duration))
+	n, err := w.ResponseWriter.Write(data)
+	w.written += int64(n)
+	return n, err
+}
+
+// Unwrap returns the response of net/http, for http.ResponseController.
+func (w *streamWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -2,348 +2,725 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
-	"path/filepath"
+	"os/signal"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
+	"time"
+
+	"http_server/accesslog"
+	"http_server/admission"
+	"http_server/htpasswd"
+	"http_server/ipfilter"
+	"http_server/logging"
 )
 
-const maxConcurrentRequests = 10
-
-var fileMutex sync.Mutex
+// maxDrainBytes is how much of an unread request body is skipped to reuse the connection.
+const maxDrainBytes = 256 << 10
 
 // main is the entry point of the HTTP server.
-// It initializes the server, accepts connections, and handles them concurrently.
+// It reads the configuration, initializes the server, accepts connections, and handles them concurrently.
 func main() {
 
-	if !CheckPort(os.Args) {
+	loaded, printConfig, err := loadConfig(os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		slog.Error("Reading the configuration", "err", err)
+		os.Exit(2)
+	}
+	config = loaded
+	logging.Setup(config.LogLevel, config.LogFormat) // Checked with the configuration
+	mimeTypes, err = newMimeRegistry(config)
+	if err != nil {
+		slog.Error("Loading the MIME types", "err", err)
+		os.Exit(2)
+	}
+	virtualHosts, err = newVirtualHosts(config)
+	if err != nil {
+		slog.Error("Setting up the sites", "err", err)
+		os.Exit(2)
+	}
+	if config.Htpasswd != "" {
+		users, err := htpasswd.Open(config.Htpasswd)
+		if err != nil {
+			slog.Error("Loading the htpasswd file", "err", err)
+			os.Exit(2)
+		}
+		credentials.Store(users)
+		slog.Info("Authentication enabled", "file", config.Htpasswd, "users", users.Users(), "rules", config.AuthRules.String())
+	}
+	rateLimiters = newRateLimiters(config)
+	accessFilter, _ = ipfilter.New(config.AccessRules, config.TrustedProxies) // Checked with the configuration
+	if printConfig {
+		output, _ := json.MarshalIndent(config, "", "  ")
+		fmt.Println(string(output))
 		return
 	}
+	format, _ := accesslog.ParseFormat(config.AccessLogFormat) // Checked with the configuration
+	accessLog, err = accesslog.Open(config.AccessLog, format, int64(config.AccessLogMaxSize), config.AccessLogBackups)
+	if err != nil {
+		slog.Error("Opening the access log", "err", err)
+		os.Exit(2)
+	}
+	for _, vhost := range append([]*virtualHost{defaultHost()}, virtualHosts...) {
+		if err := removeOrphanedUploads(vhost.config.UploadDir); err != nil {
+			slog.Warn("Removing orphaned uploads", "err", err)
+		}
+	}
 
-	var port = os.Args[1]
-	listener, error_lis := net.Listen("tcp", ":"+port)
-	defer listener.Close()
+	var port = strconv.Itoa(config.Port)
+	if !CheckPort(config.Host, port) {
+		os.Exit(1)
+	}
 
-	if CheckError(error_lis, "Creating Listener net.Listen") {
-		fmt.Printf("\x1b[31mFailed to start HTTP-server on port %s\x1b[0m\n", port)
-		return
+	listener, error_lis := net.Listen("tcp", net.JoinHostPort(config.Host, port))
+	if error_lis != nil {
+		slog.Error("Failed to start HTTP-server", "port", port, "err", error_lis)
+		os.Exit(1)
+	}
+	scheme := "http"
+	if config.tlsEnabled() {
+		tlsConfig, err := newTLSConfig(config)
+		if err != nil {
+			slog.Error("Setting up TLS", "err", err)
+			os.Exit(2)
+		}
+		listener = tls.NewListener(listener, tlsConfig)
+		scheme = "https"
+	}
+
+	slog.Info("HTTP-server started", "port", port, "url", scheme+"://localhost:"+port+"/site.html", "root", config.Root)
+	for _, vhost := range virtualHosts {
+		slog.Info("Serving site", "host", vhost.name, "root", vhost.config.Root)
+	}
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	httpServer := newServer(admission.New(config.MaxConnections, config.QueueSize, config.QueueTimeout.Duration))
+	watchServer(httpServer)
+	go httpServer.serve(listener)
+
+	if config.RedirectPort != 0 {
+		redirectPort := strconv.Itoa(config.RedirectPort)
+		plain, err := net.Listen("tcp", net.JoinHostPort(config.Host, redirectPort))
+		if err != nil {
+			slog.Error("Failed to start the HTTP to HTTPS redirect", "port", redirectPort, "err", err)
+			os.Exit(1)
+		}
+		slog.Info("Redirecting HTTP to HTTPS", "port", redirectPort)
+		go httpServer.serve(redirectListener{plain})
+	}
+
+	status := waitForShutdown(httpServer, signals)
+	if err := accessLog.Close(); err != nil {
+		slog.Error("Closing the access log", "err", err)
+	}
+	os.Exit(status)
+}
+
+/*
+waitForShutdown waits for SIGTERM or SIGINT and shuts the server down gracefully.
+A second signal closes the connections that are still busy at once.
+It returns the exit status: 0 when all connections finished, 1 when some had to be closed.
+*/
+func waitForShutdown(httpServer *server, signals chan os.Signal) int {
+	received := <-signals
+	slog.Info("Shutting down", "signal", received, "timeout", config.ShutdownTimeout, "connections", httpServer.admission.Stats().Active)
+	go func() {
+		<-signals
+		slog.Warn("Received a second signal, closing all connections")
+		httpServer.closeConnections()
+	}()
+
+	err := httpServer.shutdown(config.ShutdownTimeout.Duration)
+	status := 0
+	if err != nil {
+		slog.Error("Shutting down", "err", err)
+		status = 1
+	} else {
+		slog.Info("HTTP-server stopped")
 	}
+	// Push out what has been logged when stdout is a file
+	os.Stdout.Sync()
+	return status
+}
+
+/*
+server accepts connections and keeps track of them, so it can be shut down gracefully.
+Active connections and active requests are counted separately, since a persistent
+connection can stay open between requests. The admission controller limits the connections:
+when all slots are taken a connection waits in its queue, and when the queue is full or the wait
+times out the client is answered 503 Service Unavailable.
+*/
+type server struct {
+	admission      *admission.Controller
+	activeRequests atomic.Int32
+	waitGroup      sync.WaitGroup
+
+	// ctx is cancelled when the server shuts down, which stops the connections waiting for admission
+	ctx    context.Context
+	cancel context.CancelFunc
 
-	fmt.Printf("\x1b[32mHTTP-server started on port %s http://localhost:%s/site.html\x1b[0m\n", port, port)
+	mutex       sync.Mutex
+	listeners   []net.Listener
+	connections map[net.Conn]bool // connection -> whether it is idle, waiting for its next request
+	closing     bool
 
-	var waitGroup = sync.WaitGroup{}
-	var activeGoRoutines int32 = 0
+	http2 *http2Server // nil when HTTP/2 is turned off
+}
+
+// newServer creates a server whose connections are let in by controller.
+func newServer(controller *admission.Controller) *server {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &server{
+		admission:   controller,
+		ctx:         ctx,
+		cancel:      cancel,
+		connections: make(map[net.Conn]bool),
+	}
+	if config.HTTP2 {
+		s.http2 = newHTTP2Server(s)
+	}
+	return s
+}
+
+/*
+serve accepts connections from the listener and handles each of them in its own Go-routine.
+Accepting never stops while the server runs, so every client gets an answer.
+serve returns when the listener is closed, by shutdown or otherwise.
+*/
+func (s *server) serve(listener net.Listener) {
+	if !s.addListener(listener) {
+		listener.Close()
+		return
+	}
 
 	for {
 		connection, error_acc := listener.Accept()
 
-		if CheckError(error_acc, "During Accepting connection, Listener.Accept") {
+		if errors.Is(error_acc, net.ErrClosed) {
+			return
+		}
+		if error_acc != nil {
+			slog.Error("Accepting a connection", "err", error_acc)
 			continue //Skip this connection, and move on accepting another one.
 		}
 
-		if atomic.LoadInt32(&activeGoRoutines) >= maxConcurrentRequests {
-			fmt.Println("Max concurrent requests reached. Waiting for a request to finish.")
-			waitGroup.Wait() // Wait until a Go-routine is done.
+		if s.track(connection) {
+			go s.admitConnection(connection)
 		}
-
-		waitGroup.Add(1)
-		atomic.AddInt32(&activeGoRoutines, 1) // Thread safe incrementing of the amount of active registered Go-routines
-		fmt.Println("activeGoRoutines", activeGoRoutines)
-		go connectionHandler(connection, &waitGroup, &activeGoRoutines)
 	}
 }
 
 /*
-connectionHandler handles an individual connection.
-It reads the request, processes it, and sends an appropriate response.
+admitConnection waits until the admission controller lets the connection in and then handles it.
+A connection that is refused, also because the server shuts down while it waits,
+gets 503 Service Unavailable with a Retry-After header and is closed.
+A refused connection that speaks HTTP/2 is handed to the HTTP/2 server all the same, its streams wait for slots
+of their own and are refused one by one, as a client of HTTP/2 can not read a response of HTTP/1.1.
 */
-func connectionHandler(connection net.Conn, waitGroup *sync.WaitGroup, activeGoRoutines *int32) {
-	fmt.Printf("\x1b[33mConnection established: \x1b[0m\n")
+func (s *server) admitConnection(connection net.Conn) {
+	defer s.untrack(connection)
 
-	// Create a reader to read the HTTP request from the connection
-	reader := bufio.NewReader(connection)
-	request, error_read := http.ReadRequest(reader)
-	if CheckError(error_read, "During read from connection, http.ReadRequest(reader)") {
+	release, err := s.admission.Acquire(s.ctx)
+	stats := s.admission.Stats()
+	if err != nil {
+		connection.SetDeadline(time.Now().Add(time.Second))
+		reader := bufio.NewReader(connection)
+		if s.http2 != nil && speaksHTTP2(connection, reader) {
+			connection.SetDeadline(time.Time{})
+			s.http2.serve(connection, reader)
+			return
+		}
+		slog.Warn("Refusing connection", "remote_addr", connection.RemoteAddr().String(), "err", err,
+			"active", stats.Active, "limit", stats.Limit, "queued", stats.Waiting, "queue_size", stats.QueueSize)
+		rejectConnection(connection, reader, s.admission.RetryAfter())
 		return
 	}
-	// Construct the file path based on the request URI
-	url := "Lab1/files" + request.RequestURI
-	// Determine the content type of the requested resource and whether it's valid
-	contentType, isValid := getContentTypeAndCheckValid(url) //returns "" if not matching valid ContentType
-	// Get the content type sent by the client (Used in POST)
-	contentTypeSender := request.Header.Get("Content-Type")
-	// Determine if the sender's content type is valid
-	_, isValidSendertype := getContentTypeAndCheckValid(contentTypeSender)
-
-	fmt.Println("this is requestURL " + request.RequestURI)
-	fmt.Println("this is isValid ", isValid)
-	fmt.Println("this is contentType on the url path " + contentType)
-	fmt.Println("this is contentType from sender " + contentTypeSender)
-	fmt.Println("this is isValidSendertype ", isValidSendertype)
-	// Decrement the activeGoRoutines counter when the function returns
-	defer atomic.AddInt32(activeGoRoutines, -1)
+	release = sync.OnceFunc(release)
+	defer release()
+
+	slog.Debug("Connection established", "remote_addr", connection.RemoteAddr().String(),
+		"active", stats.Active, "queued", stats.Waiting, "active_requests", s.activeRequests.Load())
+	s.connectionHandler(connection, release)
+}
+
+/*
+rejectConnection answers 503 Service Unavailable on a connection the server has no room for, and closes it.
+The request is read first, because a connection that is closed with unread data is reset,
+and the client could lose the response.
+A liveness probe of the health endpoint is answered 200 OK instead, as a busy server is still alive.
+*/
+func rejectConnection(connection net.Conn, reader *bufio.Reader, retryAfter int) {
+	defer connection.Close()
+
+	connection.SetReadDeadline(time.Now().Add(time.Second))
+	start := time.Now()
+	request, err := http.ReadRequest(reader)
+	parsed := err == nil
+	if !parsed {
+		request = &http.Request{ProtoMajor: 1, ProtoMinor: 1}
+	}
+	request.Close = true
+	request.RemoteAddr = connection.RemoteAddr().String()
+
+	writer := bufio.NewWriter(connection)
+	response := newResponseWriter(writer, request)
+	if parsed && request.URL.Path == healthPath {
+		if checkAccess(response, request) {
+			handleHealth(response, request)
+		}
+	} else {
+		response.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		giveResponse(response, 503)
+	}
+	response.finish()
+	if err := writer.Flush(); err != nil {
+		slog.Debug("Sending the response to a refused connection", "remote_addr", request.RemoteAddr, "err", err)
+	}
+	if parsed {
+		logAccess(request, response.status, response.written, start)
+		recordRequest(request, response.status, response.written, start)
+	}
+}
+
+/*
+connectionHandler handles an individual connection.
+It reads requests from the connection one after another and answers each of them in order,
+so pipelined requests that are already waiting in the reader get their responses in the order they were sent.
+The connection is closed when the client asks for it, when a response can not be delimited,
+when no new request arrives within the idle timeout, or when the server shuts down.
+Slow clients can not hold a connection forever: headers must arrive within the header timeout and
+bodies within the body timeout and minimum rate, both answered 408 Request Timeout, and a write
+to a client that stops reading fails after the write timeout.
+A connection that speaks HTTP/2 is handed to the HTTP/2 server instead. It then gives back its admission slot
+with release, since each of its streams waits for a slot of its own.
+*/
+func (s *server) connectionHandler(connection net.Conn, release func()) {
 	// Close the connection when the function returns
 	defer connection.Close()
-	// Notify the waitGroup that the function is done
-	defer waitGroup.Done()
-
-	// Handle the HTTP method GET
-	if request.Method == "GET" {
-		fmt.Println("GET")
-		// If the content type is not valid, respond with a Bad Request error
-		if !isValid { //If isValiedType = false   (If not one of these types : .txt .html .css .jpg .jpeg) -> send "Bad request" response
-			err := giveResponse(connection, responseType(400, "", "")) // 400 Bad Request
-			if CheckError(err, "GiveRespones") {
-				return
+
+	logger := slog.With("remote_addr", connection.RemoteAddr().String())
+	if tlsConnection, ok := connection.(*tls.Conn); ok {
+		// The handshake is done first, to know whether the client chose HTTP/2
+		connection.SetDeadline(time.Now().Add(config.HeaderTimeout.Duration))
+		if err := tlsConnection.Handshake(); err != nil {
+			var recordError tls.RecordHeaderError
+			if errors.As(err, &recordError) && recordError.Conn != nil {
+				// The client speaks plain HTTP to the HTTPS port, which is told in plain text
+				io.WriteString(recordError.Conn, "HTTP/1.0 400 Bad Request\r\n\r\nClient sent an HTTP request to an HTTPS server.\n")
+				logger.Info("Plain HTTP request to the HTTPS port")
+			} else if !isConnectionDone(err) {
+				logger.Info("TLS handshake", "err", err)
 			}
-		} else {
-			// If the content type is valid, check if the file exists
-			if checkFileExistence(url) {
-				fmt.Println("File exists")
-				// Read the file contents
-				fileContents, err_read := readFile(url)
-				if CheckError(err_read, "Reading file from url, readFile(url) ") {
-					return
-				}
-				// Respond with a success status and content type header
-				err := giveResponse(connection, responseType(200, contentType, strconv.Itoa(len(fileContents))))
-				if CheckError(err, "GiveRespones") {
-					return
-				}
-				// Send the file contents to the client
-				err = sendResponseFile(connection, fileContents)
-				if CheckError(err, "During sendResponseFile, back to connection ") {
-					return
-				}
-
-			} else {
-				// If the file does not exist, respond with a 404 Not Found
-				err := giveResponse(connection, responseType(404, "", ""))
-				if CheckError(err, "GiveRespones") {
-					return
-				}
+			return
+		}
+		connection.SetDeadline(time.Time{})
+		if s.http2 != nil && tlsConnection.ConnectionState().NegotiatedProtocol == "h2" {
+			release()
+			s.http2.serve(connection, bufio.NewReader(connection))
+			return
+		}
+	}
+
+	// Create a reader and a writer that are kept for all requests on the connection,
+	// writes that stall for longer than the write timeout fail
+	reader := bufio.NewReader(connection)
+	writer := bufio.NewWriter(&timeoutConn{Conn: connection, writeTimeout: config.WriteTimeout.Duration})
+	defer writer.Flush()
+
+	serve := serveRequest
+	_, redirect := connection.(redirectConn)
+	if redirect {
+		serve = serveRedirect
+	}
+	// HTTP/2 with prior knowledge must start the connection, not on the redirect listener which only redirects
+	_, encrypted := connection.(*tls.Conn)
+	priorKnowledge := s.http2 != nil && !redirect && !encrypted
+	for {
+		// Wait at most the idle timeout for the next request to start
+		connection.SetReadDeadline(time.Now().Add(config.IdleTimeout.Duration))
+		if !s.setIdle(connection, true) {
+			return // The server shuts down
+		}
+		_, error_read := reader.Peek(1)
+		closing := !s.setIdle(connection, false)
+		if error_read != nil {
+			if !isConnectionDone(error_read) {
+				logger.Warn("Waiting for a request", "err", error_read)
 			}
+			return
 		}
-	} else if request.Method == "POST" {
-		fmt.Println("POST")
-		// If the sender's content type is not valid, respond with a Bad Request error
-		if !isValidSendertype { //If the sender type not matches
-			err := giveResponse(connection, responseType(400, "", "")) // 400 Bad Request
-			if CheckError(err, "GiveRespones") {
+
+		// Once a request has started its headers must arrive within the header timeout
+		connection.SetReadDeadline(time.Now().Add(config.HeaderTimeout.Duration))
+		if priorKnowledge {
+			priorKnowledge = false
+			if hasHTTP2Preface(reader) {
+				release()
+				s.http2.serve(connection, reader)
 				return
 			}
-		} else {
-			// Save the file sent in the POST request
-			err := saveFile(request, url)
-			if CheckError(err, "During savefile from sender during POST") {
+		}
+		request, error_read := http.ReadRequest(reader)
+		if error_read != nil {
+			if isTimeout(error_read) {
+				logger.Info("Request headers did not arrive within the header timeout")
+				response := newResponseWriter(writer, &http.Request{Close: true})
+				giveResponse(response, 408) // 408 Request Timeout for headers that are too slow
 				return
 			}
-			// Respond with a success status and content type header
-			err = giveResponse(connection, responseType(200, contentTypeSender, "")) // 200 ok
-			if CheckError(err, "GiveRespones") {
+			if isConnectionDone(error_read) {
 				return
 			}
+			logger.Info("Reading a request", "err", error_read)
+			response := newResponseWriter(writer, &http.Request{Close: true})
+			giveResponse(response, 400) // 400 Bad Request for a malformed request
+			return
 		}
-	} else {
-		// If the HTTP method is not supported, respond with a Not Implemented error
-		err := giveResponse(connection, responseType(501, "", ""))
-		if CheckError(err, "GiveRespones") {
+		if closing {
+			request.Close = true // The server shuts down, answer this request and close
+		}
+		connection.SetReadDeadline(time.Time{})
+		request.RemoteAddr = connection.RemoteAddr().String()
+		body := newTimeoutBody(request.Body, connection)
+		request.Body = body
+
+		s.activeRequests.Add(1)
+		keepAlive := serve(writer, request)
+		s.activeRequests.Add(-1)
+		requestBodyBytes.Add(float64(body.read))
+
+		if !keepAlive {
 			return
 		}
+		// Only flush when no pipelined request is waiting, so responses to a pipeline are sent together
+		if reader.Buffered() == 0 {
+			if err := writer.Flush(); err != nil {
+				logger.Debug("Sending responses", "err", err)
+				return
+			}
+		}
+	}
+}
+
+/*
+logAccess writes the line of a request to the access log, with the status and the body bytes that were sent.
+*/
+func logAccess(request *http.Request, status int, written int64, start time.Time) {
+	err := accessLog.Log(accesslog.Entry{
+		Time:       start,
+		RemoteAddr: request.RemoteAddr,
+		Method:     request.Method,
+		URI:        request.RequestURI,
+		Proto:      request.Proto,
+		User:       authenticatedUser(request),
+		Status:     status,
+		Bytes:      written,
+		Duration:   time.Since(start),
+		Referer:    request.Referer(),
+		UserAgent:  request.UserAgent(),
+	})
+	if err != nil {
+		requestLogger(request).Error("Writing the access log", "err", err)
 	}
+}
 
+// requestLogger returns the logger of a request, which adds its ID and remote address to every line.
+func requestLogger(request *http.Request) *slog.Logger {
+	return logging.FromContext(request.Context())
 }
 
 /*
-CheckPort takes in a string of arguments, the arguments is the port-number given when stared.
-Checks if an argument is given.
-Checks if the arguments consists of numbers.
-If the argument is a number, it checks if the port-number is free for use.
-If not all above, returns false. If all tests passes, returns true.
+serveRequest answers a single request and reports whether the connection can be used for another one.
+A client that sends "Expect: 100-continue" gets 100 Continue when the handler starts reading the body,
+other expectations are answered with 417 Expectation Failed.
+Every request is written to the access log and counted in the metrics once it is answered. The handlers log with a logger
+that adds the request ID and remote address, so the lines of one request can be found.
+Whatever the handler did not read of the request body is skipped, so the reader is positioned at the next request.
 */
-func CheckPort(args []string) bool {
-	if len(args) < 2 {
-		fmt.Printf("\x1b[31mError: Please give an Port-number as start-arg.\x1b[0m\n") // "\x1b[31m  makes the text red for error messages
+func serveRequest(writer *bufio.Writer, request *http.Request) bool {
+	start := time.Now()
+	logger := slog.With("request_id", logging.NewRequestID(), "remote_addr", request.RemoteAddr)
+	request = request.WithContext(logging.NewContext(request.Context(), logger))
+	logger.Debug("Request", "method", request.Method, "uri", request.RequestURI, "proto", request.Proto)
+
+	response := newResponseWriter(writer, request)
+	if expect := request.Header.Get("Expect"); expect == "" {
+		handleRequest(response, request)
+	} else if strings.EqualFold(expect, "100-continue") {
+		if request.ProtoAtLeast(1, 1) {
+			response.expectContinue(request) // HTTP/1.0 clients send the body without waiting
+		}
+		handleRequest(response, request)
+	} else {
+		// Only 100-continue is known, the request is not handled and its body not read
+		response.keepAlive = false
+		giveResponse(response, 417)
+	}
+	response.finish()
+	logAccess(request, response.status, response.written, start)
+	recordRequest(request, response.status, response.written, start)
+
+	if !response.keepAlive {
+		// The body is not closed, that would read all of it, the connection is closed instead
 		return false
 	}
-	regex := regexp.MustCompile("^[0-9]+$")
+	// Skip the rest of the body, but close instead of reading a huge upload nobody wants
+	skipped, err := io.CopyN(io.Discard, request.Body, maxDrainBytes+1)
+	if skipped > maxDrainBytes || (err != nil && err != io.EOF) {
+		return false
+	}
+	request.Body.Close()
+	return true
+}
+
+// isConnectionDone reports whether a read error means the client closed or abandoned an idle connection.
+func isConnectionDone(err error) bool {
+	return err == io.EOF || errors.Is(err, net.ErrClosed) || isTimeout(err)
+}
+
+// allowedMethods is the value of the Allow header, the methods the file server supports.
+const allowedMethods = "GET, HEAD, POST, PUT, DELETE, OPTIONS"
+
+/*
+handleRequest processes one request and writes the response.
+It finds the site of the Host header, resolves the request URI to a file path inside its document root
+(for uploads the upload directory) and lets the handler of the request method answer.
+An HTTP/1.1 request without a Host header gets 400 Bad Request, as RFC 9112 requires, and a request
+for an unknown host 421 Misdirected Request when the configuration rejects unknown hosts.
+A client that the access rules do not allow the request gets 403 Forbidden, before anything else is done for it,
+so the rules can also keep clients from the metrics. The metrics, health and readiness endpoints are answered
+for every host before the path is resolved, so no file can take their place.
+Methods the server knows but does not allow get 405 Method Not Allowed, unknown methods 501 Not Implemented.
+*/
+func handleRequest(response http.ResponseWriter, request *http.Request) {
+	if request.ProtoMajor == 1 && request.ProtoMinor >= 1 && request.Host == "" {
+		requestLogger(request).Info("HTTP/1.1 request without a Host header")
+		giveResponse(response, 400)
+		return
+	}
+	if !checkAccess(response, request) {
+		return
+	}
+	if handler := endpointHandler(request.URL.Path); handler != nil {
+		if err := handler(response, request); err != nil {
+			requestLogger(request).Debug("Answering "+request.URL.Path, "err", err)
+		}
+		return
+	}
+	vhost := findVirtualHost(request)
+	if vhost == nil {
+		requestLogger(request).Info("Request for an unknown host", "host", request.Host)
+		giveResponse(response, 421)
+		return
+	}
+	// Requests are counted against the limits before they are refused for their credentials, so guessing passwords is limited too
+	user, authenticated := authenticate(request)
+	if !allowRate(response, request, user) {
+		return
+	}
+	if !authenticated {
+		challenge(response)
+		return
+	}
+	// Construct the file path inside the document root, or the upload directory, based on the request URI
+	root := vhost.config.Root
+	if request.Method == "POST" || request.Method == "PUT" || request.Method == "DELETE" {
+		root = vhost.config.UploadDir
+	}
+	url, err := resolvePath(root, request.RequestURI)
+	if err != nil && !(request.Method == "OPTIONS" && request.RequestURI == "*") {
+		requestLogger(request).Info("Resolving the path", "uri", request.RequestURI, "err", err)
+		giveResponse(response, pathErrorStatus(err))
+		return
+	}
+	if isHiddenPath(root, url) {
+		// Files such as .mime.types and unfinished uploads are not part of the site
+		giveResponse(response, 404)
+		return
+	}
+
+	switch request.Method {
+	case "GET", "HEAD":
+		err = handleGet(response, request, vhost, url)
+	case "POST":
+		err = handlePost(response, request, vhost, url)
+	case "PUT":
+		err = handlePut(response, request, vhost, url)
+	case "DELETE":
+		err = handleDelete(response, request, vhost, url)
+	case "OPTIONS":
+		err = handleOptions(response, vhost)
+	case "PATCH", "TRACE", "CONNECT":
+		// Known methods that the file server does not allow
+		response.Header().Set("Allow", allowedMethods)
+		err = giveResponse(response, 405)
+	default:
+		// If the HTTP method is not supported, respond with a Not Implemented error
+		err = giveResponse(response, 501)
+	}
+	if err != nil {
+		requestLogger(request).Error("Handling the request", "method", request.Method, "err", err)
+	}
+}
 
-	if regex.MatchString(args[1]) {
-		fmt.Printf("\x1b[33mGiven Port is: %s \x1b[0m\n", args[1]) //os.Args[1] = the first argument given, Obs not 0-index
+/*
+CheckPort takes in the host and the port-number the server is configured with.
+Checks if the port consists of numbers.
+If the port is a number, it checks if the port-number is free for use.
+If not all above, returns false. If all tests passes, returns true.
+*/
+func CheckPort(host string, port string) bool {
+	regex := regexp.MustCompile("^[0-9]+$")
 
+	if regex.MatchString(port) {
 		//Test if the port is free to use.
-		conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%s", args[1]))
+		if host == "" {
+			host = "localhost"
+		}
+		conn, err := net.Dial("tcp", net.JoinHostPort(host, port))
 		if err != nil {
-			fmt.Printf("\x1b[33mPort %s is available.\x1b[0m\n", args[1])
+			slog.Debug("Port is available", "port", port)
 			return true
 		}
 		conn.Close()
 
 	} else {
-		fmt.Printf("\x1b[31mError: Only numbers can be given :%s: is incorrect input.\x1b[0m\n", args[1])
+		slog.Error("Only numbers can be given as port", "port", port)
 		return false
 	}
-	fmt.Printf("\x1b[33mPort %s is NOT available.\x1b[0m\n", args[1])
+	slog.Error("Port is not available", "port", port)
 	return false
 }
 
 /*
-CheckError checks if an error has occurred and prints an error message.
-It takes an error and a location description as arguments.
-If the error is != nil, it indicates an error occurred, then it
-prints an error-message with an explanation and returns true.
-If error = nil, it returns false to indicate no error.
+getContentTypeAndCheckValid determines the content type of a file from its extension, or if the extension
+is unknown by sniffing the beginning of the file. It returns the content type and a boolean indicating
+if it's valid, a type that the configuration of the site allows.
 */
-func CheckError(error error, place string) bool {
-	if error != nil {
-		fmt.Printf("\x1b[31mError during:%s.\x1b[0m \n", place)
-		fmt.Printf("\x1b[31mexplanation Err =:%s.\x1b[0m \n", error)
-		return true
-	} else {
-		return false
+func getContentTypeAndCheckValid(vhost *virtualHost, filePath string) (string, bool) {
+	contentType, known, err := vhost.mimeTypes.DetectFile(filePath)
+	if err != nil || !known || !vhost.config.allowsType(contentType) {
+		return "", false
 	}
+	return contentType, true
 }
 
-// getContentTypeAndCheckValid determines the content type based on the file extension or provided content type.
-// It returns the content type and a boolean indicating if it's valid.
-func getContentTypeAndCheckValid(filePath string) (string, bool) {
-	extension := strings.ToLower(filepath.Ext(filePath)) // Extract the file extension type from the file path
-
-	var condition string // create the condition variable for the switch
-
-	if extension == "" {
-		condition = filePath // if the file path does not have an extension at the end then we use the whole file path as condition (POST)
-	} else {
-		condition = extension // if the file path has an extension then we use only the file extension type as condition (GET)
-	}
-	switch condition { //cover all types of extensions and then return true
-	case ".html", "text/html":
-		return "text/html", true
-
-	case ".txt", "text/plain":
-		return "text/plain", true
-
-	case ".gif", "image/gif":
-		return "image/gif", true
-
-	case ".jpeg", ".jpg", "image/jpeg":
-		return "image/jpeg", true
-
-	case ".css", "text/css":
-		return "text/css", true
-
-	default: //else return false
+// checkSenderType checks the content type sent by a client, which is valid if the type is known and allowed on the site.
+func checkSenderType(vhost *virtualHost, contentType string) (string, bool) {
+	registered, known := vhost.mimeTypes.Lookup(contentType)
+	if !known || !vhost.config.allowsType(registered) {
 		return "", false
 	}
+	return registered, true
 }
 
 // checkFileExistence checks if a file exists at the specified path.
 // It returns true if the file exists, otherwise false.
 func checkFileExistence(filePath string) bool {
-	fileInfo, err := os.Stat(filePath)
+	_, err := os.Stat(filePath)
 	if err == nil {
-		fmt.Printf("Filen %s hittades. Storlek: %d bytes\n", filePath, fileInfo.Size())
 		return true
-	} else if os.IsNotExist(err) {
-		fmt.Printf("Filen %s finns inte\n", filePath)
-		return false
-	} else {
-		fmt.Println("Fel vid kontroll av filen:", err)
-		return false
 	}
+	if !isNotExist(err) {
+		slog.Error("Checking if a file exists", "path", filePath, "err", err)
+	}
+	return false
 }
 
 /*
-giveResponse takes a connection and the respons string to send.
-Sends the response string to the given connection, and returns an error.
+giveResponse takes a response writer and a status code.
+Sends a short plain text response for the status, and returns an error.
 */
-func giveResponse(conn net.Conn, response string) error {
-	_, err := conn.Write([]byte(response))
-	if err != nil {
-		fmt.Println("Fel vid skickande av HTTP-svarhuvuden:", err)
-		return err
-	}
-	return nil
+func giveResponse(response http.ResponseWriter, rtype int) error {
+	message := responseType(rtype)
+	response.Header().Set("Content-Type", "text/plain")
+	response.Header().Set("Content-Length", strconv.Itoa(len(message)))
+	response.WriteHeader(rtype)
+	_, err := io.WriteString(response, message)
+	return err
 }
 
-// sendResponseFile sends the file contents to the connection.
-func sendResponseFile(conn net.Conn, fileContents []byte) error {
-	_, err := conn.Write(fileContents)
-	if CheckError(err, "During conn.Write(fileContents, inside sendResponsFile") {
+/*
+sendResponseFile streams a range of an open file to the connection.
+The file is positioned at the start of the range and copied as an io.LimitedReader, which the connection
+can send with the sendfile system call, without the bytes passing through the memory of the server.
+*/
+func sendResponseFile(response http.ResponseWriter, file *os.File, r byteRange) error {
+	_, err := file.Seek(r.start, io.SeekStart)
+	if err != nil {
 		return err
-	} else {
-		return nil
 	}
+	_, err = io.Copy(response, io.LimitReader(file, r.length))
+	return err
 }
 
-// readFile reads the content of a file from the server's disk.
-// It returns the file contents as a byte slice or an error if one occurs.
-func readFile(url string) ([]byte, error) {
-	fileMutex.Lock()         //Locking for thread-safety
-	defer fileMutex.Unlock() //Unlocking when done
+/*
+openFile opens a file on the server's disk for streaming.
+It returns the open file and the file information, or an error if one occurs.
+The read lock of the path is only held while the file is opened. Uploads replace files by renaming,
+so the open file keeps its contents while its bytes are sent, even if a new version is uploaded.
+*/
+func openFile(url string) (*os.File, os.FileInfo, error) {
+	unlock := locks.readLock(url) //Locking the path for reading
+	defer unlock()
 	file, err := os.Open(url)
-	if CheckError(err, "Inside readFile, error during os.open(url)") {
-		return nil, err
+	if err != nil {
+		return nil, nil, err
 	}
-	defer file.Close()
 
-	// Read the file
-	fileContents, err := io.ReadAll(file)
-	if CheckError(err, "Inside readFile, error during io.ReadAll(file)") {
-		return nil, err
+	// Get the size and modification time of the file
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
 	}
-	return fileContents, nil //If all good, return fileContents
+	return file, fileInfo, nil
 }
 
 /*
-responseType takes in the rtype, contentType and length.
-Creates a header for respons base on the value on rtype. 400 = Bad Request,
-404 = Not found, 501 = Not Implemented and 200 = OK.
-returns the respons string
+responseType takes in the rtype and returns the message sent as body for that status.
+400 = Bad Request, 401 = Unauthorized, 403 = Forbidden, 429 = Too Many Requests, 404 = Not found, 405 = Method Not Allowed, 409 = Conflict, 412 = Precondition Failed,
+421 = Misdirected Request, 408 = Request Timeout, 413 = Payload Too Large, 416 = Range Not Satisfiable, 417 = Expectation Failed, 500 = Internal Server Error,
+501 = Not Implemented, 503 = Service Unavailable, 200 = OK and 201 = Created.
 */
-func responseType(rtype int, contentType string, length string) string {
+func responseType(rtype int) string {
 	switch rtype {
 	case 400:
-		message := "400 Bad Request. No such content type"
-		response := "HTTP/1.1 400 Bad Request\r\nContent-Length:" + fmt.Sprint(len(message)) + "\r\nContent-Type: text/plain\r\n\r\n" + message
-		return response
-
+		return "400 Bad Request. No such content type"
 	case 404:
-		message := "404 Not Found"
-		response := "HTTP/1.1 404 Not Found\r\nContent-Length:" + fmt.Sprint(len(message)) + "\r\nContent-Type: text/plain\r\n\r\n" + message
-		return response
+		return "404 Not Found"
+	case 413:
+		return "413 Payload Too Large"
+	case 416:
+		return "416 Range Not Satisfiable"
 	case 501:
-		message := "Not Implemented"
-		response := "HTTP/1.1 501 Not Implemented\r\nContent-Length:" + fmt.Sprint(len(message)) + "\r\n\r\n" + message
-		return response
-	case 200:
-		response := "HTTP/1.1 200 OK\r\nContent-Length: " + length + "\r\nContent-Type: " + contentType + "\r\n\r\n"
-		return response
+		return "Not Implemented"
 	default:
-		return ""
+		return strconv.Itoa(rtype) + " " + http.StatusText(rtype)
 	}
 }
 
-// saveFile saves the contents of a POST request to a file.
-func saveFile(request *http.Request, url string) error {
-	fileMutex.Lock()
-	defer fileMutex.Unlock()
-	body, err := ioutil.ReadAll(request.Body)
-	if CheckError(err, "Inside saveFile, error during ioutil.readAll(request.body)") {
-		return err
-	}
-	// Save the content from the POST to a file.
-	err = ioutil.WriteFile(url, body, 0777) //0777 = authorization code:
-	if CheckError(err, "inside SaveFile, error during ioutil.writeFile(url, body ..)") {
-		return err
-	}
-	return nil
+// deleteFile removes a file from the server's disk.
+func deleteFile(url string) error {
+	unlock := locks.writeLock(url)
+	defer unlock()
+	return os.Remove(url)
 }
@@ -1,14 +1,114 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"http_server/accesslog"
+	"http_server/admission"
+	"http_server/filewatch"
+	"http_server/health"
+	"http_server/htpasswd"
+	"http_server/ipfilter"
+	"http_server/logging"
+	"http_server/tlsconfig"
 )
 
-func Test_Server(t *testing.T) {
+// TestMain starts the server on port 8080, serving the files in Lab1/files.
+func TestMain(m *testing.M) {
+	// Run as the server itself, for the tests that start it as a separate process
+	if os.Getenv("HTTP_SERVER_TEST_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+
+	config.Root = "../files"
+	config.UploadDir = "../files"
+	config.IdleTimeout.Duration = 500 * time.Millisecond
+	config.HeaderTimeout.Duration = 500 * time.Millisecond
+	config.BodyTimeout.Duration = 500 * time.Millisecond
+	config.WriteTimeout.Duration = time.Second
+	config.UploadLimits = sizeMap{"application/pdf": 64}
+	accessLog = accesslog.New(&accessLogBuffer, accesslog.JSON)
+
+	listener, err := net.Listen("tcp", ":8080")
+	if err != nil {
+		panic(err)
+	}
+	testServer := newServer(admission.New(config.MaxConnections, config.QueueSize, config.QueueTimeout.Duration))
+	watchServer(testServer)
+	go testServer.serve(listener)
+
+	code := m.Run()
+	listener.Close()
+	os.Exit(code)
+}
+
+// syncBuffer is a buffer that can be written from several Go-routines.
+type syncBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *syncBuffer) Write(data []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.Write(data)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.String()
+}
+
+// accessLogBuffer collects the access log of the test server, in JSON.
+var accessLogBuffer syncBuffer
+
+// readResponses reads count responses from the reader, including their bodies.
+func readResponses(t *testing.T, reader *bufio.Reader, count int) []*http.Response {
+	t.Helper()
+	var responses []*http.Response
+	for i := 0; i < count; i++ {
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("Error reading response %d: %v", i, err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("Error reading body of response %d: %v", i, err)
+		}
+		resp.Body = io.NopCloser(strings.NewReader(string(body)))
+		responses = append(responses, resp)
+	}
+	return responses
+}
 
-	go main()
+func Test_Server(t *testing.T) {
 
 	t.Run("Test GET request with valid file", func(t *testing.T) {
 		resp, err := http.Get("http://localhost:8080/site.html") // Assuming your server is running on port 8080
@@ -75,7 +175,8 @@ func Test_Server(t *testing.T) {
 
 				resp, err := http.Get("http://localhost:8080/site.html")
 				if err != nil {
-					t.Fatalf("Error sending GET request: %v", err)
+					t.Errorf("Error sending GET request: %v", err)
+					return
 				}
 				defer resp.Body.Close()
 
@@ -90,3 +191,2568 @@ func Test_Server(t *testing.T) {
 
 	t.Log("This is a test")
 }
+
+func Test_PersistentConnections(t *testing.T) {
+
+	t.Run("Test pipelined requests are answered in order on one connection", func(t *testing.T) {
+		conn, err := net.Dial("tcp", "localhost:8080")
+		if err != nil {
+			t.Fatalf("Error connecting: %v", err)
+		}
+		defer conn.Close()
+
+		pipeline := "GET /site.html HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+			"GET /nonexistent.html HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+			"GET /text.txt HTTP/1.1\r\nHost: localhost\r\n\r\n"
+		if _, err := conn.Write([]byte(pipeline)); err != nil {
+			t.Fatalf("Error writing pipeline: %v", err)
+		}
+
+		responses := readResponses(t, bufio.NewReader(conn), 3)
+		expected := []int{http.StatusOK, http.StatusNotFound, http.StatusOK}
+		for i, resp := range responses {
+			if resp.StatusCode != expected[i] {
+				t.Errorf("Response %d: expected status %d, got %s", i, expected[i], resp.Status)
+			}
+			if resp.Close {
+				t.Errorf("Response %d: connection should stay open", i)
+			}
+		}
+		if responses[2].Header.Get("Content-Type") != "text/plain; charset=utf-8" {
+			t.Errorf("Expected the third response to be text/plain, got %s", responses[2].Header.Get("Content-Type"))
+		}
+	})
+
+	t.Run("Test Connection close ends the connection", func(t *testing.T) {
+		conn, err := net.Dial("tcp", "localhost:8080")
+		if err != nil {
+			t.Fatalf("Error connecting: %v", err)
+		}
+		defer conn.Close()
+
+		conn.Write([]byte("GET /site.html HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+		reader := bufio.NewReader(conn)
+		resp := readResponses(t, reader, 1)[0]
+		if !resp.Close {
+			t.Errorf("Expected Connection: close in the response")
+		}
+		if _, err := reader.ReadByte(); err != io.EOF {
+			t.Errorf("Expected the server to close the connection, got %v", err)
+		}
+	})
+
+	t.Run("Test HTTP/1.0 closes unless keep-alive is requested", func(t *testing.T) {
+		conn, err := net.Dial("tcp", "localhost:8080")
+		if err != nil {
+			t.Fatalf("Error connecting: %v", err)
+		}
+		defer conn.Close()
+
+		conn.Write([]byte("GET /site.html HTTP/1.0\r\nConnection: keep-alive\r\n\r\n"))
+		reader := bufio.NewReader(conn)
+		resp := readResponses(t, reader, 1)[0]
+		if resp.Header.Get("Connection") != "keep-alive" {
+			t.Errorf("Expected Connection: keep-alive, got %q", resp.Header.Get("Connection"))
+		}
+
+		conn.Write([]byte("GET /site.html HTTP/1.0\r\n\r\n"))
+		resp = readResponses(t, reader, 1)[0]
+		if !resp.Close {
+			t.Errorf("Expected the HTTP/1.0 connection to be closed")
+		}
+	})
+
+	t.Run("Test idle connections are closed after the timeout", func(t *testing.T) {
+		conn, err := net.Dial("tcp", "localhost:8080")
+		if err != nil {
+			t.Fatalf("Error connecting: %v", err)
+		}
+		defer conn.Close()
+
+		conn.SetReadDeadline(time.Now().Add(config.IdleTimeout.Duration + 2*time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("Expected the idle connection to be closed, got %v", err)
+		}
+	})
+}
+
+// getWithHeaders sends a GET request for path with the given headers.
+func getWithHeaders(t *testing.T, path string, headers map[string]string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest("GET", "http://localhost:8080"+path, nil)
+	if err != nil {
+		t.Fatalf("Error creating GET request: %v", err)
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error sending GET request: %v", err)
+	}
+	return resp
+}
+
+func Test_RangeRequests(t *testing.T) {
+	original, err := os.ReadFile("../files/dog.jpeg")
+	if err != nil {
+		t.Fatalf("Error reading dog.jpeg: %v", err)
+	}
+
+	t.Run("Test single range", func(t *testing.T) {
+		resp := getWithHeaders(t, "/dog.jpeg", map[string]string{"Range": "bytes=100-199"})
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+
+		if resp.StatusCode != http.StatusPartialContent {
+			t.Fatalf("Expected status Partial Content, got %s", resp.Status)
+		}
+		expectedRange := "bytes 100-199/" + strconv.Itoa(len(original))
+		if resp.Header.Get("Content-Range") != expectedRange {
+			t.Errorf("Expected Content-Range %s, got %s", expectedRange, resp.Header.Get("Content-Range"))
+		}
+		if !bytes.Equal(body, original[100:200]) {
+			t.Errorf("Body does not match bytes 100-199 of the file")
+		}
+	})
+
+	t.Run("Test suffix and open ended ranges", func(t *testing.T) {
+		resp := getWithHeaders(t, "/dog.jpeg", map[string]string{"Range": "bytes=-10"})
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, original[len(original)-10:]) {
+			t.Errorf("Expected the last 10 bytes, got %s with %d bytes", resp.Status, len(body))
+		}
+
+		resp = getWithHeaders(t, "/dog.jpeg", map[string]string{"Range": "bytes=75000-"})
+		body, _ = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, original[75000:]) {
+			t.Errorf("Expected the bytes from 75000, got %s with %d bytes", resp.Status, len(body))
+		}
+
+		// An end past the end of the file is clamped, also when it is too large for an int64
+		resp = getWithHeaders(t, "/dog.jpeg", map[string]string{"Range": "bytes=10-99999999999999999999"})
+		body, _ = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		expectedRange := "bytes 10-" + strconv.Itoa(len(original)-1) + "/" + strconv.Itoa(len(original))
+		if resp.StatusCode != http.StatusPartialContent || resp.Header.Get("Content-Range") != expectedRange || !bytes.Equal(body, original[10:]) {
+			t.Errorf("Expected the bytes from 10 with %s, got %s %q with %d bytes", expectedRange, resp.Status, resp.Header.Get("Content-Range"), len(body))
+		}
+
+		resp = getWithHeaders(t, "/dog.jpeg", map[string]string{"Range": "bytes=-99999999999999999999"})
+		body, _ = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, original) {
+			t.Errorf("Expected a suffix longer than the file to be the whole file, got %s with %d bytes", resp.Status, len(body))
+		}
+
+		resp = getWithHeaders(t, "/dog.jpeg", map[string]string{"Range": "bytes=99999999999999999999-"})
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+			t.Errorf("Expected a start too large for an int64 not to be satisfiable, got %s", resp.Status)
+		}
+	})
+
+	t.Run("Test multiple ranges", func(t *testing.T) {
+		resp := getWithHeaders(t, "/dog.jpeg", map[string]string{"Range": "bytes=0-9,500-509"})
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusPartialContent {
+			t.Fatalf("Expected status Partial Content, got %s", resp.Status)
+		}
+		mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		if err != nil || mediaType != "multipart/byteranges" {
+			t.Fatalf("Expected multipart/byteranges, got %s", resp.Header.Get("Content-Type"))
+		}
+		reader := multipart.NewReader(resp.Body, params["boundary"])
+		expected := [][]byte{original[0:10], original[500:510]}
+		for i := range expected {
+			part, err := reader.NextPart()
+			if err != nil {
+				t.Fatalf("Error reading part %d: %v", i, err)
+			}
+			data, _ := io.ReadAll(part)
+			if !bytes.Equal(data, expected[i]) {
+				t.Errorf("Part %d does not match the file", i)
+			}
+			if part.Header.Get("Content-Type") != "image/jpeg" {
+				t.Errorf("Part %d: expected image/jpeg, got %s", i, part.Header.Get("Content-Type"))
+			}
+		}
+		if _, err := reader.NextPart(); err != io.EOF {
+			t.Errorf("Expected exactly two parts, got %v", err)
+		}
+	})
+
+	t.Run("Test range not satisfiable", func(t *testing.T) {
+		resp := getWithHeaders(t, "/dog.jpeg", map[string]string{"Range": "bytes=100000-"})
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+			t.Errorf("Expected status Range Not Satisfiable, got %s", resp.Status)
+		}
+		if resp.Header.Get("Content-Range") != "bytes */"+strconv.Itoa(len(original)) {
+			t.Errorf("Expected Content-Range with the file size, got %s", resp.Header.Get("Content-Range"))
+		}
+	})
+
+	t.Run("Test a suffix range of an empty file is not satisfiable", func(t *testing.T) {
+		os.WriteFile("../files/empty_range_test.txt", nil, 0644)
+		defer os.Remove("../files/empty_range_test.txt")
+		resp := getWithHeaders(t, "/empty_range_test.txt", map[string]string{"Range": "bytes=-5"})
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable || resp.Header.Get("Content-Range") != "bytes */0" {
+			t.Errorf("Expected 416 with Content-Range bytes */0, got %s %q", resp.Status, resp.Header.Get("Content-Range"))
+		}
+	})
+
+	t.Run("Test invalid range and failing If-Range send the whole file", func(t *testing.T) {
+		for _, headers := range []map[string]string{
+			{"Range": "lines=1-2"},
+			{"Range": "bytes="},
+			{"Range": "bytes= , ,"},
+			{"Range": "bytes=0-9", "If-Range": "Wed, 21 Oct 2015 07:28:00 GMT"},
+		} {
+			resp := getWithHeaders(t, "/dog.jpeg", headers)
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || len(body) != len(original) {
+				t.Errorf("%v: expected the whole file with status OK, got %s with %d bytes", headers, resp.Status, len(body))
+			}
+			if resp.Header.Get("Accept-Ranges") != "bytes" {
+				t.Errorf("%v: expected Accept-Ranges: bytes", headers)
+			}
+		}
+	})
+}
+
+func Test_ConditionalRequests(t *testing.T) {
+	resp := getWithHeaders(t, "/flower.jpg", nil)
+	resp.Body.Close()
+	etag := resp.Header.Get("ETag")
+	lastModified := resp.Header.Get("Last-Modified")
+	if etag == "" || lastModified == "" {
+		t.Fatalf("Expected ETag and Last-Modified headers, got %q and %q", etag, lastModified)
+	}
+
+	tests := []struct {
+		name     string
+		headers  map[string]string
+		expected int
+	}{
+		{"If-None-Match with the current tag", map[string]string{"If-None-Match": etag}, http.StatusNotModified},
+		{"If-None-Match with a weak version of the tag", map[string]string{"If-None-Match": `"other", W/` + etag}, http.StatusNotModified},
+		{"If-None-Match with another tag", map[string]string{"If-None-Match": `"other"`}, http.StatusOK},
+		{"If-None-Match star", map[string]string{"If-None-Match": "*"}, http.StatusNotModified},
+		{"If-Modified-Since the last modification", map[string]string{"If-Modified-Since": lastModified}, http.StatusNotModified},
+		{"If-Modified-Since an old date", map[string]string{"If-Modified-Since": "Sun, 06 Nov 1994 08:49:37 GMT"}, http.StatusOK},
+		{"If-None-Match wins over If-Modified-Since", map[string]string{"If-None-Match": `"other"`, "If-Modified-Since": lastModified}, http.StatusOK},
+		{"If-Match with the current tag", map[string]string{"If-Match": etag}, http.StatusOK},
+		{"If-Match with another tag", map[string]string{"If-Match": `"other"`}, http.StatusPreconditionFailed},
+		{"If-Unmodified-Since an old date", map[string]string{"If-Unmodified-Since": "Sun, 06 Nov 1994 08:49:37 GMT"}, http.StatusPreconditionFailed},
+		{"If-Unmodified-Since the last modification", map[string]string{"If-Unmodified-Since": lastModified}, http.StatusOK},
+		{"If-Range with the current tag", map[string]string{"Range": "bytes=0-9", "If-Range": etag}, http.StatusPartialContent},
+		{"If-Range with another tag", map[string]string{"Range": "bytes=0-9", "If-Range": `"other"`}, http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := getWithHeaders(t, "/flower.jpg", test.headers)
+			defer resp.Body.Close()
+			if resp.StatusCode != test.expected {
+				t.Errorf("Expected status %d, got %s", test.expected, resp.Status)
+			}
+			if resp.StatusCode == http.StatusNotModified && resp.Header.Get("ETag") != etag {
+				t.Errorf("Expected the 304 response to carry the ETag")
+			}
+		})
+	}
+}
+
+// doRequest sends a request with the given method and body to path and returns the response.
+func doRequest(t *testing.T, method string, path string, contentType string, body string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, "http://localhost:8080"+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Error creating %s request: %v", method, err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error sending %s request: %v", method, err)
+	}
+	return resp
+}
+
+func Test_Methods(t *testing.T) {
+
+	t.Run("Test HEAD request sends headers without body", func(t *testing.T) {
+		resp, err := http.Head("http://localhost:8080/site.html")
+		if err != nil {
+			t.Fatalf("Error sending HEAD request: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+
+		info, _ := os.Stat("../files/site.html")
+		if resp.StatusCode != http.StatusOK || resp.ContentLength != info.Size() || len(body) != 0 {
+			t.Errorf("Expected 200 with Content-Length %d and no body, got %s, %d, %d bytes", info.Size(), resp.Status, resp.ContentLength, len(body))
+		}
+	})
+
+	t.Run("Test OPTIONS request lists the allowed methods", func(t *testing.T) {
+		resp := doRequest(t, "OPTIONS", "/site.html", "", "")
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Allow") != allowedMethods {
+			t.Errorf("Expected 200 with Allow %q, got %s with %q", allowedMethods, resp.Status, resp.Header.Get("Allow"))
+		}
+	})
+
+	t.Run("Test known but disallowed method gives 405", func(t *testing.T) {
+		resp := doRequest(t, "PATCH", "/site.html", "text/html", "patch")
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") == "" {
+			t.Errorf("Expected 405 with an Allow header, got %s", resp.Status)
+		}
+	})
+
+	t.Run("Test unknown method gives 501", func(t *testing.T) {
+		resp := doRequest(t, "BREW", "/site.html", "", "")
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusNotImplemented {
+			t.Errorf("Expected status Not Implemented, got %s", resp.Status)
+		}
+	})
+
+	t.Run("Test PUT creates and replaces, DELETE removes", func(t *testing.T) {
+		defer os.Remove("../files/put_test.txt")
+
+		resp := doRequest(t, "PUT", "/put_test.txt", "text/plain", "first")
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			t.Errorf("Expected status Created, got %s", resp.Status)
+		}
+
+		resp = doRequest(t, "PUT", "/put_test.txt", "text/plain", "second")
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			t.Errorf("Expected status No Content, got %s", resp.Status)
+		}
+		if data, _ := os.ReadFile("../files/put_test.txt"); string(data) != "second" {
+			t.Errorf("Expected the file to be replaced, got %q", data)
+		}
+
+		req, _ := http.NewRequest("PUT", "http://localhost:8080/put_test.txt", strings.NewReader("third"))
+		req.Header.Set("If-None-Match", "*")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error sending PUT request: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusPreconditionFailed {
+			t.Errorf("Expected If-None-Match: * to refuse replacing, got %s", resp.Status)
+		}
+
+		resp = doRequest(t, "DELETE", "/put_test.txt", "", "")
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			t.Errorf("Expected status No Content, got %s", resp.Status)
+		}
+
+		resp = doRequest(t, "DELETE", "/put_test.txt", "", "")
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("Expected status Not Found for a deleted file, got %s", resp.Status)
+		}
+	})
+
+	t.Run("Test a directory named like a file is not served", func(t *testing.T) {
+		os.Mkdir("../files/dir_test.txt", 0755)
+		defer os.Remove("../files/dir_test.txt")
+		for _, method := range []string{"GET", "HEAD"} {
+			resp := doRequest(t, method, "/dir_test.txt", "", "")
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusNotFound || err != nil {
+				t.Errorf("Expected %s of a directory to get a whole 404, got %s with %d bytes, %v", method, resp.Status, len(body), err)
+			}
+		}
+	})
+
+	t.Run("Test uploads and DELETE of a directory conflict", func(t *testing.T) {
+		os.Mkdir("../files/dir_test.txt", 0755)
+		defer os.Remove("../files/dir_test.txt")
+		for _, request := range []string{"PUT /dir_test.txt", "POST /dir_test.txt", "DELETE /dir_test.txt", "POST /"} {
+			method, path, _ := strings.Cut(request, " ")
+			resp := doRequest(t, method, path, "text/plain", "data")
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusConflict {
+				t.Errorf("Expected %s of a directory to get 409, got %s", request, resp.Status)
+			}
+		}
+		// The temporary files of uploads are made next to the file, never outside the upload root
+		if temps, _ := filepath.Glob("../" + uploadTempPrefix + "*"); len(temps) != 0 {
+			t.Errorf("Expected no temporary file outside the upload root, found %v", temps)
+			for _, temp := range temps {
+				os.Remove(temp)
+			}
+		}
+		if info, err := os.Stat("../files/dir_test.txt"); err != nil || !info.IsDir() {
+			t.Errorf("Expected the directory to be left alone, got %v", err)
+		}
+	})
+
+	t.Run("Test a path through a file or a missing directory", func(t *testing.T) {
+		tests := []struct {
+			method   string
+			path     string
+			expected int
+		}{
+			{"GET", "/text.txt/x.txt", http.StatusNotFound},
+			{"DELETE", "/text.txt/x.txt", http.StatusNotFound},
+			{"PUT", "/text.txt/x.txt", http.StatusConflict},
+			{"POST", "/text.txt/x.txt", http.StatusConflict},
+			{"PUT", "/no_such_dir/x.txt", http.StatusConflict},
+		}
+		for _, test := range tests {
+			resp := doRequest(t, test.method, test.path, "text/plain", "data")
+			resp.Body.Close()
+			if resp.StatusCode != test.expected {
+				t.Errorf("Expected %s %s to get %d, got %s", test.method, test.path, test.expected, resp.Status)
+			}
+		}
+	})
+
+	t.Run("Test concurrent PUTs with If-None-Match: * create the file once", func(t *testing.T) {
+		defer os.Remove("../files/put_once_test.txt")
+
+		// The bodies are held back until every request had its headers checked, so all of them pass the first check
+		const uploads = 8
+		statuses := make(chan int, uploads)
+		writers := make([]*io.PipeWriter, uploads)
+		var wg sync.WaitGroup
+		for i := 0; i < uploads; i++ {
+			body, writer := io.Pipe()
+			writers[i] = writer
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				req, _ := http.NewRequest("PUT", "http://localhost:8080/put_once_test.txt", body)
+				req.ContentLength = 5
+				req.Header.Set("If-None-Match", "*")
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Errorf("Error sending PUT request: %v", err)
+					return
+				}
+				resp.Body.Close()
+				statuses <- resp.StatusCode
+			}()
+		}
+		time.Sleep(200 * time.Millisecond)
+		for i, writer := range writers {
+			writer.Write([]byte(strings.Repeat(string(rune('a'+i)), 5)))
+			writer.Close()
+		}
+		wg.Wait()
+		close(statuses)
+
+		created := 0
+		for status := range statuses {
+			switch status {
+			case http.StatusCreated:
+				created++
+			case http.StatusPreconditionFailed:
+			default:
+				t.Errorf("Expected Created or Precondition Failed, got %d", status)
+			}
+		}
+		if created != 1 {
+			t.Errorf("Expected exactly one PUT to create the file, %d did", created)
+		}
+	})
+}
+
+func Test_ResolvePath(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	os.Mkdir(filepath.Join(root, "images"), 0755)
+	os.WriteFile(filepath.Join(root, "file.txt"), nil, 0644)
+	os.Symlink(outside, filepath.Join(root, "escape"))
+	os.Symlink(filepath.Join(root, "images"), filepath.Join(root, "inside"))
+
+	tests := []struct {
+		uri      string
+		expected string
+		err      error
+	}{
+		{"/site.html", filepath.Join(root, "site.html"), nil},
+		{"/site.html?version=2", filepath.Join(root, "site.html"), nil},
+		{"/images/../site.html", filepath.Join(root, "site.html"), nil},
+		{"/my%20file.txt", filepath.Join(root, "my file.txt"), nil},
+		{"http://localhost:8080/site.html", filepath.Join(root, "site.html"), nil},
+		{"/inside/dog.jpeg", filepath.Join(root, "inside", "dog.jpeg"), nil},
+		{"/file.txt/x.txt", filepath.Join(root, "file.txt", "x.txt"), nil},
+		{"/file.txt/new/x.txt", filepath.Join(root, "file.txt", "new", "x.txt"), nil},
+		{"//site.html", filepath.Join(root, "site.html"), nil},
+		{"/../../etc/passwd.txt", "", errBadPath},
+		{"//../etc/passwd.txt", "", errBadPath},
+		{"/%2e%2e/src/http_server.go.txt", "", errBadPath},
+		{"/images/../../secret.txt", "", errBadPath},
+		{"/site.html%00.txt", "", errBadPath},
+		{"site.html", "", errBadPath},
+		{"/%zz.txt", "", errBadPath},
+		{"/escape/secret.txt", "", errForbiddenPath},
+		{"/escape/new/upload.txt", "", errForbiddenPath},
+	}
+	for _, test := range tests {
+		resolved, err := resolvePath(root, test.uri)
+		if err != test.err || resolved != test.expected {
+			t.Errorf("resolvePath(%q) = %q, %v; expected %q, %v", test.uri, resolved, err, test.expected, test.err)
+		}
+	}
+}
+
+func Test_DirectoryTraversal(t *testing.T) {
+	for _, uri := range []string{"/../../etc/passwd.txt", "/..%2f..%2fetc/passwd.txt", "/../src/http_server.go.txt"} {
+		for _, method := range []string{"GET", "POST"} {
+			conn, err := net.Dial("tcp", "localhost:8080")
+			if err != nil {
+				t.Fatalf("Error connecting: %v", err)
+			}
+			conn.Write([]byte(method + " " + uri + " HTTP/1.1\r\nHost: localhost\r\nContent-Type: text/plain\r\nContent-Length: 4\r\n\r\nevil"))
+			resp := readResponses(t, bufio.NewReader(conn), 1)[0]
+			conn.Close()
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("%s %s: expected status Bad Request, got %s", method, uri, resp.Status)
+			}
+		}
+	}
+	if _, err := os.Stat("http_server.go.txt"); err == nil {
+		os.Remove("http_server.go.txt")
+		t.Errorf("A POST outside the document root created a file")
+	}
+}
+
+func Test_Config(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "server.json")
+	os.WriteFile(configFile, []byte(`{"root": "../files", "port": 9000, "idle_timeout": "30s", "allowed_types": ["text/html"]}`), 0644)
+
+	environment := map[string]string{}
+	getenv := func(name string) string { return environment[name] }
+
+	t.Run("Test defaults", func(t *testing.T) {
+		loaded, printConfig, err := loadConfig([]string{"-root", "../files"}, getenv)
+		if err != nil || printConfig {
+			t.Fatalf("Unexpected result: %v, %v", err, printConfig)
+		}
+		if loaded.Port != 8080 || loaded.MaxConnections != 10 || loaded.UploadDir != "../files" {
+			t.Errorf("Unexpected defaults: %+v", loaded)
+		}
+	})
+
+	t.Run("Test config file, environment and flags override each other in order", func(t *testing.T) {
+		environment["SERVER_CONFIG"] = configFile
+		environment["SERVER_PORT"] = "9001"
+		environment["SERVER_IDLE_TIMEOUT"] = "1m"
+		defer delete(environment, "SERVER_CONFIG")
+		defer delete(environment, "SERVER_PORT")
+		defer delete(environment, "SERVER_IDLE_TIMEOUT")
+
+		loaded, _, err := loadConfig([]string{"-idle-timeout", "2m", "-allowed-types", "text/css, image/gif"}, getenv)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if loaded.Root != "../files" || loaded.Port != 9001 || loaded.IdleTimeout.Duration != 2*time.Minute {
+			t.Errorf("Unexpected configuration: %+v", loaded)
+		}
+		if len(loaded.AllowedTypes) != 2 || loaded.AllowedTypes[1] != "image/gif" {
+			t.Errorf("Unexpected allowed types: %v", loaded.AllowedTypes)
+		}
+	})
+
+	t.Run("Test the port can be given as argument", func(t *testing.T) {
+		loaded, printConfig, err := loadConfig([]string{"-root", "../files", "-print-config", "8081"}, getenv)
+		if err != nil || loaded.Port != 8081 || !printConfig {
+			t.Errorf("Expected port 8081 and print-config, got %d, %v, %v", loaded.Port, printConfig, err)
+		}
+	})
+
+	t.Run("Test invalid settings are reported together", func(t *testing.T) {
+		environment["SERVER_MAX_CONNECTIONS"] = "many"
+		defer delete(environment, "SERVER_MAX_CONNECTIONS")
+
+		_, _, err := loadConfig([]string{"-root", filepath.Join(dir, "missing"), "70000"}, getenv)
+		if err == nil {
+			t.Fatalf("Expected an error")
+		}
+		for _, expected := range []string{"SERVER_MAX_CONNECTIONS", "root", "port 70000"} {
+			if !strings.Contains(err.Error(), expected) {
+				t.Errorf("Expected the error to mention %q, got: %v", expected, err)
+			}
+		}
+	})
+
+	t.Run("Test allowed types must be known, also from a mime.types file", func(t *testing.T) {
+		_, _, err := loadConfig([]string{"-root", "../files", "-allowed-types", "text/html,application/x-lab"}, getenv)
+		if err == nil || !strings.Contains(err.Error(), "application/x-lab") {
+			t.Errorf("Expected an error about application/x-lab, got %v", err)
+		}
+
+		mimeFile := filepath.Join(dir, "mime.types")
+		os.WriteFile(mimeFile, []byte("# lab types\napplication/x-lab  lab labx\n"), 0644)
+		loaded, _, err := loadConfig([]string{"-root", "../files", "-mime-types", mimeFile, "-allowed-types", "text/html,application/x-lab"}, getenv)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		registry, _ := newMimeRegistry(loaded)
+		if contentType, _ := registry.TypeByPath("report.LABX"); contentType != "application/x-lab" {
+			t.Errorf("Expected application/x-lab for .LABX, got %q", contentType)
+		}
+	})
+
+	t.Run("Test TLS settings are checked", func(t *testing.T) {
+		loaded, _, err := loadConfig([]string{"-root", "../files", "-dev-tls", "-redirect-port", "8000", "-tls-min-version", "1.3"}, getenv)
+		if err != nil || !loaded.tlsEnabled() || loaded.RedirectPort != 8000 {
+			t.Errorf("Expected a valid TLS configuration, got %+v, %v", loaded, err)
+		}
+		_, _, err = loadConfig([]string{"-root", "../files", "-tls-cert", "cert.pem", "-redirect-port", "8080",
+			"-tls-min-version", "1.5", "-tls-cipher-suites", "TLS_RSA_WITH_RC4_128_SHA"}, getenv)
+		if err == nil {
+			t.Fatalf("Expected an error")
+		}
+		for _, expected := range []string{"tls-key", "1.5", "TLS_RSA_WITH_RC4_128_SHA", "redirect port"} {
+			if !strings.Contains(err.Error(), expected) {
+				t.Errorf("Expected the error to mention %q, got: %v", expected, err)
+			}
+		}
+		if _, _, err := loadConfig([]string{"-root", "../files", "-redirect-port", "8000"}, getenv); err == nil {
+			t.Errorf("Expected a redirect without TLS to be refused")
+		}
+	})
+
+	t.Run("Test authentication settings are checked", func(t *testing.T) {
+		loaded, _, err := loadConfig([]string{"-root", "../files", "-auth-rules", "/=put delete, /private=*"}, getenv)
+		if err != nil || len(loaded.AuthRules) != 2 || loaded.AuthRules["/"][0] != "PUT" || loaded.AuthRules["/private"][0] != "*" {
+			t.Fatalf("Unexpected rules %v, %v", loaded.AuthRules, err)
+		}
+		_, _, err = loadConfig([]string{"-root", "../files", "-htpasswd", filepath.Join(dir, "missing"), "-auth-rules", "/=FETCH,private=GET"}, getenv)
+		if err == nil {
+			t.Fatalf("Expected an error")
+		}
+		for _, expected := range []string{"htpasswd", "FETCH", `"private"`} {
+			if !strings.Contains(err.Error(), expected) {
+				t.Errorf("Expected the error to mention %q, got: %v", expected, err)
+			}
+		}
+	})
+
+	t.Run("Test rate limits are read from flags and checked", func(t *testing.T) {
+		loaded, _, err := loadConfig([]string{"-root", "../files", "-rate-limits", "/=10:20, /uploads=0.5:1:1MB:10MB"}, getenv)
+		if err != nil || loaded.RateLimits["/"].Burst != 20 || loaded.RateLimits["/uploads"].Requests != 0.5 ||
+			loaded.RateLimits["/uploads"].UploadBurst != 10<<20 {
+			t.Fatalf("Unexpected rate limits %v, %v", loaded.RateLimits, err)
+		}
+		_, _, err = loadConfig([]string{"-root", "../files", "-rate-limits", "uploads=1:1,/=5:0,/x=1:1:1MB:0"}, getenv)
+		if err == nil {
+			t.Fatalf("Expected an error")
+		}
+		for _, expected := range []string{`"uploads"`, "rate limit for /:", "rate limit for /x"} {
+			if !strings.Contains(err.Error(), expected) {
+				t.Errorf("Expected the error to mention %q, got: %v", expected, err)
+			}
+		}
+		if _, _, err := loadConfig([]string{"-root", "../files", "-rate-limits", "/=10"}, getenv); err == nil {
+			t.Errorf("Expected a limit without a burst to be refused")
+		}
+	})
+
+	t.Run("Test access rules are read from flags and checked", func(t *testing.T) {
+		loaded, _, err := loadConfig([]string{"-root", "../files", "-access-rules", "allow 10.0.0.0/8 POST /; deny all POST /",
+			"-trusted-proxies", "127.0.0.1, 10.0.0.0/8"}, getenv)
+		if err != nil || len(loaded.AccessRules) != 2 || loaded.AccessRules[1] != "deny all POST /" || len(loaded.TrustedProxies) != 2 {
+			t.Fatalf("Unexpected access rules %v %v, %v", loaded.AccessRules, loaded.TrustedProxies, err)
+		}
+		for _, args := range [][]string{{"-access-rules", "permit all"}, {"-access-rules", "deny 10.0.0.0/40"}, {"-trusted-proxies", "proxy"}} {
+			if _, _, err := loadConfig(append([]string{"-root", "../files"}, args...), getenv); err == nil || !strings.Contains(err.Error(), "access rules") {
+				t.Errorf("Expected %v to be refused, got %v", args, err)
+			}
+		}
+	})
+
+	t.Run("Test sites are read from flags and checked", func(t *testing.T) {
+		loaded, _, err := loadConfig([]string{"-root", "../files", "-sites", "Example.com=../files, *.example.org=..", "-unknown-host", "reject"}, getenv)
+		if err != nil || len(loaded.Sites) != 2 || loaded.Sites["example.com"].Root != "../files" || loaded.UnknownHost != "reject" {
+			t.Fatalf("Unexpected sites %v, %v", loaded.Sites, err)
+		}
+		if loaded.Sites["*.example.org"].apply(loaded).UploadDir != ".." {
+			t.Errorf("Expected the upload directory of a site to default to its root")
+		}
+		_, _, err = loadConfig([]string{"-root", "../files", "-sites", "a*b.com=../files,example.com=" + filepath.Join(dir, "missing"),
+			"-unknown-host", "ignore"}, getenv)
+		if err == nil {
+			t.Fatalf("Expected an error")
+		}
+		for _, expected := range []string{"a*b.com", "site example.com: root", "ignore"} {
+			if !strings.Contains(err.Error(), expected) {
+				t.Errorf("Expected the error to mention %q, got: %v", expected, err)
+			}
+		}
+	})
+}
+
+func Test_CommonWebTypes(t *testing.T) {
+
+	t.Run("Test GET favicon.ico", func(t *testing.T) {
+		resp := getWithHeaders(t, "/favicon.ico", nil)
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "image/x-icon" {
+			t.Errorf("Expected 200 with image/x-icon, got %s with %s", resp.Status, resp.Header.Get("Content-Type"))
+		}
+	})
+
+	tests := []struct {
+		file        string
+		contentType string
+		body        string
+	}{
+		{"type_test.png", "image/png", "\x89PNG\r\n\x1a\n"},
+		{"type_test.svg", "image/svg+xml", `<svg xmlns="http://www.w3.org/2000/svg"></svg>`},
+		{"type_test.js", "text/javascript; charset=utf-8", "console.log('hej');"},
+		{"type_test.json", "application/json", `{"lab": 1}`},
+		{"type_test.pdf", "application/pdf", "%PDF-1.4"},
+		{"type_test.woff2", "font/woff2", "wOF2"},
+		{"type_test.mp4", "video/mp4", "\x00\x00\x00\x18ftypmp42"},
+		{"type_test.webp", "image/webp", "RIFF\x00\x00\x00\x00WEBPVP8 "},
+		{"type_test.ico", "image/x-icon", "\x00\x00\x01\x00"},
+	}
+	for _, test := range tests {
+		t.Run("Test POST and GET "+test.file, func(t *testing.T) {
+			defer os.Remove("../files/" + test.file)
+
+			resp := doRequest(t, "POST", "/"+test.file, test.contentType, test.body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("Expected POST with %s to give status OK, got %s", test.contentType, resp.Status)
+			}
+
+			resp = getWithHeaders(t, "/"+test.file, nil)
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || string(body) != test.body {
+				t.Errorf("Expected GET to return the uploaded file, got %s with %q", resp.Status, body)
+			}
+			if resp.Header.Get("Content-Type") != test.contentType {
+				t.Errorf("Expected Content-Type %s, got %s", test.contentType, resp.Header.Get("Content-Type"))
+			}
+		})
+	}
+}
+
+// peakRSS returns the largest resident set size of the process in bytes, from /proc on Linux, or 0.
+func peakRSS() float64 {
+	status, err := os.ReadFile("/proc/self/status")
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		if strings.HasPrefix(line, "VmHWM:") {
+			fields := strings.Fields(line)
+			kilobytes, _ := strconv.ParseFloat(fields[1], 64)
+			return kilobytes * 1024
+		}
+	}
+	return 0
+}
+
+/*
+BenchmarkConcurrentLargeDownloads downloads a 64 MB file over 8 connections at the same time.
+It reports the throughput and the peak memory of the process, which holds both the server and the clients.
+Since the file is streamed, the memory does not grow with the file size or the number of downloads.
+*/
+func BenchmarkConcurrentLargeDownloads(b *testing.B) {
+	const size = 64 << 20
+	const downloads = 8
+	large := "../files/benchmark_large.mp4"
+	file, err := os.Create(large)
+	if err != nil {
+		b.Fatalf("Error creating the large file: %v", err)
+	}
+	chunk := bytes.Repeat([]byte("0123456789abcdef"), 1<<16)
+	for written := 0; written < size; written += len(chunk) {
+		file.Write(chunk)
+	}
+	file.Close()
+	defer os.Remove(large)
+
+	client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: downloads}}
+	b.SetBytes(size)
+	b.ResetTimer()
+
+	var next int64 = -1
+	var wg sync.WaitGroup
+	for worker := 0; worker < downloads; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atomic.AddInt64(&next, 1) < int64(b.N) {
+				resp, err := client.Get("http://localhost:8080/benchmark_large.mp4")
+				if err != nil {
+					b.Errorf("Error sending GET request: %v", err)
+					return
+				}
+				n, _ := io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				if n != size {
+					b.Errorf("Expected %d bytes, got %d", size, n)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	b.StopTimer()
+	b.ReportMetric(peakRSS()/(1<<20), "peak-RSS-MB")
+}
+
+func Test_FileLocks(t *testing.T) {
+
+	t.Run("Test readers of the same file do not wait for each other", func(t *testing.T) {
+		fileLocks := newFileLocks()
+		unlock := fileLocks.readLock("files/dog.jpeg")
+		done := make(chan bool)
+		go func() {
+			fileLocks.readLock("files/./dog.jpeg")()
+			done <- true
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Errorf("A second reader had to wait for the first")
+		}
+		unlock()
+	})
+
+	t.Run("Test a writer does not block other files", func(t *testing.T) {
+		fileLocks := newFileLocks()
+		unlock := fileLocks.writeLock("files/styles.css")
+		done := make(chan bool)
+		go func() {
+			fileLocks.readLock("files/site.html")()
+			fileLocks.writeLock("files/text.txt")()
+			done <- true
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Errorf("Locking other files had to wait for the writer")
+		}
+		unlock()
+	})
+
+	t.Run("Test writers are exclusive and entries are reclaimed", func(t *testing.T) {
+		fileLocks := newFileLocks()
+		const paths = 16
+		var readers, writers [paths]int32
+
+		var wg sync.WaitGroup
+		for worker := 0; worker < 64; worker++ {
+			wg.Add(1)
+			go func(worker int) {
+				defer wg.Done()
+				for i := 0; i < 200; i++ {
+					index := (worker*7 + i) % paths
+					path := "files/file" + strconv.Itoa(index) + ".txt"
+					if (worker+i)%4 == 0 {
+						unlock := fileLocks.writeLock(path)
+						if atomic.AddInt32(&writers[index], 1) != 1 || atomic.LoadInt32(&readers[index]) != 0 {
+							t.Errorf("Writer of %s did not have the file to itself", path)
+						}
+						atomic.AddInt32(&writers[index], -1)
+						unlock()
+					} else {
+						unlock := fileLocks.readLock(path)
+						atomic.AddInt32(&readers[index], 1)
+						if atomic.LoadInt32(&writers[index]) != 0 {
+							t.Errorf("Reader of %s ran at the same time as a writer", path)
+						}
+						atomic.AddInt32(&readers[index], -1)
+						unlock()
+					}
+				}
+			}(worker)
+		}
+		wg.Wait()
+
+		if size := fileLocks.size(); size != 0 {
+			t.Errorf("Expected all lock entries to be reclaimed, %d are left", size)
+		}
+	})
+
+	t.Run("Test concurrent GET and PUT requests on many files", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for worker := 0; worker < 8; worker++ {
+			wg.Add(1)
+			go func(worker int) {
+				defer wg.Done()
+				path := "/lock_test" + strconv.Itoa(worker%4) + ".txt"
+				for i := 0; i < 10; i++ {
+					body := strings.Repeat(strconv.Itoa(worker), 100)
+					resp := doRequest(t, "PUT", path, "text/plain", body)
+					resp.Body.Close()
+
+					resp = getWithHeaders(t, path, nil)
+					data, _ := io.ReadAll(resp.Body)
+					resp.Body.Close()
+					if resp.StatusCode == http.StatusOK && (len(data) != 100 || strings.Count(string(data), string(data[0])) != 100) {
+						t.Errorf("GET %s returned a mixed or partial file: %q", path, data)
+					}
+				}
+			}(worker)
+		}
+		wg.Wait()
+		for i := 0; i < 4; i++ {
+			os.Remove("../files/lock_test" + strconv.Itoa(i) + ".txt")
+		}
+		if size := locks.size(); size != 0 {
+			t.Errorf("Expected all lock entries of the server to be reclaimed, %d are left", size)
+		}
+	})
+}
+
+func Test_AtomicUploads(t *testing.T) {
+
+	t.Run("Test GETs during large POSTs see a whole file", func(t *testing.T) {
+		const size = 4 << 20
+		defer os.Remove("../files/atomic_test.txt")
+		resp := doRequest(t, "POST", "/atomic_test.txt", "text/plain", strings.Repeat("a", size))
+		resp.Body.Close()
+
+		stop := make(chan bool)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				letter := string(rune('a' + i%2))
+				resp := doRequest(t, "POST", "/atomic_test.txt", "text/plain", strings.Repeat(letter, size))
+				resp.Body.Close()
+			}
+		}()
+
+		for i := 0; i < 20; i++ {
+			resp := getWithHeaders(t, "/atomic_test.txt", nil)
+			data, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil || len(data) != size || strings.Count(string(data), string(data[0])) != size {
+				t.Errorf("GET %d returned a partial or mixed file of %d bytes: %v", i, len(data), err)
+			}
+		}
+		close(stop)
+		wg.Wait()
+
+		info, err := os.Stat("../files/atomic_test.txt")
+		if err != nil || info.Mode().Perm() != uploadFileMode {
+			t.Errorf("Expected the uploaded file to have mode %o, got %v, %v", uploadFileMode, info.Mode().Perm(), err)
+		}
+		temps, _ := filepath.Glob("../files/" + uploadTempPrefix + "*")
+		if len(temps) != 0 {
+			t.Errorf("Expected no temporary files to be left, found %v", temps)
+		}
+	})
+
+	t.Run("Test temporary upload files are not served", func(t *testing.T) {
+		temp := "../files/" + uploadTempPrefix + "123.tmp"
+		os.WriteFile(temp, []byte("half an upload"), 0644)
+		defer os.Remove(temp)
+
+		resp := getWithHeaders(t, "/"+uploadTempPrefix+"123.tmp", nil)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("Expected status Not Found, got %s", resp.Status)
+		}
+	})
+
+	t.Run("Test orphaned temporary files are removed at startup", func(t *testing.T) {
+		dir := t.TempDir()
+		os.Mkdir(filepath.Join(dir, "images"), 0755)
+		orphans := []string{filepath.Join(dir, uploadTempPrefix+"1.tmp"), filepath.Join(dir, "images", uploadTempPrefix+"2.tmp")}
+		kept := filepath.Join(dir, "notes.tmp")
+		for _, path := range append(orphans, kept) {
+			os.WriteFile(path, []byte("data"), 0644)
+		}
+
+		if err := removeOrphanedUploads(dir); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		for _, path := range orphans {
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("Expected %s to be removed", path)
+			}
+		}
+		if _, err := os.Stat(kept); err != nil {
+			t.Errorf("Expected %s to be kept", kept)
+		}
+	})
+}
+
+func Test_UploadLimits(t *testing.T) {
+
+	t.Run("Test too large Content-Length is refused before the body is sent", func(t *testing.T) {
+		conn, err := net.Dial("tcp", "localhost:8080")
+		if err != nil {
+			t.Fatalf("Error connecting: %v", err)
+		}
+		defer conn.Close()
+		conn.Write([]byte("POST /limit_test.txt HTTP/1.1\r\nHost: localhost\r\nContent-Type: text/plain\r\nContent-Length: 20971520\r\n\r\n"))
+
+		resp := readResponses(t, bufio.NewReader(conn), 1)[0]
+		if resp.StatusCode != http.StatusRequestEntityTooLarge || !resp.Close {
+			t.Errorf("Expected 413 and a closed connection, got %s, close %v", resp.Status, resp.Close)
+		}
+	})
+
+	t.Run("Test the limit of a type is enforced while streaming", func(t *testing.T) {
+		defer os.Remove("../files/limit_test.pdf")
+		req, _ := http.NewRequest("PUT", "http://localhost:8080/limit_test.pdf", strings.NewReader(strings.Repeat("x", 1000)))
+		req.Header.Set("Content-Type", "application/pdf")
+		req.ContentLength = -1 // Sent chunked, without a Content-Length
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error sending PUT request: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected status Payload Too Large, got %s", resp.Status)
+		}
+		if _, err := os.Stat("../files/limit_test.pdf"); !os.IsNotExist(err) {
+			t.Errorf("Expected no file to be saved")
+		}
+		temps, _ := filepath.Glob("../files/" + uploadTempPrefix + "*")
+		if len(temps) != 0 {
+			t.Errorf("Expected the temporary file to be removed, found %v", temps)
+		}
+	})
+
+	t.Run("Test Expect 100-continue", func(t *testing.T) {
+		defer os.Remove("../files/continue_test.txt")
+		conn, err := net.Dial("tcp", "localhost:8080")
+		if err != nil {
+			t.Fatalf("Error connecting: %v", err)
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+
+		conn.Write([]byte("PUT /continue_test.txt HTTP/1.1\r\nHost: localhost\r\nContent-Type: text/plain\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n"))
+		interim := readResponses(t, reader, 1)[0]
+		if interim.StatusCode != http.StatusContinue {
+			t.Fatalf("Expected 100 Continue, got %s", interim.Status)
+		}
+		conn.Write([]byte("hello"))
+		resp := readResponses(t, reader, 1)[0]
+		if resp.StatusCode != http.StatusCreated || resp.Close {
+			t.Errorf("Expected 201 on an open connection, got %s, close %v", resp.Status, resp.Close)
+		}
+
+		conn.Write([]byte("PUT /continue_test.pdf HTTP/1.1\r\nHost: localhost\r\nContent-Length: 1000\r\nExpect: 100-continue\r\n\r\n"))
+		resp = readResponses(t, reader, 1)[0]
+		if resp.StatusCode != http.StatusRequestEntityTooLarge || !resp.Close {
+			t.Errorf("Expected 413 without 100 Continue and a closed connection, got %s, close %v", resp.Status, resp.Close)
+		}
+	})
+
+	t.Run("Test unknown expectation gives 417", func(t *testing.T) {
+		resp := doRequestWithHeader(t, "PUT", "/expect_test.txt", "Expect", "something-else")
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusExpectationFailed {
+			t.Errorf("Expected status Expectation Failed, got %s", resp.Status)
+		}
+	})
+
+	t.Run("Test OPTIONS shows the limits", func(t *testing.T) {
+		resp := doRequest(t, "OPTIONS", "/", "", "")
+		defer resp.Body.Close()
+		var limits struct {
+			MaxUploadSize int64             `json:"max_upload_size"`
+			UploadLimits  map[string]string `json:"upload_limits"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&limits); err != nil {
+			t.Fatalf("Error decoding the OPTIONS body: %v", err)
+		}
+		if limits.MaxUploadSize != int64(config.MaxUploadSize) || limits.UploadLimits["application/pdf"] != "64B" {
+			t.Errorf("Unexpected limits: %+v", limits)
+		}
+	})
+
+	t.Run("Test sizes in the configuration", func(t *testing.T) {
+		loaded, _, err := loadConfig([]string{"-root", "../files", "-max-upload-size", "2MiB", "-upload-limits", "video/mp4=1GB, image/png=512KB"}, func(string) string { return "" })
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if loaded.MaxUploadSize != 2<<20 || loaded.uploadLimit("video/mp4") != 1<<30 || loaded.uploadLimit("image/png") != 512<<10 || loaded.uploadLimit("text/plain") != 2<<20 {
+			t.Errorf("Unexpected limits: %v, %v", loaded.MaxUploadSize, loaded.UploadLimits)
+		}
+		for _, size := range []string{"-5MB", "-1", "8589934592GB", "9999999999999999999"} {
+			var b byteSize
+			if err := b.Set(size); err == nil {
+				t.Errorf("Expected size %s to be refused, got %d", size, b)
+			}
+		}
+
+		configFile := filepath.Join(t.TempDir(), "server.json")
+		os.WriteFile(configFile, []byte(`{"root": "../files", "upload_limits": {"Text/Plain; charset=utf-8": "1KB", "IMAGE/PNG": 2048}}`), 0644)
+		loaded, _, err = loadConfig([]string{"-config", configFile}, func(string) string { return "" })
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if loaded.uploadLimit("text/plain") != 1<<10 || loaded.uploadLimit("image/png") != 2048 {
+			t.Errorf("Expected the types of the config file to be normalized, got %v", loaded.UploadLimits)
+		}
+
+		var b byteSize
+		if err := json.Unmarshal([]byte("-5"), &b); err == nil {
+			t.Errorf("Expected a negative size in JSON to be refused, got %d", b)
+		}
+		if err := b.Set("8589934591GB"); err != nil || int64(b) != 8589934591<<30 {
+			t.Errorf("Expected the largest size in GB to be accepted, got %d, %v", b, err)
+		}
+	})
+}
+
+// doRequestWithHeader sends a request without body but with one extra header.
+func doRequestWithHeader(t *testing.T, method string, path string, name string, value string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, "http://localhost:8080"+path, nil)
+	if err != nil {
+		t.Fatalf("Error creating %s request: %v", method, err)
+	}
+	req.Header.Set(name, value)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error sending %s request: %v", method, err)
+	}
+	return resp
+}
+
+func Test_AdmissionControl(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer listener.Close()
+	// One connection at a time, one waiting, for at most 300ms
+	controller := admission.New(1, 1, 300*time.Millisecond)
+	go newServer(controller).serve(listener)
+
+	request := "GET /site.html HTTP/1.1\r\nHost: localhost\r\n\r\n"
+	dial := func() (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Error connecting: %v", err)
+		}
+		conn.Write([]byte(request))
+		return conn, bufio.NewReader(conn)
+	}
+	waitFor := func(condition func(admission.Stats) bool) {
+		deadline := time.Now().Add(2 * time.Second)
+		for !condition(controller.Stats()) {
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for the admission controller, stats %+v", controller.Stats())
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	// The first connection is served and kept open, so it holds the only slot
+	first, firstReader := dial()
+	defer first.Close()
+	if resp := readResponses(t, firstReader, 1)[0]; resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the first connection to be served, got %s", resp.Status)
+	}
+
+	// The second connection waits in the queue
+	queued, queuedReader := dial()
+	defer queued.Close()
+	waitFor(func(stats admission.Stats) bool { return stats.Waiting == 1 })
+
+	// The queue is full, the third connection is refused at once
+	start := time.Now()
+	refused, refusedReader := dial()
+	defer refused.Close()
+	resp := readResponses(t, refusedReader, 1)[0]
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "1" || !resp.Close {
+		t.Errorf("Expected 503 with Retry-After 1 and a closed connection, got %s, Retry-After %q, close %v",
+			resp.Status, resp.Header.Get("Retry-After"), resp.Close)
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("Expected a full queue to refuse at once, took %v", elapsed)
+	}
+
+	// A liveness probe is still answered 200 OK, the server is busy but alive
+	probe, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer probe.Close()
+	probe.Write([]byte("GET /healthz HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	if resp := readResponses(t, bufio.NewReader(probe), 1)[0]; resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the liveness probe of a saturated server to get 200, got %s", resp.Status)
+	}
+
+	// The queued connection gives up after the queue timeout
+	resp = readResponses(t, queuedReader, 1)[0]
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected the queued connection to time out with 503, got %s", resp.Status)
+	}
+	// The liveness probe was refused a slot too, though it got an answer
+	if stats := controller.Stats(); stats.Rejected != 3 || stats.Waiting != 0 {
+		t.Errorf("Expected 3 rejected and none waiting, got %+v", stats)
+	}
+
+	// A waiting connection gets the slot as soon as it is free
+	waiting, waitingReader := dial()
+	defer waiting.Close()
+	waitFor(func(stats admission.Stats) bool { return stats.Waiting == 1 })
+	first.Close()
+	if resp := readResponses(t, waitingReader, 1)[0]; resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the waiting connection to be served, got %s", resp.Status)
+	}
+}
+
+// startServerProcess runs the server as a separate process with the arguments, and returns it with its address.
+func startServerProcess(t *testing.T, args ...string) (*exec.Cmd, string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error finding a free port: %v", err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+	_, port, _ := net.SplitHostPort(address)
+
+	cmd := exec.Command(os.Args[0], append(args, "-host", "localhost", "-port", port)...)
+	cmd.Env = append(os.Environ(), "HTTP_SERVER_TEST_MAIN=1")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Error starting the server: %v", err)
+	}
+	t.Cleanup(func() { cmd.Process.Kill() })
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		if conn, err := net.Dial("tcp", address); err == nil {
+			conn.Close()
+			return cmd, address
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("The server did not start listening on %s", address)
+		}
+	}
+}
+
+// startTransfer requests a file on a new connection and reads the headers and the first bytes of the body.
+func startTransfer(t *testing.T, address string, path string) (net.Conn, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	conn.Write([]byte("GET " + path + " HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 OK, got %v, %v", resp, err)
+	}
+	if _, err := io.CopyN(io.Discard, resp.Body, 1<<20); err != nil {
+		t.Fatalf("Error reading the start of the body: %v", err)
+	}
+	return conn, resp
+}
+
+func Test_GracefulShutdown(t *testing.T) {
+	root := t.TempDir()
+	const largeSize = 64 << 20
+	file, err := os.Create(filepath.Join(root, "large.txt"))
+	if err != nil {
+		t.Fatalf("Error creating file: %v", err)
+	}
+	chunk := bytes.Repeat([]byte("0123456789abcdef"), 64<<10)
+	for written := 0; written < largeSize; written += len(chunk) {
+		file.Write(chunk)
+	}
+	file.Close()
+	os.WriteFile(filepath.Join(root, "small.txt"), []byte("small"), 0644)
+
+	t.Run("Test SIGTERM lets a transfer finish and closes idle connections", func(t *testing.T) {
+		cmd, address := startServerProcess(t, "-root", root, "-shutdown-timeout", "10s", "-idle-timeout", "30s")
+
+		// An idle keep-alive connection
+		idle, err := net.Dial("tcp", address)
+		if err != nil {
+			t.Fatalf("Error connecting: %v", err)
+		}
+		defer idle.Close()
+		idle.Write([]byte("GET /small.txt HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		idleReader := bufio.NewReader(idle)
+		readResponses(t, idleReader, 1)
+
+		conn, resp := startTransfer(t, address, "/large.txt")
+		defer conn.Close()
+
+		if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+			t.Fatalf("Error sending SIGTERM: %v", err)
+		}
+
+		// The idle connection is closed long before its idle timeout
+		idle.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := idleReader.ReadByte(); err != io.EOF {
+			t.Errorf("Expected the idle connection to be closed, got %v", err)
+		}
+		// No new connections are accepted
+		for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+			newConn, err := net.Dial("tcp", address)
+			if err != nil {
+				break
+			}
+			newConn.Close()
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected the server to stop accepting connections")
+			}
+		}
+
+		// The transfer in progress is completed
+		rest, err := io.Copy(io.Discard, resp.Body)
+		if err != nil || rest+(1<<20) != largeSize {
+			t.Errorf("Expected the whole file, got %d more bytes after the first MB, error %v", rest, err)
+		}
+
+		if err := cmd.Wait(); err != nil {
+			t.Errorf("Expected the server to exit with status 0, got %v", err)
+		}
+	})
+
+	t.Run("Test SIGTERM closes busy connections after the shutdown timeout", func(t *testing.T) {
+		cmd, address := startServerProcess(t, "-root", root, "-shutdown-timeout", "200ms")
+
+		// The client stops reading, so the transfer can not finish
+		conn, resp := startTransfer(t, address, "/large.txt")
+		defer conn.Close()
+
+		start := time.Now()
+		cmd.Process.Signal(syscall.SIGTERM)
+		err := cmd.Wait()
+		if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 1 {
+			t.Errorf("Expected the server to exit with status 1, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("Expected the server to stop after the shutdown timeout, took %v", elapsed)
+		}
+		if _, err := io.Copy(io.Discard, resp.Body); err == nil {
+			t.Errorf("Expected the transfer to be cut off")
+		}
+	})
+}
+
+func Test_Timeouts(t *testing.T) {
+	// A server of its own with one connection slot and no queue, to see who holds the slot
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer listener.Close()
+	controller := admission.New(1, 0, time.Second)
+	go newServer(controller).serve(listener)
+	address := listener.Addr().String()
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			t.Fatalf("Error connecting: %v", err)
+		}
+		return conn
+	}
+	waitForFreeSlot := func(within time.Duration) time.Duration {
+		start := time.Now()
+		for controller.Stats().Active != 0 {
+			if time.Since(start) > within {
+				t.Fatalf("The connection slot was not freed within %v", within)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return time.Since(start)
+	}
+	expectTimeout := func(conn net.Conn, start time.Time, within time.Duration) {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		resp := readResponses(t, bufio.NewReader(conn), 1)[0]
+		if resp.StatusCode != http.StatusRequestTimeout || !resp.Close {
+			t.Errorf("Expected 408 and a closed connection, got %s, close %v", resp.Status, resp.Close)
+		}
+		if elapsed := time.Since(start); elapsed > within {
+			t.Errorf("Expected 408 within %v, took %v", within, elapsed)
+		}
+	}
+
+	t.Run("Test a client that sends nothing loses its slot after the idle timeout", func(t *testing.T) {
+		stalled := dial()
+		defer stalled.Close()
+		for controller.Stats().Active != 1 {
+			time.Sleep(time.Millisecond)
+		}
+
+		// The slot is taken, another client is refused
+		refused := dial()
+		refused.Write([]byte("GET /site.html HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		if resp := readResponses(t, bufio.NewReader(refused), 1)[0]; resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("Expected 503 while the slot is held, got %s", resp.Status)
+		}
+		refused.Close()
+
+		// The stalled connection is closed without a response
+		stalled.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := stalled.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("Expected the stalled connection to be closed, got %v", err)
+		}
+		waitForFreeSlot(time.Second)
+	})
+
+	t.Run("Test headers sent slowly get 408", func(t *testing.T) {
+		conn := dial()
+		defer conn.Close()
+		start := time.Now()
+		conn.Write([]byte("GET /site.html HTTP/1.1\r\n"))
+		// Send a header line every 100ms, which would go on forever
+		go func() {
+			for i := 0; i < 50; i++ {
+				time.Sleep(100 * time.Millisecond)
+				if _, err := conn.Write([]byte("X-Slow: " + strconv.Itoa(i) + "\r\n")); err != nil {
+					return
+				}
+			}
+		}()
+		expectTimeout(conn, start, 2*time.Second)
+		waitForFreeSlot(time.Second)
+	})
+
+	t.Run("Test a stalled body gets 408", func(t *testing.T) {
+		defer os.Remove("../files/timeout_test.txt")
+		conn := dial()
+		defer conn.Close()
+		start := time.Now()
+		conn.Write([]byte("PUT /timeout_test.txt HTTP/1.1\r\nHost: localhost\r\nContent-Type: text/plain\r\nContent-Length: 100\r\n\r\nonly ten b"))
+		expectTimeout(conn, start, 2*time.Second)
+		if _, err := os.Stat("../files/timeout_test.txt"); !os.IsNotExist(err) {
+			t.Errorf("Expected no file to be saved")
+		}
+		waitForFreeSlot(time.Second)
+	})
+
+	t.Run("Test a body below the minimum rate gets 408", func(t *testing.T) {
+		defer os.Remove("../files/timeout_test.txt")
+		conn := dial()
+		defer conn.Close()
+		start := time.Now()
+		conn.Write([]byte("PUT /timeout_test.txt HTTP/1.1\r\nHost: localhost\r\nContent-Type: text/plain\r\nContent-Length: 10000\r\n\r\n"))
+		// 20 bytes every 100ms is 200 bytes per second, slower than the minimum of 1KB, but never stalls
+		go func() {
+			for i := 0; i < 50; i++ {
+				if _, err := conn.Write(bytes.Repeat([]byte("x"), 20)); err != nil {
+					return
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+		}()
+		expectTimeout(conn, start, 2*time.Second)
+		waitForFreeSlot(time.Second)
+	})
+
+	t.Run("Test a client that stops reading loses its slot after the write timeout", func(t *testing.T) {
+		file, err := os.Create("../files/write_timeout_test.txt")
+		if err != nil {
+			t.Fatalf("Error creating file: %v", err)
+		}
+		defer os.Remove("../files/write_timeout_test.txt")
+		chunk := bytes.Repeat([]byte("0123456789abcdef"), 64<<10)
+		for i := 0; i < 32; i++ {
+			file.Write(chunk)
+		}
+		file.Close()
+
+		conn := dial()
+		defer conn.Close()
+		conn.Write([]byte("GET /write_timeout_test.txt HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		// Nothing is read, the server can only send what fits in the socket buffers
+		for controller.Stats().Active == 0 {
+			time.Sleep(time.Millisecond) // Wait for the connection to be let in
+		}
+		if elapsed := waitForFreeSlot(5 * time.Second); elapsed < config.WriteTimeout.Duration-100*time.Millisecond {
+			t.Errorf("Expected the slot to be held until the write timeout, freed after %v", elapsed)
+		}
+	})
+
+	t.Run("Test timeouts in the configuration", func(t *testing.T) {
+		loaded, _, err := loadConfig([]string{"-root", "../files", "-header-timeout", "2s", "-body-timeout", "1m", "-min-body-rate", "0"},
+			func(name string) string {
+				if name == "SERVER_WRITE_TIMEOUT" {
+					return "45s"
+				}
+				return ""
+			})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if loaded.HeaderTimeout.Duration != 2*time.Second || loaded.BodyTimeout.Duration != time.Minute ||
+			loaded.MinBodyRate != 0 || loaded.WriteTimeout.Duration != 45*time.Second {
+			t.Errorf("Unexpected timeouts: %+v", loaded)
+		}
+		if _, _, err := loadConfig([]string{"-root", "../files", "-header-timeout", "0s"}, func(string) string { return "" }); err == nil {
+			t.Errorf("Expected an error for a header timeout of 0")
+		}
+	})
+}
+
+func Test_AccessLog(t *testing.T) {
+	userAgent := "access-log-test/" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	send := func(method string, path string) {
+		req, _ := http.NewRequest(method, "http://localhost:8080"+path, nil)
+		req.Header.Set("User-Agent", userAgent)
+		req.Header.Set("Referer", "http://localhost:8080/site.html")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error sending %s request: %v", method, err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	send("GET", "/site.html?from=test")
+	send("HEAD", "/site.html")
+	send("GET", "/no_such_file.html")
+
+	type entry struct {
+		Time       string  `json:"time"`
+		RemoteIP   string  `json:"remote_ip"`
+		Method     string  `json:"method"`
+		URI        string  `json:"uri"`
+		Proto      string  `json:"proto"`
+		Status     int     `json:"status"`
+		Bytes      int64   `json:"bytes"`
+		DurationMS float64 `json:"duration_ms"`
+		Referer    string  `json:"referer"`
+		UserAgent  string  `json:"user_agent"`
+	}
+	var entries []entry
+	for _, line := range strings.Split(accessLogBuffer.String(), "\n") {
+		var e entry
+		if json.Unmarshal([]byte(line), &e) == nil && e.UserAgent == userAgent {
+			entries = append(entries, e)
+		}
+	}
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 lines in the access log, got %d:\n%s", len(entries), accessLogBuffer.String())
+	}
+
+	info, _ := os.Stat("../files/site.html")
+	get, head, notFound := entries[0], entries[1], entries[2]
+	if get.Method != "GET" || get.URI != "/site.html?from=test" || get.Proto != "HTTP/1.1" || get.Status != 200 ||
+		get.Bytes != info.Size() || get.RemoteIP != "127.0.0.1" || get.Referer != "http://localhost:8080/site.html" {
+		t.Errorf("Unexpected line for GET: %+v", get)
+	}
+	if _, err := time.Parse(time.RFC3339Nano, get.Time); err != nil || get.DurationMS < 0 {
+		t.Errorf("Unexpected time or duration: %+v", get)
+	}
+	if head.Method != "HEAD" || head.Status != 200 || head.Bytes != 0 {
+		t.Errorf("Expected a HEAD line with no bytes sent, got %+v", head)
+	}
+	if notFound.Status != 404 || notFound.URI != "/no_such_file.html" {
+		t.Errorf("Unexpected line for the missing file: %+v", notFound)
+	}
+
+	t.Run("Test access log settings", func(t *testing.T) {
+		loaded, _, err := loadConfig([]string{"-root", "../files", "-access-log", "access.log", "-access-log-format", "json", "-access-log-max-size", "10MB"},
+			func(string) string { return "" })
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if loaded.AccessLog != "access.log" || loaded.AccessLogFormat != "json" || loaded.AccessLogMaxSize != 10<<20 || loaded.AccessLogBackups != 5 {
+			t.Errorf("Unexpected access log settings: %+v", loaded)
+		}
+		if _, _, err := loadConfig([]string{"-root", "../files", "-access-log-format", "xml"}, func(string) string { return "" }); err == nil {
+			t.Errorf("Expected an error for an unknown access log format")
+		}
+	})
+}
+
+func Test_Logging(t *testing.T) {
+	var logBuffer syncBuffer
+	defaultLogger := slog.Default()
+	slog.SetDefault(logging.New(&logBuffer, slog.LevelDebug, "json"))
+	defer slog.SetDefault(defaultLogger)
+
+	// Every line of a request carries its ID and the address of the client
+	for _, path := range []string{"/site.html", "/..%2fsecret.txt"} {
+		response, err := http.Get("http://localhost:8080" + path)
+		if err != nil {
+			t.Fatalf("Error sending request: %v", err)
+		}
+		io.Copy(io.Discard, response.Body)
+		response.Body.Close()
+	}
+
+	requests := map[string]string{} // request ID by URI
+	var resolveLine map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(logBuffer.String()), "\n") {
+		var decoded map[string]any
+		if err := json.Unmarshal([]byte(line), &decoded); err != nil {
+			t.Fatalf("Error decoding the log line %q: %v", line, err)
+		}
+		switch decoded["msg"] {
+		case "Request":
+			id, _ := decoded["request_id"].(string)
+			remote, _ := decoded["remote_addr"].(string)
+			if len(id) != 16 || !strings.HasPrefix(remote, "127.0.0.1:") {
+				t.Errorf("Request line without request ID or remote address: %s", line)
+			}
+			requests[decoded["uri"].(string)] = id
+		case "Resolving the path":
+			resolveLine = decoded
+		}
+	}
+	if len(requests) != 2 || requests["/site.html"] == requests["/..%2fsecret.txt"] {
+		t.Fatalf("Expected two requests with their own IDs, got %v", requests)
+	}
+	if resolveLine == nil || resolveLine["level"] != "INFO" || resolveLine["request_id"] != requests["/..%2fsecret.txt"] {
+		t.Errorf("Expected the rejected path to be logged with the ID of its request, got %v", resolveLine)
+	}
+
+	t.Run("Test log settings", func(t *testing.T) {
+		loaded, _, err := loadConfig([]string{"-root", "../files"}, func(name string) string {
+			return map[string]string{"SERVER_LOG_LEVEL": "debug", "SERVER_LOG_FORMAT": "json"}[name]
+		})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if loaded.LogLevel != "debug" || loaded.LogFormat != "json" {
+			t.Errorf("Unexpected log settings: %+v", loaded)
+		}
+		if _, _, err := loadConfig([]string{"-root", "../files", "-log-level", "loud"}, func(string) string { return "" }); err == nil {
+			t.Errorf("Expected an error for an unknown log level")
+		}
+	})
+}
+
+func Test_Metrics(t *testing.T) {
+	getMetrics := func() string {
+		t.Helper()
+		resp, err := http.Get("http://localhost:8080/metrics")
+		if err != nil {
+			t.Fatalf("Error getting the metrics: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != 200 || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain; version=0.0.4") {
+			t.Fatalf("Expected 200 with the text exposition format, got %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		return string(body)
+	}
+
+	requests := requestsTotal.Value("GET", "200")
+	hits := conditionalRequests.Value("hit")
+	misses := conditionalRequests.Value("miss")
+	uploads := uploadSizes.Count()
+	sent := responseBodyBytes.Value()
+	received := requestBodyBytes.Value()
+
+	resp := doRequestWithHeader(t, "GET", "/site.html", "If-None-Match", `"no-such-tag"`)
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	etag := resp.Header.Get("ETag")
+	resp = doRequestWithHeader(t, "GET", "/site.html", "If-None-Match", etag)
+	resp.Body.Close()
+	if resp.StatusCode != 304 {
+		t.Fatalf("Expected 304 for a current ETag, got %d", resp.StatusCode)
+	}
+	defer os.Remove("../files/metrics_test.txt")
+	resp = doRequest(t, "PUT", "/metrics_test.txt", "text/plain", "twelve bytes")
+	resp.Body.Close()
+
+	if got := requestsTotal.Value("GET", "200"); got != requests+1 {
+		t.Errorf("Expected one more GET answered 200, counted %v then %v", requests, got)
+	}
+	if conditionalRequests.Value("hit") != hits+1 || conditionalRequests.Value("miss") != misses+1 {
+		t.Errorf("Expected one hit and one miss, got hits %v -> %v and misses %v -> %v",
+			hits, conditionalRequests.Value("hit"), misses, conditionalRequests.Value("miss"))
+	}
+	if uploadSizes.Count() != uploads+1 || requestBodyBytes.Value() != received+12 {
+		t.Errorf("Expected an upload of 12 bytes to be counted, got %d uploads and %v bytes", uploadSizes.Count()-uploads, requestBodyBytes.Value()-received)
+	}
+	if responseBodyBytes.Value() <= sent {
+		t.Errorf("Expected the bytes of site.html to be counted as sent")
+	}
+
+	body := getMetrics()
+	for _, expected := range []string{
+		"# TYPE http_requests_total counter\n",
+		`http_requests_total{method="PUT",status="201"} `,
+		`http_request_duration_seconds_bucket{method="GET",le="+Inf"} `,
+		"http_connections_active ",
+		"http_connections_limit ",
+		"http_admission_queue_length 0\n",
+		"http_admission_rejected_total ",
+		`http_conditional_requests_total{result="hit"} `,
+		"http_upload_size_bytes_count ",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("The metrics do not contain %q:\n%s", expected, body)
+		}
+	}
+
+	t.Run("Test metrics only allow GET and HEAD", func(t *testing.T) {
+		resp := doRequest(t, "POST", "/metrics", "text/plain", "x")
+		resp.Body.Close()
+		if resp.StatusCode != 405 || resp.Header.Get("Allow") != "GET, HEAD" {
+			t.Errorf("Expected 405 with Allow: GET, HEAD, got %d %q", resp.StatusCode, resp.Header.Get("Allow"))
+		}
+	})
+
+	t.Run("Test metrics path setting", func(t *testing.T) {
+		loaded, _, err := loadConfig([]string{"-root", "../files", "-metrics-path", "off"}, func(string) string { return "" })
+		if err != nil || loaded.MetricsPath != "" {
+			t.Errorf("Expected the metrics to be turned off, got %q, %v", loaded.MetricsPath, err)
+		}
+		if _, _, err := loadConfig([]string{"-root", "../files", "-metrics-path", "metrics"}, func(string) string { return "" }); err == nil {
+			t.Errorf("Expected an error for a metrics path without a leading /")
+		}
+	})
+}
+
+func Test_HealthEndpoints(t *testing.T) {
+	getReport := func(method string, path string) (*http.Response, health.Report) {
+		t.Helper()
+		resp := doRequest(t, method, path, "", "")
+		defer resp.Body.Close()
+		var report health.Report
+		if method != "HEAD" {
+			if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+				t.Fatalf("Error decoding the report of %s: %v", path, err)
+			}
+		}
+		return resp, report
+	}
+
+	resp, report := getReport("GET", "/healthz")
+	if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != "application/json" || !report.OK() {
+		t.Errorf("Expected the server to be alive, got %d %+v", resp.StatusCode, report)
+	}
+
+	resp, report = getReport("GET", "/readyz")
+	if resp.StatusCode != 200 || !report.OK() {
+		t.Errorf("Expected the server to be ready, got %d %+v", resp.StatusCode, report)
+	}
+	for _, check := range []string{"document_root", "upload_dir", "admission", "shutdown"} {
+		if result, found := report.Checks[check]; !found || !result.OK {
+			t.Errorf("Expected the %s check to pass, got %+v", check, report.Checks)
+		}
+	}
+	if matches, _ := filepath.Glob("../files/" + uploadTempPrefix + "ready-*"); len(matches) != 0 {
+		t.Errorf("The readiness check left files behind: %v", matches)
+	}
+
+	resp, _ = getReport("HEAD", "/readyz?verbose=1")
+	if resp.StatusCode != 200 || resp.ContentLength <= 0 {
+		t.Errorf("Expected HEAD to get the headers of the report, got %d with length %d", resp.StatusCode, resp.ContentLength)
+	}
+	resp = doRequest(t, "DELETE", "/healthz", "", "")
+	resp.Body.Close()
+	if resp.StatusCode != 405 || resp.Header.Get("Allow") != "GET, HEAD" {
+		t.Errorf("Expected DELETE of an endpoint to get 405, got %d", resp.StatusCode)
+	}
+
+	t.Run("Test an upload directory that can not be written makes the server unready", func(t *testing.T) {
+		uploadDir := config.UploadDir
+		config.UploadDir = "../files/no_such_dir"
+		defer func() { config.UploadDir = uploadDir }()
+
+		recorder := httptest.NewRecorder()
+		handleReady(recorder, httptest.NewRequest("GET", "/readyz", nil))
+		var report health.Report
+		json.Unmarshal(recorder.Body.Bytes(), &report)
+		if recorder.Code != 503 || report.Status != "unavailable" || report.Checks["upload_dir"].OK || report.Checks["upload_dir"].Error == "" {
+			t.Errorf("Expected 503 with a failed upload_dir check, got %d %s", recorder.Code, recorder.Body.String())
+		}
+		if !report.Checks["document_root"].OK {
+			t.Errorf("Expected the document root to still pass, got %s", recorder.Body.String())
+		}
+	})
+}
+
+/*
+startTLSServer starts a server with a -dev-tls certificate on a free port, whose connections are let in by controller.
+It returns the server, its address and a pool that trusts the certificate. The listener is closed at the end of the test.
+*/
+func startTLSServer(t *testing.T, controller *admission.Controller) (*server, string, *x509.CertPool) {
+	t.Helper()
+	devConfig := config
+	devConfig.DevTLS = true
+	tlsConfig, err := newTLSConfig(devConfig)
+	if err != nil {
+		t.Fatalf("Error setting up TLS: %v", err)
+	}
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	tlsServer := newServer(controller)
+	go tlsServer.serve(tls.NewListener(listener, tlsConfig))
+
+	roots := x509.NewCertPool()
+	roots.AddCert(tlsConfig.Certificates[0].Leaf)
+	return tlsServer, listener.Addr().String(), roots
+}
+
+func Test_TLS(t *testing.T) {
+	tlsServer, address, roots := startTLSServer(t, admission.New(config.MaxConnections, config.QueueSize, config.QueueTimeout.Duration))
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+
+	t.Run("Test a file is served over HTTPS", func(t *testing.T) {
+		resp, err := client.Get("https://" + address + "/site.html")
+		if err != nil {
+			t.Fatalf("Error sending the request: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		expected, _ := os.ReadFile("../files/site.html")
+		if resp.StatusCode != 200 || resp.TLS == nil || !bytes.Equal(body, expected) {
+			t.Errorf("Expected the file over TLS, got %d", resp.StatusCode)
+		}
+		if resp.TLS.Version < tls.VersionTLS12 {
+			t.Errorf("Unexpected TLS version %x", resp.TLS.Version)
+		}
+	})
+
+	t.Run("Test TLS older than the minimum version is refused", func(t *testing.T) {
+		conn, err := tls.Dial("tcp", address, &tls.Config{RootCAs: roots, MaxVersion: tls.VersionTLS11, MinVersion: tls.VersionTLS10})
+		if err == nil {
+			conn.Close()
+			t.Errorf("Expected the handshake with TLS 1.1 to fail")
+		}
+	})
+
+	t.Run("Test plain HTTP to the HTTPS port is told so", func(t *testing.T) {
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			t.Fatalf("Error connecting: %v", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		io.WriteString(conn, "GET /site.html HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("Error reading the response: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != 400 || !strings.Contains(string(body), "HTTPS") {
+			t.Errorf("Expected 400 about HTTPS, got %d %q", resp.StatusCode, body)
+		}
+	})
+
+	t.Run("Test the redirect listener sends clients to HTTPS", func(t *testing.T) {
+		plain, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			t.Fatalf("Error listening: %v", err)
+		}
+		defer plain.Close()
+		go tlsServer.serve(redirectListener{plain})
+
+		noFollow := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+		request, _ := http.NewRequest("POST", "http://"+plain.Addr().String()+"/upload/new.txt?x=1", strings.NewReader("content"))
+		request.Host = "example.com:80"
+		resp, err := noFollow.Do(request)
+		if err != nil {
+			t.Fatalf("Error sending the request: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 308 || resp.Header.Get("Location") != "https://example.com:8080/upload/new.txt?x=1" || !resp.Close {
+			t.Errorf("Expected 308 to HTTPS, got %d %q", resp.StatusCode, resp.Header.Get("Location"))
+		}
+		if _, err := os.Stat("../files/upload/new.txt"); err == nil {
+			t.Errorf("Expected the redirected upload not to be saved")
+		}
+
+		resp, err = noFollow.Get("http://" + plain.Addr().String() + "/healthz")
+		if err != nil {
+			t.Fatalf("Error sending the request: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Errorf("Expected the liveness probe to be answered without TLS, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("Test a reloaded certificate is served to new connections", func(t *testing.T) {
+		dir := t.TempDir()
+		certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+		writeCertificate := func(certificate tls.Certificate) {
+			key, _ := x509.MarshalPKCS8PrivateKey(certificate.PrivateKey)
+			os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Certificate[0]}), 0644)
+			os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600)
+		}
+		first, _ := tlsconfig.SelfSigned("localhost")
+		writeCertificate(first)
+		fileConfig := config
+		fileConfig.TLSCert, fileConfig.TLSKey = certFile, keyFile
+		reloading, err := newTLSConfig(fileConfig)
+		if err != nil {
+			t.Fatalf("Error setting up TLS: %v", err)
+		}
+		served := func() string {
+			certificate, _ := reloading.GetCertificate(&tls.ClientHelloInfo{ServerName: "localhost"})
+			return tlsconfig.Fingerprint(*certificate)
+		}
+		if served() != tlsconfig.Fingerprint(first) {
+			t.Fatalf("Expected the first certificate")
+		}
+		second, _ := tlsconfig.SelfSigned("localhost")
+		writeCertificate(second)
+		later := time.Now().Add(time.Minute)
+		os.Chtimes(certFile, later, later)
+		time.Sleep(filewatch.DefaultCheckInterval)
+		if served() != tlsconfig.Fingerprint(second) {
+			t.Errorf("Expected the renewed certificate")
+		}
+	})
+}
+
+// http2Client returns a client that only speaks HTTP/2: h2c with prior knowledge, or h2 over TLS when roots is given.
+func http2Client(roots *x509.CertPool) *http.Client {
+	var protocols http.Protocols
+	transport := &http.Transport{Protocols: &protocols}
+	if roots != nil {
+		protocols.SetHTTP2(true)
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+	} else {
+		protocols.SetUnencryptedHTTP2(true)
+	}
+	return &http.Client{Transport: transport}
+}
+
+func Test_HTTP2(t *testing.T) {
+	expected, _ := os.ReadFile("../files/site.html")
+
+	t.Run("Test h2c with prior knowledge serves the resources of site.html on one connection", func(t *testing.T) {
+		client := http2Client(nil)
+		defer client.CloseIdleConnections()
+		var connections sync.Map
+		var wg sync.WaitGroup
+		for _, path := range []string{"/site.html", "/flower.jpg", "/dog.jpeg", "/bird.gif", "/styles.css"} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				request, _ := http.NewRequest("GET", "http://localhost:8080"+path, nil)
+				trace := &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) {
+					connections.Store(info.Conn.LocalAddr().String(), true)
+				}}
+				resp, err := client.Do(request.WithContext(httptrace.WithClientTrace(request.Context(), trace)))
+				if err != nil {
+					t.Errorf("Error getting %s: %v", path, err)
+					return
+				}
+				defer resp.Body.Close()
+				body, _ := io.ReadAll(resp.Body)
+				file, _ := os.ReadFile("../files" + path)
+				if resp.StatusCode != 200 || resp.ProtoMajor != 2 || !bytes.Equal(body, file) {
+					t.Errorf("Expected %s over HTTP/2, got %d %s", path, resp.StatusCode, resp.Proto)
+				}
+			}()
+		}
+		wg.Wait()
+		count := 0
+		connections.Range(func(any, any) bool { count++; return true })
+		if count != 1 {
+			t.Errorf("Expected the streams to share one connection, they used %d", count)
+		}
+	})
+
+	t.Run("Test methods, ranges and conditional requests over h2c", func(t *testing.T) {
+		client := http2Client(nil)
+		defer client.CloseIdleConnections()
+		defer os.Remove("../files/http2_test.txt")
+		send := func(method string, path string, headers map[string]string, body string) (*http.Response, string) {
+			t.Helper()
+			request, _ := http.NewRequest(method, "http://localhost:8080"+path, strings.NewReader(body))
+			for name, value := range headers {
+				request.Header.Set(name, value)
+			}
+			resp, err := client.Do(request)
+			if err != nil {
+				t.Fatalf("Error sending %s %s: %v", method, path, err)
+			}
+			defer resp.Body.Close()
+			data, _ := io.ReadAll(resp.Body)
+			return resp, string(data)
+		}
+
+		if resp, _ := send("PUT", "/http2_test.txt", map[string]string{"Content-Type": "text/plain"}, "over HTTP/2"); resp.StatusCode != 201 {
+			t.Errorf("Expected PUT to create the file, got %d", resp.StatusCode)
+		}
+		resp, body := send("GET", "/http2_test.txt", map[string]string{"Range": "bytes=5-"}, "")
+		if resp.StatusCode != 206 || body != "HTTP/2" {
+			t.Errorf("Expected 206 with HTTP/2, got %d %q", resp.StatusCode, body)
+		}
+		resp, body = send("HEAD", "/site.html", nil, "")
+		if resp.StatusCode != 200 || resp.ContentLength != int64(len(expected)) || body != "" {
+			t.Errorf("Expected HEAD to get the length without a body, got %d %d %q", resp.StatusCode, resp.ContentLength, body)
+		}
+		resp, _ = send("GET", "/site.html", map[string]string{"If-None-Match": resp.Header.Get("ETag")}, "")
+		if resp.StatusCode != 304 {
+			t.Errorf("Expected 304 for a current ETag, got %d", resp.StatusCode)
+		}
+		if resp, _ := send("DELETE", "/http2_test.txt", nil, ""); resp.StatusCode != 204 {
+			t.Errorf("Expected DELETE to get 204, got %d", resp.StatusCode)
+		}
+		if resp, _ := send("GET", "/missing.txt", nil, ""); resp.StatusCode != 404 {
+			t.Errorf("Expected 404, got %d", resp.StatusCode)
+		}
+		if !strings.Contains(accessLogBuffer.String(), `"proto":"HTTP/2.0"`) {
+			t.Errorf("Expected the streams in the access log")
+		}
+	})
+
+	t.Run("Test h2 is negotiated over TLS and HTTP/1.1 is still served", func(t *testing.T) {
+		_, address, roots := startTLSServer(t, admission.New(config.MaxConnections, config.QueueSize, config.QueueTimeout.Duration))
+		client := http2Client(roots)
+		defer client.CloseIdleConnections()
+		resp, err := client.Get("https://" + address + "/site.html")
+		if err != nil {
+			t.Fatalf("Error sending the request: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != 200 || resp.ProtoMajor != 2 || resp.TLS.NegotiatedProtocol != "h2" || !bytes.Equal(body, expected) {
+			t.Errorf("Expected the file over h2, got %d %s", resp.StatusCode, resp.Proto)
+		}
+
+		http1 := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+		resp, err = http1.Get("https://" + address + "/site.html")
+		if err != nil {
+			t.Fatalf("Error sending the request: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 200 || resp.ProtoMajor != 1 {
+			t.Errorf("Expected the file over HTTP/1.1, got %d %s", resp.StatusCode, resp.Proto)
+		}
+	})
+
+	t.Run("Test streams wait for a slot of the admission controller", func(t *testing.T) {
+		controller := admission.New(1, 0, time.Second)
+		_, address, roots := startTLSServer(t, controller)
+		client := http2Client(roots)
+		defer client.CloseIdleConnections()
+		defer os.Remove("../files/http2_slot.txt")
+		waitFor := func(condition func(admission.Stats) bool) {
+			deadline := time.Now().Add(2 * time.Second)
+			for !condition(controller.Stats()) {
+				if time.Now().After(deadline) {
+					t.Fatalf("Timed out waiting for the admission controller, stats %+v", controller.Stats())
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+		}
+
+		// An upload whose body has not all been sent holds the only slot
+		reader, writer := io.Pipe()
+		defer writer.CloseWithError(io.ErrUnexpectedEOF) // Ends the upload if the test stops early
+		request, _ := http.NewRequest("PUT", "https://"+address+"/http2_slot.txt", reader)
+		request.Header.Set("Content-Type", "text/plain")
+		request.ContentLength = 10
+		uploaded := make(chan *http.Response, 1)
+		go func() {
+			resp, err := client.Do(request)
+			if err != nil {
+				t.Errorf("Error uploading: %v", err)
+			}
+			uploaded <- resp
+		}()
+		writer.Write([]byte("first"))
+		waitFor(func(stats admission.Stats) bool { return stats.Active == 1 })
+
+		resp, err := client.Get("https://" + address + "/site.html")
+		if err != nil {
+			t.Fatalf("Error sending the request: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 503 || resp.Header.Get("Retry-After") == "" || resp.ProtoMajor != 2 {
+			t.Errorf("Expected a second stream to get 503 while the slot is taken, got %d %s", resp.StatusCode, resp.Proto)
+		}
+		resp, err = client.Get("https://" + address + "/healthz")
+		if err != nil || resp.StatusCode != 200 {
+			t.Errorf("Expected the liveness probe to be answered without a slot, got %v %v", resp, err)
+		} else {
+			resp.Body.Close()
+		}
+
+		writer.Write([]byte(" last"))
+		writer.Close()
+		if resp := <-uploaded; resp == nil || resp.StatusCode != 201 {
+			t.Errorf("Expected the upload to finish, got %v", resp)
+		} else {
+			resp.Body.Close()
+		}
+		waitFor(func(stats admission.Stats) bool { return stats.Active == 0 })
+		if resp, err := client.Get("https://" + address + "/site.html"); err != nil || resp.StatusCode != 200 {
+			t.Errorf("Expected the slot to be free again, got %v %v", resp, err)
+		} else {
+			resp.Body.Close()
+		}
+		// The idle connection holds no slot
+		if stats := controller.Stats(); stats.Active != 0 {
+			t.Errorf("Expected no slot to be taken between streams, got %+v", stats)
+		}
+	})
+
+	t.Run("Test an h2c upgrade is not supported and answered with HTTP/1.1", func(t *testing.T) {
+		// A whole upgrade request as RFC 7540 describes it, the server ignores the upgrade and does not answer 101
+		connection, err := net.Dial("tcp", "localhost:8080")
+		if err != nil {
+			t.Fatalf("Error connecting: %v", err)
+		}
+		defer connection.Close()
+		reader := bufio.NewReader(connection)
+		upgrade := "GET /site.html HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: AAMAAABkAARAAAAAAAIAAAAA\r\n\r\n"
+		for i := 0; i < 2; i++ {
+			// The connection stays an HTTP/1.1 connection, a second request on it is answered too
+			io.WriteString(connection, upgrade)
+			resp, err := http.ReadResponse(reader, nil)
+			if err != nil {
+				t.Fatalf("Error reading response %d: %v", i, err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != 200 || resp.Proto != "HTTP/1.1" || resp.Header.Get("Upgrade") != "" || !bytes.Equal(body, expected) {
+				t.Errorf("Expected site.html over HTTP/1.1 without an upgrade, got %d %s %v", resp.StatusCode, resp.Proto, resp.Header)
+			}
+		}
+	})
+
+	t.Run("Test HTTP/2 can be turned off", func(t *testing.T) {
+		loaded, _, err := loadConfig([]string{"-root", "../files", "-http2=false"}, func(string) string { return "" })
+		if err != nil || loaded.HTTP2 {
+			t.Errorf("Expected -http2=false to turn HTTP/2 off, got %v, %v", loaded.HTTP2, err)
+		}
+	})
+}
+
+func Test_VirtualHosts(t *testing.T) {
+	exampleDir, orgDir := t.TempDir(), t.TempDir()
+	os.WriteFile(filepath.Join(exampleDir, "index.txt"), []byte("example.com"), 0644)
+	os.WriteFile(filepath.Join(orgDir, "index.txt"), []byte("example.org"), 0644)
+	os.WriteFile(filepath.Join(orgDir, "notes.lab"), []byte("lab notes"), 0644)
+	mimeFile := filepath.Join(orgDir, "mime.types")
+	os.WriteFile(mimeFile, []byte("text/x-lab lab\n"), 0644)
+
+	siteConfig := config
+	siteConfig.Sites = siteMap{
+		"example.com": {Root: exampleDir},
+		"*.example.org": {Root: orgDir, MimeTypes: mimeFile, AllowedTypes: stringList{"text/plain", "text/x-lab"},
+			MaxUploadSize: 16},
+	}
+	hosts, err := newVirtualHosts(siteConfig)
+	if err != nil {
+		t.Fatalf("Error setting up the sites: %v", err)
+	}
+	virtualHosts = hosts
+	defer func() { virtualHosts = nil }()
+
+	// request sends a request for host to the test server and returns the response with its body.
+	request := func(method string, host string, path string, contentType string, body string) (*http.Response, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, "http://localhost:8080"+path, strings.NewReader(body))
+		req.Host = host
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error sending %s request: %v", method, err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp, string(data)
+	}
+
+	t.Run("Test each host is served from its own root", func(t *testing.T) {
+		for host, expected := range map[string]string{"example.com": "example.com", "EXAMPLE.com:8080": "example.com",
+			"www.example.org": "example.org", "a.b.example.org.": "example.org"} {
+			if resp, body := request("GET", host, "/index.txt", "", ""); resp.StatusCode != 200 || body != expected {
+				t.Errorf("Expected %q for host %s, got %d %q", expected, host, resp.StatusCode, body)
+			}
+		}
+		if resp, _ := request("GET", "example.org", "/index.txt", "", ""); resp.StatusCode != 404 {
+			t.Errorf("Expected the wildcard not to match example.org itself, got %d", resp.StatusCode)
+		}
+		if resp, _ := request("GET", "example.com", "/site.html", "", ""); resp.StatusCode != 404 {
+			t.Errorf("Expected the files of the default site not to be served for example.com, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("Test the MIME types and upload policy of a site", func(t *testing.T) {
+		resp, _ := request("GET", "www.example.org", "/notes.lab", "", "")
+		if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != "text/x-lab" {
+			t.Errorf("Expected text/x-lab from the types of the site, got %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		if resp, _ := request("PUT", "www.example.org", "/new.txt", "text/plain", strings.Repeat("x", 32)); resp.StatusCode != 413 {
+			t.Errorf("Expected the upload limit of the site, got %d", resp.StatusCode)
+		}
+		if resp, _ := request("PUT", "www.example.org", "/page.html", "text/html", "<p></p>"); resp.StatusCode != 400 {
+			t.Errorf("Expected text/html not to be allowed on the site, got %d", resp.StatusCode)
+		}
+		if resp, _ := request("PUT", "www.example.org", "/new.txt", "text/plain", "small"); resp.StatusCode != 201 {
+			t.Errorf("Expected the upload to be created, got %d", resp.StatusCode)
+		}
+		if _, err := os.Stat(filepath.Join(orgDir, "new.txt")); err != nil {
+			t.Errorf("Expected the upload in the root of the site: %v", err)
+		}
+	})
+
+	t.Run("Test unknown hosts get the default site, or 421 when they are rejected", func(t *testing.T) {
+		if resp, _ := request("GET", "unknown.test", "/site.html", "", ""); resp.StatusCode != 200 {
+			t.Errorf("Expected the default site, got %d", resp.StatusCode)
+		}
+		config.UnknownHost = "reject"
+		defer func() { config.UnknownHost = "default" }()
+		if resp, _ := request("GET", "unknown.test", "/site.html", "", ""); resp.StatusCode != 421 {
+			t.Errorf("Expected 421 Misdirected Request, got %d", resp.StatusCode)
+		}
+		if resp, _ := request("GET", "unknown.test", "/healthz", "", ""); resp.StatusCode != 200 {
+			t.Errorf("Expected the health endpoint for every host, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("Test HTTP/1.1 requires a Host header", func(t *testing.T) {
+		for request, expected := range map[string]int{
+			"GET /site.html HTTP/1.1\r\nConnection: close\r\n\r\n": 400,
+			"GET /site.html HTTP/1.0\r\n\r\n":                      200,
+		} {
+			conn, err := net.Dial("tcp", "localhost:8080")
+			if err != nil {
+				t.Fatalf("Error connecting: %v", err)
+			}
+			conn.Write([]byte(request))
+			resp := readResponses(t, bufio.NewReader(conn), 1)[0]
+			conn.Close()
+			if resp.StatusCode != expected {
+				t.Errorf("Expected %d for %q, got %s", expected, request, resp.Status)
+			}
+		}
+	})
+
+	t.Run("Test the sites are checked with the readiness", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		handleReady(recorder, httptest.NewRequest("GET", "/readyz", nil))
+		for _, check := range []string{"document_root:example.com", "upload_dir:*.example.org"} {
+			if !strings.Contains(recorder.Body.String(), check) {
+				t.Errorf("Expected the %s check, got %s", check, recorder.Body.String())
+			}
+		}
+	})
+}
+
+func Test_Authentication(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".htpasswd")
+	writeUsers := func(password string) {
+		hash, _ := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		// bob has the SHA hash of "secret", made with htpasswd -nbs bob secret
+		os.WriteFile(path, []byte("alice:"+string(hash)+"\nbob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"), 0600)
+	}
+	writeUsers("first")
+	file, err := htpasswd.Open(path)
+	if err != nil {
+		t.Fatalf("Error loading the users: %v", err)
+	}
+	file.CheckInterval = 0
+	credentials.Store(file)
+	defer credentials.Store(nil)
+	defer os.Remove("../files/auth_test.txt")
+
+	// send sends a request with the credentials, when a user is given.
+	send := func(method string, path string, user string, password string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, "http://localhost:8080"+path, strings.NewReader("authenticated"))
+		req.Header.Set("Content-Type", "text/plain")
+		if user != "" {
+			req.SetBasicAuth(user, password)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error sending %s request: %v", method, err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+
+	t.Run("Test downloads are public and uploads need a user", func(t *testing.T) {
+		if resp := send("GET", "/site.html", "", ""); resp.StatusCode != 200 {
+			t.Errorf("Expected GET without credentials to be allowed, got %d", resp.StatusCode)
+		}
+		resp := send("PUT", "/auth_test.txt", "", "")
+		if resp.StatusCode != 401 || resp.Header.Get("WWW-Authenticate") != `Basic realm="http_server", charset="UTF-8"` {
+			t.Errorf("Expected 401 with a Basic challenge, got %d %q", resp.StatusCode, resp.Header.Get("WWW-Authenticate"))
+		}
+		if resp := send("PUT", "/auth_test.txt", "alice", "wrong"); resp.StatusCode != 401 {
+			t.Errorf("Expected a wrong password to get 401, got %d", resp.StatusCode)
+		}
+		if resp := send("PUT", "/auth_test.txt", "carol", "first"); resp.StatusCode != 401 {
+			t.Errorf("Expected an unknown user to get 401, got %d", resp.StatusCode)
+		}
+		if _, err := os.Stat("../files/auth_test.txt"); !os.IsNotExist(err) {
+			t.Fatalf("Expected no file to be saved without authentication")
+		}
+		if resp := send("PUT", "/auth_test.txt", "alice", "first"); resp.StatusCode != 201 {
+			t.Errorf("Expected alice with a bcrypt password to upload, got %d", resp.StatusCode)
+		}
+		if resp := send("DELETE", "/auth_test.txt", "bob", "secret"); resp.StatusCode != 204 && resp.StatusCode != 200 {
+			t.Errorf("Expected bob with a SHA password to delete, got %d", resp.StatusCode)
+		}
+		if !strings.Contains(accessLogBuffer.String(), `"user":"bob"`) {
+			t.Errorf("Expected the user in the access log")
+		}
+	})
+
+	t.Run("Test a changed htpasswd file is used without a restart", func(t *testing.T) {
+		writeUsers("second")
+		later := time.Now().Add(time.Second)
+		os.Chtimes(path, later, later)
+		if resp := send("PUT", "/auth_test.txt", "alice", "first"); resp.StatusCode != 401 {
+			t.Errorf("Expected the old password to be refused, got %d", resp.StatusCode)
+		}
+		if resp := send("PUT", "/auth_test.txt", "alice", "second"); resp.StatusCode != 201 {
+			t.Errorf("Expected the new password to be accepted, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("Test the longest matching rule decides", func(t *testing.T) {
+		rules := config.AuthRules
+		config.AuthRules = ruleMap{"/": {"POST", "PUT", "DELETE"}, "/private": {"*"}, "/private/public": {}}
+		defer func() { config.AuthRules = rules }()
+		for request, expected := range map[string]bool{
+			"GET /site.html":                false,
+			"DELETE /site.html":             true,
+			"HEAD /private":                 true,
+			"GET /private/notes.txt":        true,
+			"GET /privateer.txt":            false,
+			"PUT /private/public/a.txt":     false,
+			"OPTIONS /private/public/a.txt": false,
+			// The rules match the path of the file that is served, however it is written
+			"GET //private/notes.txt":          true,
+			"GET /x/../private/notes.txt":      true,
+			"GET /%2fprivate/notes.txt":        true,
+			"GET /%2Fprivate%2Fnotes.txt":      true,
+			"GET /private/public/../notes.txt": true,
+			"GET /private/./public/a.txt":      false,
+		} {
+			method, target, _ := strings.Cut(request, " ")
+			if needsAuthentication(httptest.NewRequest(method, target, nil)) != expected {
+				t.Errorf("Expected authentication needed for %s to be %v", request, expected)
+			}
+		}
+	})
+}
+
+func Test_RateLimits(t *testing.T) {
+	limits := config
+	limits.RateLimits = rateLimitMap{
+		"/limited":         {Requests: 1, Burst: 2},
+		"/rate_upload.txt": {UploadRate: 10, UploadBurst: 100},
+	}
+	defer func() { rateLimiters = nil }()
+	defer os.Remove("../files/rate_upload.txt")
+
+	// send sends a request with a body of size bytes, chunked when chunked is true.
+	send := func(method string, path string, size int, chunked bool) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, "http://localhost:8080"+path, strings.NewReader(strings.Repeat("x", size)))
+		req.Header.Set("Content-Type", "text/plain")
+		if chunked {
+			req.ContentLength = -1
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error sending %s request: %v", method, err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+
+	t.Run("Test requests over the burst get 429", func(t *testing.T) {
+		rateLimiters = newRateLimiters(limits)
+		refused := rateLimited.Value("requests")
+		for i, remaining := range []string{"1", "0"} {
+			resp := send("GET", "/limited/page.html", 0, false)
+			if resp.StatusCode != 404 || resp.Header.Get("RateLimit-Limit") != "2" || resp.Header.Get("RateLimit-Remaining") != remaining {
+				t.Errorf("Expected request %d to be allowed with %s remaining, got %d %v", i, remaining, resp.StatusCode, resp.Header)
+			}
+		}
+		resp := send("GET", "/limited", 0, false)
+		if resp.StatusCode != 429 || resp.Header.Get("Retry-After") != "1" || resp.Header.Get("RateLimit-Reset") != "2" {
+			t.Errorf("Expected 429 with Retry-After, got %d %v", resp.StatusCode, resp.Header)
+		}
+		resp = send("GET", "/site.html", 0, false)
+		if resp.StatusCode != 200 || resp.Header.Get("RateLimit-Limit") != "" {
+			t.Errorf("Expected other paths not to be limited, got %d %v", resp.StatusCode, resp.Header)
+		}
+		if rateLimited.Value("requests") != refused+1 {
+			t.Errorf("Expected the refused request to be counted")
+		}
+	})
+
+	t.Run("Test the limits match the cleaned path", func(t *testing.T) {
+		rateLimiters = newRateLimiters(limits)
+		for _, path := range []string{"//limited/page.html", "/x/../limited/page.html"} {
+			if resp := send("GET", path, 0, false); resp.Header.Get("RateLimit-Limit") != "2" {
+				t.Errorf("Expected %s to be limited, got %d %v", path, resp.StatusCode, resp.Header)
+			}
+		}
+		if resp := send("GET", "/%2flimited/page.html", 0, false); resp.StatusCode != 429 {
+			t.Errorf("Expected the third request to get 429, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("Test an authenticated user has a bucket of its own", func(t *testing.T) {
+		rateLimiters = newRateLimiters(limits)
+		path := filepath.Join(t.TempDir(), ".htpasswd")
+		os.WriteFile(path, []byte("bob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"), 0600) // Password "secret"
+		file, _ := htpasswd.Open(path)
+		credentials.Store(file)
+		defer credentials.Store(nil)
+
+		for i := 0; i < 3; i++ {
+			send("GET", "/limited", 0, false)
+		}
+		req, _ := http.NewRequest("DELETE", "http://localhost:8080/limited/page.html", nil)
+		req.SetBasicAuth("bob", "secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error sending DELETE request: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode == 429 || resp.Header.Get("RateLimit-Remaining") != "1" {
+			t.Errorf("Expected bob not to share the bucket of the IP address, got %d %v", resp.StatusCode, resp.Header)
+		}
+	})
+
+	t.Run("Test upload bytes are limited", func(t *testing.T) {
+		for _, chunked := range []bool{false, true} {
+			rateLimiters = newRateLimiters(limits)
+			if resp := send("PUT", "/rate_upload.txt", 150, chunked); resp.StatusCode != 201 && resp.StatusCode != 204 {
+				t.Errorf("Expected an upload larger than the burst to be allowed from a full bucket, got %d", resp.StatusCode)
+			}
+			resp := send("PUT", "/rate_upload.txt", 10, chunked)
+			if resp.StatusCode != 429 || resp.Header.Get("Retry-After") == "" || resp.Header.Get("RateLimit-Limit") != "" {
+				t.Errorf("Expected the next upload to wait for the debt, chunked %v, got %d %v", chunked, resp.StatusCode, resp.Header)
+			}
+		}
+		if resp := send("GET", "/rate_upload.txt", 0, false); resp.StatusCode != 200 {
+			t.Errorf("Expected downloads not to take upload bytes, got %d", resp.StatusCode)
+		}
+	})
+}
+
+func Test_AccessRules(t *testing.T) {
+	defer func() { accessFilter = &ipfilter.Filter{} }()
+	defer os.Remove("../files/access_test.txt")
+	// setFilter makes the server use the rules, with the networks of trusted proxies.
+	setFilter := func(rules []string, trusted ...string) {
+		t.Helper()
+		filter, err := ipfilter.New(rules, trusted)
+		if err != nil {
+			t.Fatalf("Error creating the filter: %v", err)
+		}
+		accessFilter = filter
+	}
+	// send sends a request with the X-Forwarded-For header, when it is given.
+	send := func(method string, path string, forwardedFor string) int {
+		t.Helper()
+		req, _ := http.NewRequest(method, "http://localhost:8080"+path, strings.NewReader("access"))
+		req.Header.Set("Content-Type", "text/plain")
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error sending %s request: %v", method, err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	internalOnly := []string{"allow 10.0.0.0/8 POST,PUT,DELETE", "deny all POST,PUT,DELETE"}
+
+	t.Run("Test uploads are only allowed from the internal network", func(t *testing.T) {
+		setFilter(internalOnly)
+		if status := send("PUT", "/access_test.txt", ""); status != 403 {
+			t.Errorf("Expected an upload from 127.0.0.1 to be forbidden, got %d", status)
+		}
+		if status := send("PUT", "/access_test.txt", "10.1.2.3"); status != 403 {
+			t.Errorf("Expected X-Forwarded-For of an untrusted client to be ignored, got %d", status)
+		}
+		if status := send("GET", "/site.html", ""); status != 200 {
+			t.Errorf("Expected GET to stay public, got %d", status)
+		}
+		if status := send("GET", "/healthz", ""); status != 200 {
+			t.Errorf("Expected the health endpoint to stay reachable without a rule for it, got %d", status)
+		}
+		setFilter([]string{"allow 127.0.0.1 PUT", "deny all"})
+		if status := send("PUT", "/access_test.txt", ""); status != 201 {
+			t.Errorf("Expected the allowed address to upload, got %d", status)
+		}
+		if status := send("GET", "/site.html", ""); status != 403 {
+			t.Errorf("Expected the rule for all methods to deny GET, got %d", status)
+		}
+	})
+
+	t.Run("Test the client behind a trusted proxy is found in X-Forwarded-For", func(t *testing.T) {
+		setFilter(internalOnly, "127.0.0.1")
+		if status := send("PUT", "/access_test.txt", "10.1.2.3"); status != 201 && status != 204 {
+			t.Errorf("Expected the internal client behind the proxy to upload, got %d", status)
+		}
+		if status := send("PUT", "/access_test.txt", "10.1.2.3, 192.0.2.1"); status != 403 {
+			t.Errorf("Expected the last untrusted address to be the client, got %d", status)
+		}
+		if status := send("DELETE", "/access_test.txt", ""); status != 403 {
+			t.Errorf("Expected the proxy itself not to be internal, got %d", status)
+		}
+	})
+
+	t.Run("Test the rules match the cleaned path", func(t *testing.T) {
+		setFilter([]string{"deny all GET /private"})
+		for _, path := range []string{"/private/a.txt", "//private/a.txt", "/x/../private/a.txt", "/%2fprivate/a.txt"} {
+			if status := send("GET", path, ""); status != 403 {
+				t.Errorf("Expected GET %s to be forbidden, got %d", path, status)
+			}
+		}
+		if status := send("GET", "/private/../site.html", ""); status != 200 {
+			t.Errorf("Expected a path that leaves /private to be allowed, got %d", status)
+		}
+	})
+
+	t.Run("Test the rules can restrict the endpoints", func(t *testing.T) {
+		setFilter([]string{"allow 10.0.0.0/8 GET /metrics", "deny all GET /metrics"})
+		if status := send("GET", "/metrics", ""); status != 403 {
+			t.Errorf("Expected the metrics to be forbidden, got %d", status)
+		}
+		if status := send("GET", "/healthz", ""); status != 200 {
+			t.Errorf("Expected the health endpoint to stay reachable, got %d", status)
+		}
+		setFilter([]string{"deny all"})
+		if status := send("GET", "/readyz", ""); status != 403 {
+			t.Errorf("Expected a rule for every path to cover the readiness endpoint, got %d", status)
+		}
+	})
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"http_server/ipfilter"
+)
+
+// accessRuleList is a list of IP rules, written as "allow 10.0.0.0/8 POST,PUT /;deny all POST,PUT /" on the command line.
+type accessRuleList []string
+
+func (l *accessRuleList) String() string {
+	return strings.Join(*l, ";")
+}
+
+func (l *accessRuleList) Set(value string) error {
+	*l = nil
+	for _, rule := range strings.Split(value, ";") {
+		if rule = strings.TrimSpace(rule); rule != "" {
+			*l = append(*l, rule)
+		}
+	}
+	return nil
+}
+
+// accessFilter decides by the -access-rules which clients may make a request, set up by main. It allows everything by default.
+var accessFilter = &ipfilter.Filter{}
+
+/*
+clientIP returns the IP address of the client of a request, which behind a trusted proxy is found in X-Forwarded-For.
+*/
+func clientIP(request *http.Request) string {
+	addr, err := accessFilter.ClientAddr(request.RemoteAddr, request.Header)
+	if err != nil {
+		return request.RemoteAddr
+	}
+	return addr.String()
+}
+
+// checkAccess answers 403 Forbidden to a client that the access rules do not allow the request, and reports whether it may go on.
+func checkAccess(response http.ResponseWriter, request *http.Request) bool {
+	addr, err := accessFilter.ClientAddr(request.RemoteAddr, request.Header)
+	if err == nil && accessFilter.Allowed(addr, request.Method, requestPath(request)) {
+		return true
+	}
+	requestLogger(request).Info("Client is not allowed", "client", addr, "method", request.Method, "uri", request.RequestURI)
+	giveResponse(response, 403)
+	return false
+}
@@ -0,0 +1,222 @@
+/*
+Package ipfilter allows or denies requests by the IP address of the client, with rules of CIDR networks
+for methods below a path prefix, for the server and the proxy.
+
+A rule is written as "action networks [methods] [path]", such as
+
+	allow 10.0.0.0/8,192.168.0.0/16 POST,PUT,DELETE /
+	deny all POST,PUT,DELETE /
+
+which lets only the internal network upload. The action is allow or deny, the networks are CIDR prefixes,
+single addresses or "all". Without methods a rule is for every method, GET also covers HEAD, and without a path
+for every path, a path covers itself and what is below it. The rules that are for a request are checked in order,
+the first whose networks hold the address of the client decides. When none does, the request is allowed.
+
+Behind proxies the address of the connection is that of the proxy. When it belongs to a trusted proxy,
+the client is found in the X-Forwarded-For header, which every proxy appends the address it got the request from to.
+*/
+package ipfilter
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"path"
+	"strings"
+)
+
+// Rule allows or denies the clients in Networks to make requests with Methods below Path.
+type Rule struct {
+	Allow    bool
+	Networks []netip.Prefix
+	Methods  []string // none for every method
+	Path     string   // "" for every path
+}
+
+// all are the networks of "all", every IPv4 and IPv6 address.
+var all = []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0")}
+
+// ParseRule reads a rule written as "action networks [methods] [path]".
+func ParseRule(text string) (Rule, error) {
+	fields := strings.Fields(text)
+	if len(fields) < 2 || len(fields) > 4 {
+		return Rule{}, fmt.Errorf("invalid rule %q, expected action networks [methods] [path]", text)
+	}
+	var rule Rule
+	switch strings.ToLower(fields[0]) {
+	case "allow":
+		rule.Allow = true
+	case "deny":
+	default:
+		return Rule{}, fmt.Errorf("invalid rule %q, the action must be allow or deny", text)
+	}
+	networks, err := ParseNetworks(strings.Split(fields[1], ","))
+	if err != nil {
+		return Rule{}, fmt.Errorf("invalid rule %q: %v", text, err)
+	}
+	rule.Networks = networks
+	for _, field := range fields[2:] {
+		if strings.HasPrefix(field, "/") && rule.Path == "" {
+			rule.Path = field
+		} else if rule.Methods == nil && rule.Path == "" {
+			for _, method := range strings.Split(field, ",") {
+				if method = strings.ToUpper(strings.TrimSpace(method)); method != "" && method != "*" {
+					rule.Methods = append(rule.Methods, method)
+				}
+			}
+		} else {
+			return Rule{}, fmt.Errorf("invalid rule %q, expected action networks [methods] [path]", text)
+		}
+	}
+	return rule, nil
+}
+
+// ParseNetworks reads CIDR prefixes, single addresses, which are a network of their own, and "all".
+func ParseNetworks(texts []string) ([]netip.Prefix, error) {
+	var networks []netip.Prefix
+	for _, text := range texts {
+		text = strings.TrimSpace(text)
+		switch {
+		case text == "":
+		case strings.EqualFold(text, "all"):
+			networks = append(networks, all...)
+		case strings.Contains(text, "/"):
+			network, err := netip.ParsePrefix(text)
+			if err != nil {
+				return nil, err
+			}
+			networks = append(networks, network.Masked())
+		default:
+			addr, err := netip.ParseAddr(text)
+			if err != nil {
+				return nil, err
+			}
+			addr = addr.Unmap()
+			networks = append(networks, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+	}
+	return networks, nil
+}
+
+// appliesTo reports whether the rule is for requests with method below path.
+func (r Rule) appliesTo(method string, path string) bool {
+	if r.Path != "" {
+		prefix := strings.TrimSuffix(r.Path, "/")
+		if path != prefix && !strings.HasPrefix(path, prefix+"/") {
+			return false
+		}
+	}
+	if len(r.Methods) == 0 {
+		return true
+	}
+	if method == "HEAD" {
+		method = "GET"
+	}
+	for _, m := range r.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanPath returns p as an absolute path without repeated slashes and dot segments.
+func cleanPath(p string) string {
+	return path.Clean("/" + p)
+}
+
+// holds reports whether addr is in one of the networks of the rule.
+func (r Rule) holds(addr netip.Addr) bool {
+	for _, network := range r.Networks {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Filter decides by the rules which clients may make a request. A Filter without rules allows everything.
+type Filter struct {
+	Rules          []Rule
+	TrustedProxies []netip.Prefix
+}
+
+// New creates a Filter from rules written for ParseRule and the networks of trusted proxies.
+func New(rules []string, trustedProxies []string) (*Filter, error) {
+	f := &Filter{}
+	for _, text := range rules {
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		rule, err := ParseRule(text)
+		if err != nil {
+			return nil, err
+		}
+		f.Rules = append(f.Rules, rule)
+	}
+	trusted, err := ParseNetworks(trustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted proxy: %v", err)
+	}
+	f.TrustedProxies = trusted
+	return f, nil
+}
+
+/*
+Allowed reports whether the client at addr may make a request with method for path.
+Repeated slashes and dot segments are removed from path first, so "//pub" and "/x/../pub" are below "/pub".
+*/
+func (f *Filter) Allowed(addr netip.Addr, method string, path string) bool {
+	addr = addr.Unmap()
+	path = cleanPath(path)
+	for _, rule := range f.Rules {
+		if rule.appliesTo(method, path) && rule.holds(addr) {
+			return rule.Allow
+		}
+	}
+	return true
+}
+
+/*
+ClientAddr returns the address of the client of a request that arrived from remoteAddr, a host:port.
+When remoteAddr is a trusted proxy, the X-Forwarded-For addresses are gone through from the last to the first,
+and the first one that is not a trusted proxy is the client. Earlier addresses could be made up by the client,
+so they are never used. An address that can not be read ends the search at the last address that could be trusted.
+*/
+func (f *Filter) ClientAddr(remoteAddr string, header http.Header) (netip.Addr, error) {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	addr = addr.Unmap().WithZone("")
+	if !f.trusted(addr) {
+		return addr, nil
+	}
+	var hops []string
+	for _, value := range header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0 && f.trusted(addr); i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		addr = hop.Unmap().WithZone("")
+	}
+	return addr, nil
+}
+
+// trusted reports whether addr belongs to a trusted proxy.
+func (f *Filter) trusted(addr netip.Addr) bool {
+	for _, network := range f.TrustedProxies {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
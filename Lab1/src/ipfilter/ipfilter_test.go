@@ -0,0 +1,86 @@
+package ipfilter
+
+import (
+	"net/http"
+	"net/netip"
+	"testing"
+)
+
+func TestParseRule(t *testing.T) {
+	rule, err := ParseRule("allow 10.0.0.0/8,192.168.1.7 post,PUT /uploads")
+	if err != nil || !rule.Allow || len(rule.Networks) != 2 || rule.Networks[1].Bits() != 32 ||
+		len(rule.Methods) != 2 || rule.Methods[0] != "POST" || rule.Path != "/uploads" {
+		t.Fatalf("Unexpected rule %+v, %v", rule, err)
+	}
+	rule, err = ParseRule("deny all /private")
+	if err != nil || rule.Allow || len(rule.Networks) != 2 || rule.Methods != nil || rule.Path != "/private" {
+		t.Errorf("Unexpected rule %+v, %v", rule, err)
+	}
+	for _, text := range []string{"allow", "block all", "deny 10.0.0.0/33", "deny all GET /a /b", "deny all /a GET", "allow all GET / extra"} {
+		if _, err := ParseRule(text); err == nil {
+			t.Errorf("Expected %q to be refused", text)
+		}
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	f, err := New([]string{
+		"allow 10.0.0.0/8,::1 POST,PUT,DELETE",
+		"deny all POST,PUT,DELETE",
+		"deny 203.0.113.0/24 GET /private",
+	}, nil)
+	if err != nil {
+		t.Fatalf("Error creating the filter: %v", err)
+	}
+	for _, test := range []struct {
+		addr, method, path string
+		allowed            bool
+	}{
+		{"10.1.2.3", "POST", "/a.txt", true},
+		{"::1", "DELETE", "/a.txt", true},
+		{"::ffff:10.1.2.3", "PUT", "/a.txt", true},
+		{"192.0.2.1", "PUT", "/a.txt", false},
+		{"192.0.2.1", "GET", "/a.txt", true},
+		{"203.0.113.9", "HEAD", "/private/a.txt", false},
+		{"203.0.113.9", "GET", "/privateer.txt", true},
+		{"203.0.113.9", "OPTIONS", "/private", true},
+		{"203.0.113.9", "GET", "//private/a.txt", false},
+		{"203.0.113.9", "GET", "/x/../private/a.txt", false},
+		{"203.0.113.9", "GET", "/private/../a.txt", true},
+	} {
+		if f.Allowed(netip.MustParseAddr(test.addr), test.method, test.path) != test.allowed {
+			t.Errorf("Expected %s %s from %s to be allowed %v", test.method, test.path, test.addr, test.allowed)
+		}
+	}
+}
+
+func TestClientAddr(t *testing.T) {
+	f, err := New(nil, []string{"10.0.0.0/8", "127.0.0.1"})
+	if err != nil {
+		t.Fatalf("Error creating the filter: %v", err)
+	}
+	header := func(values ...string) http.Header {
+		return http.Header{"X-Forwarded-For": values}
+	}
+	for _, test := range []struct {
+		remote string
+		header http.Header
+		client string
+	}{
+		{"192.0.2.1:5000", header("10.0.0.1"), "192.0.2.1"},                           // Not a proxy, the header is ignored
+		{"127.0.0.1:5000", nil, "127.0.0.1"},                                          // A trusted proxy that forwarded nothing
+		{"127.0.0.1:5000", header("198.51.100.7"), "198.51.100.7"},                    // Through the proxy
+		{"127.0.0.1:5000", header("1.2.3.4, 198.51.100.7, 10.0.0.2"), "198.51.100.7"}, // Two proxies, 1.2.3.4 is made up by the client
+		{"127.0.0.1:5000", header("198.51.100.7", "10.0.0.2"), "198.51.100.7"},        // Headers on several lines
+		{"127.0.0.1:5000", header("garbage, 10.0.0.2"), "10.0.0.2"},                   // Stops at what can not be read
+		{"[::ffff:127.0.0.1]:5000", header("2001:db8::1"), "2001:db8::1"},
+	} {
+		addr, err := f.ClientAddr(test.remote, test.header)
+		if err != nil || addr.String() != test.client {
+			t.Errorf("Expected client %s for %s %v, got %s, %v", test.client, test.remote, test.header, addr, err)
+		}
+	}
+	if _, err := New(nil, []string{"not an address"}); err == nil {
+		t.Errorf("Expected an invalid trusted proxy to be refused")
+	}
+}
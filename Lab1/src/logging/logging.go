@@ -0,0 +1,150 @@
+/*
+Package logging sets up the log/slog logger of the server, the proxy and the client.
+
+Log lines have a level (debug, info, warn or error) and are written as text or JSON:
+
+	time=2026-10-17T13:55:36.000+02:00 level=ERROR msg="Opening file" request_id=4f1c9a02d3e8b761 err="permission denied"
+	{"time":"2026-10-17T13:55:36.000+02:00","level":"ERROR","msg":"Opening file","request_id":"4f1c9a02d3e8b761","err":"permission denied"}
+
+Text lines are colored by level only when they go to a terminal, so logs collected from a container
+have no escape codes in them. Setting NO_COLOR turns the colors off on a terminal too.
+A logger with the attributes of a request, such as its ID and remote address, is passed along in the
+context of the request.
+*/
+package logging
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Formats are the names of the log formats, as given to New.
+var Formats = []string{"text", "json"}
+
+// ParseLevel returns the level with the name "debug", "info", "warn" or "error".
+func ParseLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.TrimSpace(name))); err != nil {
+		return 0, fmt.Errorf("unknown log level %q, expected debug, info, warn or error", name)
+	}
+	return level, nil
+}
+
+// CheckFormat returns an error if format is not one of Formats.
+func CheckFormat(format string) error {
+	for _, known := range Formats {
+		if format == known {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown log format %q, expected text or json", format)
+}
+
+/*
+New returns a logger writing lines of at least level to out, as "text" or "json".
+Text lines are colored when out is a terminal and NO_COLOR is not set.
+*/
+func New(out io.Writer, level slog.Leveler, format string) *slog.Logger {
+	options := &slog.HandlerOptions{Level: level}
+	if format == "json" {
+		return slog.New(slog.NewJSONHandler(out, options))
+	}
+	if IsTerminal(out) && os.Getenv("NO_COLOR") == "" {
+		out = &colorWriter{out: out}
+	}
+	return slog.New(slog.NewTextHandler(out, options))
+}
+
+/*
+Setup makes a logger to stdout with the level and format names the default of log/slog,
+which is used by slog.Info, slog.Error and so on.
+*/
+func Setup(levelName string, format string) error {
+	level, err := ParseLevel(levelName)
+	if err != nil {
+		return err
+	}
+	if err := CheckFormat(format); err != nil {
+		return err
+	}
+	slog.SetDefault(New(os.Stdout, level, format))
+	return nil
+}
+
+// IsTerminal reports whether out is a terminal rather than a file or a pipe.
+func IsTerminal(out io.Writer) bool {
+	file, ok := out.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// contextKey is the key of the logger in a context.
+type contextKey struct{}
+
+// NewContext returns a copy of ctx that carries logger.
+func NewContext(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, logger)
+}
+
+// FromContext returns the logger of ctx, or the default logger if it has none.
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(contextKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// NewRequestID returns a random ID to tell the log lines of a request apart from those of others.
+func NewRequestID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// levelColors are the ANSI colors of the levels in text lines.
+var levelColors = []struct {
+	level string
+	color string
+}{
+	{"level=ERROR", "\x1b[31m"}, // red
+	{"level=WARN", "\x1b[33m"},  // yellow
+	{"level=INFO", "\x1b[32m"},  // green
+	{"level=DEBUG", "\x1b[90m"}, // grey
+}
+
+/*
+colorWriter colors the level of the text lines written to a terminal.
+The text handler writes every line with a single Write, so each Write is one line.
+*/
+type colorWriter struct {
+	out io.Writer
+}
+
+func (w *colorWriter) Write(line []byte) (int, error) {
+	for _, level := range levelColors {
+		if i := bytes.Index(line, []byte(level.level)); i >= 0 {
+			end := i + len(level.level)
+			colored := make([]byte, 0, len(line)+len(level.color)+4)
+			colored = append(colored, line[:i]...)
+			colored = append(colored, level.color...)
+			colored = append(colored, line[i:end]...)
+			colored = append(colored, "\x1b[0m"...)
+			colored = append(colored, line[end:]...)
+			if _, err := w.out.Write(colored); err != nil {
+				return 0, err
+			}
+			return len(line), nil
+		}
+	}
+	return w.out.Write(line)
+}
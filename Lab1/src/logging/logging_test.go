@@ -0,0 +1,85 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestParseLevel(t *testing.T) {
+	tests := map[string]slog.Level{
+		"debug": slog.LevelDebug,
+		"INFO":  slog.LevelInfo,
+		"warn":  slog.LevelWarn,
+		"error": slog.LevelError,
+	}
+	for name, expected := range tests {
+		if level, err := ParseLevel(name); err != nil || level != expected {
+			t.Errorf("ParseLevel(%q) = %v, %v", name, level, err)
+		}
+	}
+	if _, err := ParseLevel("loud"); err == nil {
+		t.Errorf("ParseLevel accepted an unknown level")
+	}
+	if CheckFormat("json") != nil || CheckFormat("xml") == nil {
+		t.Errorf("CheckFormat accepts the wrong formats")
+	}
+}
+
+func TestNew(t *testing.T) {
+	var out bytes.Buffer
+	logger := New(&out, slog.LevelInfo, "text")
+	logger.Debug("Hidden")
+	logger.With("request_id", "4f1c9a02d3e8b761").Error("Opening file", "err", "permission denied")
+	line := out.String()
+	if strings.Contains(line, "Hidden") {
+		t.Errorf("A debug message was logged at level info: %q", line)
+	}
+	if !strings.Contains(line, `level=ERROR msg="Opening file" request_id=4f1c9a02d3e8b761 err="permission denied"`) {
+		t.Errorf("Unexpected text line %q", line)
+	}
+	// A buffer is not a terminal, so there are no colors
+	if strings.Contains(line, "\x1b[") {
+		t.Errorf("The text line has escape codes: %q", line)
+	}
+
+	out.Reset()
+	New(&out, slog.LevelDebug, "json").Debug("Request", "uri", "/site.html")
+	var decoded map[string]any
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil {
+		t.Fatalf("Error decoding the JSON line %q: %v", out.String(), err)
+	}
+	if decoded["level"] != "DEBUG" || decoded["msg"] != "Request" || decoded["uri"] != "/site.html" {
+		t.Errorf("Unexpected JSON line %s", out.String())
+	}
+}
+
+func TestColorWriter(t *testing.T) {
+	var out bytes.Buffer
+	writer := &colorWriter{out: &out}
+	line := "time=now level=WARN msg=Slow\n"
+	if n, err := writer.Write([]byte(line)); n != len(line) || err != nil {
+		t.Errorf("Write returned %d, %v", n, err)
+	}
+	if out.String() != "time=now \x1b[33mlevel=WARN\x1b[0m msg=Slow\n" {
+		t.Errorf("Unexpected colored line %q", out.String())
+	}
+}
+
+func TestContext(t *testing.T) {
+	if FromContext(context.Background()) != slog.Default() {
+		t.Errorf("A context without a logger does not give the default logger")
+	}
+	var out bytes.Buffer
+	logger := New(&out, slog.LevelInfo, "text").With("request_id", NewRequestID())
+	FromContext(NewContext(context.Background(), logger)).Info("Handled")
+	if !strings.Contains(out.String(), "request_id=") {
+		t.Errorf("The logger of the context was not used: %q", out.String())
+	}
+	if first, second := NewRequestID(), NewRequestID(); len(first) != 16 || first == second {
+		t.Errorf("Request IDs %q and %q are not random 16 character IDs", first, second)
+	}
+}
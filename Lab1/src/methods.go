@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+handleGet answers GET and HEAD requests for a file.
+A HEAD request gets the same status and headers as a GET request, the response writer leaves out the body.
+*/
+func handleGet(response http.ResponseWriter, request *http.Request, vhost *virtualHost, url string) error {
+	// Determine the content type of the requested resource and whether it's valid
+	contentType, isValid := getContentTypeAndCheckValid(vhost, url) //returns "" if not matching valid ContentType
+
+	// If the content type is not valid, respond with a Bad Request error
+	if !isValid { //If isValiedType = false   (If not one of the allowed types, such as .txt .html .css .jpg .png) -> send "Bad request" response
+		return giveResponse(response, 400) // 400 Bad Request
+	}
+	// If the content type is valid, check if the file exists
+	if !checkFileExistence(url) {
+		// If the file does not exist, respond with a 404 Not Found
+		return giveResponse(response, 404)
+	}
+	// Open the file, it is streamed to the client
+	file, fileInfo, err_open := openFile(url)
+	if err_open != nil {
+		requestLogger(request).Error("Opening file", "path", url, "err", err_open)
+		return giveResponse(response, 500)
+	}
+	defer file.Close()
+	if fileInfo.IsDir() {
+		// A directory named like a file is not served, its listing is not a file of the site
+		return giveResponse(response, 404)
+	}
+	// Answer 304 Not Modified or 412 Precondition Failed if the conditional headers ask for it
+	etag := fileETag(fileInfo)
+	setValidators(response, etag, fileInfo.ModTime())
+	status := checkPreconditions(request, etag, fileInfo.ModTime())
+	recordConditional(request, status)
+	if status == 304 {
+		response.WriteHeader(304)
+		return nil
+	} else if status == 412 {
+		return giveResponse(response, 412)
+	}
+	// Send the file, or the requested ranges of it, to the client
+	return sendFileContents(response, request, file, fileInfo.Size(), contentType, etag, fileInfo.ModTime())
+}
+
+// handlePost saves the body of a POST request as a file and answers 200 OK.
+func handlePost(response http.ResponseWriter, request *http.Request, vhost *virtualHost, url string) error {
+	// Get the content type sent by the client and determine if it's valid
+	contentTypeSender := request.Header.Get("Content-Type")
+	senderType, isValidSendertype := checkSenderType(vhost, contentTypeSender)
+
+	// If the sender's content type is not valid, respond with a Bad Request error
+	if !isValidSendertype { //If the sender type not matches
+		return giveResponse(response, 400) // 400 Bad Request
+	}
+	// Refuse a body that is announced to be too large before reading it
+	limit := vhost.config.uploadLimit(senderType)
+	if rejected, err := checkUploadSize(response, request, limit); rejected {
+		return err
+	}
+	// Save the file sent in the POST request
+	err := saveFile(request, url, limit, nil)
+	if err != nil {
+		return uploadErrorResponse(response, request, err)
+	}
+	// Respond with a success status
+	return giveResponse(response, 200) // 200 ok
+}
+
+/*
+handlePut stores the body of a PUT request as the file at the request URI.
+The file must have a type the server can serve. Creating a new file answers 201 Created,
+replacing an existing file answers 204 No Content. If-Match and If-None-Match are evaluated
+against the existing file, so "If-None-Match: *" only creates and never replaces.
+*/
+func handlePut(response http.ResponseWriter, request *http.Request, vhost *virtualHost, url string) error {
+	contentType, isValid := getContentTypeAndCheckValid(vhost, url)
+	contentTypeSender := request.Header.Get("Content-Type")
+	_, isValidSendertype := checkSenderType(vhost, contentTypeSender)
+	if !isValid || (contentTypeSender != "" && !isValidSendertype) {
+		return giveResponse(response, 400) // 400 Bad Request
+	}
+
+	etag, modTime, exists, err := fileValidators(url)
+	if err == errIsDirectory {
+		return giveResponse(response, 409)
+	}
+	if err != nil {
+		requestLogger(request).Error("Checking the file of a PUT", "path", url, "err", err)
+		return giveResponse(response, 500)
+	}
+	if checkPreconditions(request, etag, modTime) != 0 {
+		return giveResponse(response, 412)
+	}
+	limit := vhost.config.uploadLimit(contentType)
+	if rejected, err := checkUploadSize(response, request, limit); rejected {
+		return err
+	}
+
+	// The preconditions are checked again with the path locked, another upload may have created or changed the file meanwhile
+	err = saveFile(request, url, limit, func() error {
+		etag, modTime, found, err := fileValidators(url)
+		if err != nil {
+			return err
+		}
+		if checkPreconditions(request, etag, modTime) != 0 {
+			return errPreconditionFailed
+		}
+		exists = found
+		return nil
+	})
+	if err != nil {
+		return uploadErrorResponse(response, request, err)
+	}
+	if exists {
+		response.WriteHeader(204)
+		return nil
+	}
+	response.Header().Set("Location", request.URL.Path)
+	return giveResponse(response, 201)
+}
+
+// handleDelete removes the file at the request URI and answers 204 No Content, or 404 if there is no such file.
+func handleDelete(response http.ResponseWriter, request *http.Request, vhost *virtualHost, url string) error {
+	if _, isValid := getContentTypeAndCheckValid(vhost, url); !isValid {
+		return giveResponse(response, 400) // 400 Bad Request
+	}
+	etag, modTime, exists, err := fileValidators(url)
+	if err == errIsDirectory {
+		return giveResponse(response, 409)
+	}
+	if err != nil {
+		requestLogger(request).Error("Checking the file of a DELETE", "path", url, "err", err)
+		return giveResponse(response, 500)
+	}
+	if !exists {
+		return giveResponse(response, 404)
+	}
+	if checkPreconditions(request, etag, modTime) != 0 {
+		return giveResponse(response, 412)
+	}
+
+	err = deleteFile(url)
+	if err != nil {
+		requestLogger(request).Error("Deleting file", "path", url, "err", err)
+		return giveResponse(response, 500)
+	}
+	response.WriteHeader(204)
+	return nil
+}
+
+/*
+handleOptions answers an OPTIONS request with the methods the server allows in the Allow header.
+The body tells clients how large uploads may be, before they send one.
+*/
+func handleOptions(response http.ResponseWriter, vhost *virtualHost) error {
+	body, err := json.Marshal(struct {
+		Allow         []string `json:"allow"`
+		MaxUploadSize int64    `json:"max_upload_size"`
+		UploadLimits  sizeMap  `json:"upload_limits"`
+	}{strings.Split(allowedMethods, ", "), int64(vhost.config.MaxUploadSize), vhost.config.UploadLimits})
+	if err != nil {
+		return err
+	}
+	response.Header().Set("Allow", allowedMethods)
+	response.Header().Set("Content-Type", "application/json")
+	response.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	response.WriteHeader(200)
+	_, err = response.Write(body)
+	return err
+}
+
+// errIsDirectory is returned by fileValidators for a directory, which is not a file the server can replace or delete.
+var errIsDirectory = errors.New("path is a directory")
+
+/*
+fileValidators returns the entity tag and modification time of a regular file and whether it exists.
+A missing file is not an error, it gets an empty entity tag. A directory returns errIsDirectory.
+*/
+func fileValidators(url string) (string, time.Time, bool, error) {
+	fileInfo, err := os.Stat(url)
+	if isNotExist(err) {
+		return "", time.Time{}, false, nil
+	}
+	if err != nil {
+		return "", time.Time{}, false, err
+	}
+	if fileInfo.IsDir() {
+		return "", time.Time{}, false, errIsDirectory
+	}
+	return fileETag(fileInfo), fileInfo.ModTime(), true, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"http_server/metrics"
+)
+
+// metricsRegistry holds the metrics of the server, which the metrics endpoint writes.
+var metricsRegistry = metrics.NewRegistry()
+
+var (
+	requestsTotal = metricsRegistry.NewCounter("http_requests_total",
+		"Requests answered, by method and status.", "method", "status")
+	requestDuration = metricsRegistry.NewHistogram("http_request_duration_seconds",
+		"Time from reading the headers of a request to having answered it, by method.", metrics.DurationBuckets, "method")
+	requestBodyBytes = metricsRegistry.NewCounter("http_request_body_bytes_total",
+		"Bytes of request bodies received.")
+	responseBodyBytes = metricsRegistry.NewCounter("http_response_body_bytes_total",
+		"Bytes of response bodies sent.")
+	uploadSizes = metricsRegistry.NewHistogram("http_upload_size_bytes",
+		"Sizes of the files saved by POST and PUT.", metrics.SizeBuckets)
+	rateLimited = metricsRegistry.NewCounter("http_rate_limited_total",
+		"Requests answered 429 Too Many Requests, by the limit that was reached: requests or upload_bytes.", "limit")
+	conditionalRequests = metricsRegistry.NewCounter("http_conditional_requests_total",
+		"GET and HEAD requests with If-None-Match or If-Modified-Since, by result: "+
+			"hit when the copy cached by the client was current and 304 Not Modified was sent, miss when the file was sent.", "result")
+)
+
+// watchedServer is the server whose connections and admission queue the gauges and readiness show, set by watchServer.
+var watchedServer atomic.Pointer[server]
+
+func init() {
+	stat := func(value func(s *server) float64) func() float64 {
+		return func() float64 {
+			if s := watchedServer.Load(); s != nil {
+				return value(s)
+			}
+			return 0
+		}
+	}
+	metricsRegistry.NewGaugeFunc("http_connections_active", "Connections being handled, HTTP/2 connections by their streams in progress.",
+		stat(func(s *server) float64 { return float64(s.admission.Stats().Active) }))
+	metricsRegistry.NewGaugeFunc("http_connections_limit", "Most connections handled at the same time.",
+		stat(func(s *server) float64 { return float64(s.admission.Stats().Limit) }))
+	metricsRegistry.NewGaugeFunc("http_requests_active", "Requests being answered.",
+		stat(func(s *server) float64 { return float64(s.activeRequests.Load()) }))
+	metricsRegistry.NewGaugeFunc("http_admission_queue_length", "Connections and HTTP/2 streams waiting for a free slot.",
+		stat(func(s *server) float64 { return float64(s.admission.Stats().Waiting) }))
+	metricsRegistry.NewGaugeFunc("http_admission_queue_size", "Most connections that may wait for a free slot.",
+		stat(func(s *server) float64 { return float64(s.admission.Stats().QueueSize) }))
+	metricsRegistry.NewCounterFunc("http_admission_rejected_total", "Connections and HTTP/2 streams answered 503 because the queue was full or the wait too long.",
+		stat(func(s *server) float64 { return float64(s.admission.Stats().Rejected) }))
+}
+
+// watchServer makes the gauges of connections and the admission queue, and the readiness endpoint, show s.
+func watchServer(s *server) {
+	watchedServer.Store(s)
+}
+
+// metricsMethods are the methods counted by name, others are counted as OTHER so clients can not create series at will.
+var metricsMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "DELETE": true, "OPTIONS": true,
+	"PATCH": true, "TRACE": true, "CONNECT": true,
+}
+
+// metricsMethod returns the method label of a request.
+func metricsMethod(method string) string {
+	if metricsMethods[method] {
+		return method
+	}
+	return "OTHER"
+}
+
+// recordRequest counts an answered request, its duration and the bytes of its response body.
+func recordRequest(request *http.Request, status int, written int64, start time.Time) {
+	method := metricsMethod(request.Method)
+	requestsTotal.Inc(method, strconv.Itoa(status))
+	requestDuration.Observe(time.Since(start).Seconds(), method)
+	if request.Method != "HEAD" {
+		// The body of a HEAD response is counted as written for the access log, but is never sent
+		responseBodyBytes.Add(float64(written))
+	}
+}
+
+// recordConditional counts a conditional GET or HEAD as a hit when it was answered 304 Not Modified.
+func recordConditional(request *http.Request, status int) {
+	if request.Header.Get("If-None-Match") == "" && request.Header.Get("If-Modified-Since") == "" {
+		return
+	}
+	if status == 304 {
+		conditionalRequests.Inc("hit")
+	} else {
+		conditionalRequests.Inc("miss")
+	}
+}
+
+/*
+handleMetrics answers a request for the metrics endpoint with the metrics in the text format of Prometheus.
+Only GET and HEAD are allowed. The endpoint is not a file, so a file of the same name in the document root is never served.
+*/
+func handleMetrics(response http.ResponseWriter, request *http.Request) error {
+	if request.Method != "GET" && request.Method != "HEAD" {
+		response.Header().Set("Allow", "GET, HEAD")
+		return giveResponse(response, 405)
+	}
+	var body bytes.Buffer
+	metricsRegistry.Write(&body)
+	response.Header().Set("Content-Type", metrics.ContentType)
+	response.Header().Set("Content-Length", strconv.Itoa(body.Len()))
+	response.Header().Set("Cache-Control", "no-store")
+	response.WriteHeader(200)
+	_, err := response.Write(body.Bytes())
+	return err
+}
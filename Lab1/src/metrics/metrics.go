@@ -0,0 +1,300 @@
+/*
+Package metrics keeps counters, gauges and histograms for the server and the proxy, and writes them
+in the text exposition format of Prometheus, so they can be scraped from a /metrics endpoint:
+
+	# HELP http_requests_total Requests answered, by method and status.
+	# TYPE http_requests_total counter
+	http_requests_total{method="GET",status="200"} 1027
+
+A metric can have labels, every combination of label values is a series of its own.
+Label values should come from a small set, such as methods and status codes, as every series is kept forever.
+*/
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the Content-Type of the text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DurationBuckets are histogram buckets for request durations in seconds, from 5ms to 10s.
+var DurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// SizeBuckets are histogram buckets for sizes in bytes, from 1KB to 1GB.
+var SizeBuckets = []float64{1 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20, 64 << 20, 256 << 20, 1 << 30}
+
+// metric is anything that a Registry can write.
+type metric interface {
+	write(out *bufio.Writer)
+}
+
+// Registry holds metrics and writes them in the order they were added. It is safe for concurrent use.
+type Registry struct {
+	mutex   sync.Mutex
+	metrics []metric
+	names   map[string]bool
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+// add registers a metric, the name must be unique in the registry.
+func (r *Registry) add(name string, m metric) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.names[name] {
+		panic("metrics: " + name + " is registered twice")
+	}
+	r.names[name] = true
+	r.metrics = append(r.metrics, m)
+}
+
+// Write writes all metrics to out in the text exposition format.
+func (r *Registry) Write(out io.Writer) error {
+	r.mutex.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mutex.Unlock()
+
+	buffered := bufio.NewWriter(out)
+	for _, m := range metrics {
+		m.write(buffered)
+	}
+	return buffered.Flush()
+}
+
+// desc is the name, help text and label names that every metric has.
+type desc struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+// writeHeader writes the HELP and TYPE lines of a metric.
+func (d *desc) writeHeader(out *bufio.Writer) {
+	help := strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(d.help)
+	fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n", d.name, help, d.name, d.kind)
+}
+
+// key joins label values into the key of a series, checking that there is a value for every label.
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s has labels %v, got values %v", d.name, d.labels, values))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// labelString formats the labels of a series as {a="1",b="2"}, with an extra label if extraName is not empty.
+func (d *desc) labelString(key string, extraName string, extraValue string) string {
+	var pairs []string
+	if len(d.labels) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			pairs = append(pairs, d.labels[i]+`="`+escapeLabel(value)+`"`)
+		}
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+`="`+extraValue+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// escapeLabel escapes backslashes, double quotes and newlines in a label value.
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// formatValue formats a sample value, with +Inf, -Inf and NaN spelled the way Prometheus expects.
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// sortedKeys returns the keys of the series of a metric in order, so the output is stable.
+func sortedKeys[V any](series map[string]V) []string {
+	keys := make([]string, 0, len(series))
+	for key := range series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Counter is a value that only goes up, such as the number of requests, with one series per combination of labels.
+type Counter struct {
+	desc
+	mutex  sync.Mutex
+	series map[string]float64
+}
+
+// NewCounter registers a counter with the given label names. A counter without labels starts at 0.
+func (r *Registry) NewCounter(name string, help string, labels ...string) *Counter {
+	c := &Counter{desc: desc{name, help, "counter", labels}, series: make(map[string]float64)}
+	if len(labels) == 0 {
+		c.series[""] = 0
+	}
+	r.add(name, c)
+	return c
+}
+
+// Inc adds one to the series with the label values.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds value, which must not be negative, to the series with the label values.
+func (c *Counter) Add(value float64, labelValues ...string) {
+	if value < 0 {
+		panic("metrics: counter " + c.name + " can not go down")
+	}
+	key := c.key(labelValues)
+	c.mutex.Lock()
+	c.series[key] += value
+	c.mutex.Unlock()
+}
+
+// Value returns the value of the series with the label values.
+func (c *Counter) Value(labelValues ...string) float64 {
+	key := c.key(labelValues)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.series[key]
+}
+
+func (c *Counter) write(out *bufio.Writer) {
+	c.writeHeader(out)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, key := range sortedKeys(c.series) {
+		fmt.Fprintf(out, "%s%s %s\n", c.name, c.labelString(key, "", ""), formatValue(c.series[key]))
+	}
+}
+
+/*
+Func is a metric without labels whose value is read when the metrics are written,
+for values that are kept elsewhere, such as the connections the admission controller lets in.
+*/
+type Func struct {
+	desc
+	value func() float64
+}
+
+// NewGaugeFunc registers a gauge, a value that goes up and down, read from value.
+func (r *Registry) NewGaugeFunc(name string, help string, value func() float64) *Func {
+	f := &Func{desc: desc{name: name, help: help, kind: "gauge"}, value: value}
+	r.add(name, f)
+	return f
+}
+
+// NewCounterFunc registers a counter read from value, which must only go up.
+func (r *Registry) NewCounterFunc(name string, help string, value func() float64) *Func {
+	f := &Func{desc: desc{name: name, help: help, kind: "counter"}, value: value}
+	r.add(name, f)
+	return f
+}
+
+func (f *Func) write(out *bufio.Writer) {
+	f.writeHeader(out)
+	fmt.Fprintf(out, "%s %s\n", f.name, formatValue(f.value()))
+}
+
+/*
+Histogram counts observations, such as request durations, in buckets with an upper bound each.
+Like in Prometheus the buckets are cumulative: a bucket counts every observation up to its bound,
+and a last bucket of +Inf counts them all. The sum and count of the observations are kept too.
+*/
+type Histogram struct {
+	desc
+	bounds []float64
+	mutex  sync.Mutex
+	series map[string]*histogramSeries
+}
+
+// histogramSeries is the state of one combination of labels of a histogram.
+type histogramSeries struct {
+	counts []uint64 // per bucket, not cumulative, the last one is +Inf
+	sum    float64
+	count  uint64
+}
+
+/*
+NewHistogram registers a histogram with the given bucket bounds, in increasing order, and label names.
+A histogram without labels starts with empty buckets.
+*/
+func (r *Registry) NewHistogram(name string, help string, bounds []float64, labels ...string) *Histogram {
+	if !sort.Float64sAreSorted(bounds) {
+		panic("metrics: the buckets of " + name + " are not in increasing order")
+	}
+	h := &Histogram{desc: desc{name, help, "histogram", labels}, bounds: bounds, series: make(map[string]*histogramSeries)}
+	if len(labels) == 0 {
+		h.series[""] = &histogramSeries{counts: make([]uint64, len(bounds)+1)}
+	}
+	r.add(name, h)
+	return h
+}
+
+// Observe adds value to the series with the label values.
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	key := h.key(labelValues)
+	bucket := sort.SearchFloat64s(h.bounds, value) // The first bound that is at least value
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	series := h.series[key]
+	if series == nil {
+		series = &histogramSeries{counts: make([]uint64, len(h.bounds)+1)}
+		h.series[key] = series
+	}
+	series.counts[bucket]++
+	series.sum += value
+	series.count++
+}
+
+// Count returns the number of observations of the series with the label values.
+func (h *Histogram) Count(labelValues ...string) uint64 {
+	key := h.key(labelValues)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if series := h.series[key]; series != nil {
+		return series.count
+	}
+	return 0
+}
+
+func (h *Histogram) write(out *bufio.Writer) {
+	h.writeHeader(out)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for _, key := range sortedKeys(h.series) {
+		series := h.series[key]
+		var cumulative uint64
+		for i, count := range series.counts {
+			cumulative += count
+			bound := math.Inf(1)
+			if i < len(h.bounds) {
+				bound = h.bounds[i]
+			}
+			fmt.Fprintf(out, "%s_bucket%s %d\n", h.name, h.labelString(key, "le", formatValue(bound)), cumulative)
+		}
+		fmt.Fprintf(out, "%s_sum%s %s\n", h.name, h.labelString(key, "", ""), formatValue(series.sum))
+		fmt.Fprintf(out, "%s_count%s %d\n", h.name, h.labelString(key, "", ""), series.count)
+	}
+}
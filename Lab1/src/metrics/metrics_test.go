@@ -0,0 +1,80 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	registry := NewRegistry()
+	requests := registry.NewCounter("http_requests_total", "Requests answered, by method and status.", "method", "status")
+	active := 3
+	registry.NewCounter("http_request_body_bytes_total", "Bytes of request bodies received.")
+	registry.NewGaugeFunc("http_connections_active", "Connections being handled.", func() float64 { return float64(active) })
+	durations := registry.NewHistogram("http_request_duration_seconds", "Time to answer a request.", []float64{0.1, 1})
+
+	requests.Inc("GET", "200")
+	requests.Inc("GET", "200")
+	requests.Add(1, "POST", "413")
+	requests.Inc("GET", `say "hi"`+"\n")
+	durations.Observe(0.05)
+	durations.Observe(0.1)
+	durations.Observe(5)
+
+	var out bytes.Buffer
+	if err := registry.Write(&out); err != nil {
+		t.Fatalf("Error writing the metrics: %v", err)
+	}
+	expected := `# HELP http_requests_total Requests answered, by method and status.
+# TYPE http_requests_total counter
+http_requests_total{method="GET",status="200"} 2
+http_requests_total{method="GET",status="say \"hi\"\n"} 1
+http_requests_total{method="POST",status="413"} 1
+# HELP http_request_body_bytes_total Bytes of request bodies received.
+# TYPE http_request_body_bytes_total counter
+http_request_body_bytes_total 0
+# HELP http_connections_active Connections being handled.
+# TYPE http_connections_active gauge
+http_connections_active 3
+# HELP http_request_duration_seconds Time to answer a request.
+# TYPE http_request_duration_seconds histogram
+http_request_duration_seconds_bucket{le="0.1"} 2
+http_request_duration_seconds_bucket{le="1"} 2
+http_request_duration_seconds_bucket{le="+Inf"} 3
+http_request_duration_seconds_sum 5.15
+http_request_duration_seconds_count 3
+`
+	if out.String() != expected {
+		t.Errorf("Unexpected output:\n%s\nwant\n%s", out.String(), expected)
+	}
+	if requests.Value("GET", "200") != 2 || durations.Count() != 3 {
+		t.Errorf("Unexpected values %v and %v", requests.Value("GET", "200"), durations.Count())
+	}
+}
+
+func TestMisuse(t *testing.T) {
+	registry := NewRegistry()
+	counter := registry.NewCounter("requests_total", "Requests.", "method")
+	tests := map[string]func(){
+		"registering a name twice": func() { registry.NewCounter("requests_total", "Again.") },
+		"missing label values":     func() { counter.Inc() },
+		"a counter going down":     func() { counter.Add(-1, "GET") },
+		"unsorted buckets":         func() { registry.NewHistogram("sizes", "Sizes.", []float64{2, 1}) },
+	}
+	for name, test := range tests {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Expected a panic for %s", name)
+				}
+			}()
+			test()
+		}()
+	}
+	var out bytes.Buffer
+	registry.Write(&out)
+	if strings.Contains(out.String(), "requests_total{") {
+		t.Errorf("A failed update created a series:\n%s", out.String())
+	}
+}
@@ -0,0 +1,256 @@
+/*
+Package mimetype maps file names to MIME types for the server, the proxy and the client.
+
+A Registry starts with a small built-in table and can load more mappings from files in the
+format of /etc/mime.types, one type per line followed by its extensions:
+
+	# comment
+	text/html;charset=utf-8    html htm
+	image/jpeg                 jpeg jpg
+
+Mappings can also be overridden for a single directory and everything below it, and the type of
+a file with an unknown extension can be sniffed from its first 512 bytes.
+*/
+package mimetype
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// SniffLength is the number of bytes Sniff looks at.
+const SniffLength = 512
+
+// builtinTypes are the types every Registry starts with, extension -> type with parameters.
+var builtinTypes = map[string]string{
+	".html":  "text/html; charset=utf-8",
+	".txt":   "text/plain; charset=utf-8",
+	".css":   "text/css; charset=utf-8",
+	".js":    "text/javascript; charset=utf-8",
+	".json":  "application/json",
+	".gif":   "image/gif",
+	".jpeg":  "image/jpeg",
+	".jpg":   "image/jpeg",
+	".png":   "image/png",
+	".svg":   "image/svg+xml",
+	".webp":  "image/webp",
+	".ico":   "image/x-icon",
+	".pdf":   "application/pdf",
+	".woff":  "font/woff",
+	".woff2": "font/woff2",
+	".mp4":   "video/mp4",
+}
+
+// Registry maps file extensions to MIME types. It is safe for concurrent use.
+type Registry struct {
+	mutex     sync.RWMutex
+	types     map[string]string            // extension -> type
+	known     map[string]string            // media type without parameters -> type with parameters
+	overrides map[string]map[string]string // directory -> extension -> type
+}
+
+// New returns a Registry with the built-in types.
+func New() *Registry {
+	registry := &Registry{
+		types:     make(map[string]string),
+		known:     make(map[string]string),
+		overrides: make(map[string]map[string]string),
+	}
+	for extension, contentType := range builtinTypes {
+		registry.Add(extension, contentType)
+	}
+	return registry
+}
+
+/*
+Add maps a file extension such as ".html" to a type such as "text/html; charset=utf-8".
+The extension may be given with or without the leading dot, and is matched case-insensitively.
+*/
+func (r *Registry) Add(extension string, contentType string) error {
+	contentType, err := normalize(contentType)
+	if err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.types[normalizeExtension(extension)] = contentType
+	r.known[MediaType(contentType)] = contentType
+	return nil
+}
+
+// AddOverride maps an extension to a type for the files in dir and its subdirectories only.
+func (r *Registry) AddOverride(dir string, extension string, contentType string) error {
+	contentType, err := normalize(contentType)
+	if err != nil {
+		return err
+	}
+	dir = filepath.Clean(dir)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.overrides[dir] == nil {
+		r.overrides[dir] = make(map[string]string)
+	}
+	r.overrides[dir][normalizeExtension(extension)] = contentType
+	r.known[MediaType(contentType)] = contentType
+	return nil
+}
+
+// Load reads mappings in mime.types format and adds them to the registry.
+func (r *Registry) Load(reader io.Reader) error {
+	return parse(reader, r.Add)
+}
+
+// LoadFile reads a mime.types file and adds its mappings to the registry.
+func (r *Registry) LoadFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := r.Load(file); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// LoadOverrideFile reads a mime.types file whose mappings only apply to dir and its subdirectories.
+func (r *Registry) LoadOverrideFile(dir string, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	err = parse(file, func(extension string, contentType string) error {
+		return r.AddOverride(dir, extension, contentType)
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// TypeByExtension returns the type of an extension such as ".html", and whether it is known.
+func (r *Registry) TypeByExtension(extension string) (string, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	contentType, ok := r.types[normalizeExtension(extension)]
+	return contentType, ok
+}
+
+/*
+TypeByPath returns the type of a file from its extension, and whether it is known.
+An override for the directory of the file, or the closest directory above it, wins over the general mapping.
+*/
+func (r *Registry) TypeByPath(path string) (string, bool) {
+	extension := normalizeExtension(filepath.Ext(path))
+	if extension == "." {
+		return "", false
+	}
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if len(r.overrides) > 0 {
+		for dir := filepath.Dir(filepath.Clean(path)); ; dir = filepath.Dir(dir) {
+			if contentType, ok := r.overrides[dir][extension]; ok {
+				return contentType, true
+			}
+			if dir == filepath.Dir(dir) {
+				break
+			}
+		}
+	}
+	contentType, ok := r.types[extension]
+	return contentType, ok
+}
+
+/*
+Lookup returns the registered type for a media type such as "text/html" or "text/html; charset=utf-8",
+with the parameters the registry uses, and whether the media type is known.
+*/
+func (r *Registry) Lookup(mediaType string) (string, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	contentType, ok := r.known[MediaType(mediaType)]
+	return contentType, ok
+}
+
+/*
+DetectFile returns the type of a file from its extension, or when the extension is unknown
+by sniffing the first 512 bytes of the file. The boolean is false if neither gives a type,
+in which case the type is "application/octet-stream".
+*/
+func (r *Registry) DetectFile(path string) (string, bool, error) {
+	if contentType, ok := r.TypeByPath(path); ok {
+		return contentType, true, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return "", false, err
+	}
+	defer file.Close()
+	buffer := make([]byte, SniffLength)
+	n, err := io.ReadFull(file, buffer)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", false, err
+	}
+	contentType := Sniff(buffer[:n])
+	return contentType, MediaType(contentType) != "application/octet-stream", nil
+}
+
+// Sniff returns the type of data, found from at most its first 512 bytes.
+func Sniff(data []byte) string {
+	return http.DetectContentType(data)
+}
+
+// MediaType returns the type without parameters in lower case, "text/html; charset=utf-8" gives "text/html".
+func MediaType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType, _, _ = strings.Cut(contentType, ";")
+		return strings.ToLower(strings.TrimSpace(mediaType))
+	}
+	return mediaType
+}
+
+// parse reads lines of mime.types format and calls add for every extension.
+func parse(reader io.Reader, add func(extension string, contentType string) error) error {
+	scanner := bufio.NewScanner(reader)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		for _, extension := range fields[1:] {
+			if err := add(extension, fields[0]); err != nil {
+				return fmt.Errorf("line %d: %v", line, err)
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// normalize checks a type and writes it the way it is sent in Content-Type headers.
+func normalize(contentType string) (string, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", fmt.Errorf("invalid type %q: %v", contentType, err)
+	}
+	if !strings.Contains(mediaType, "/") {
+		return "", fmt.Errorf("invalid type %q: missing subtype", contentType)
+	}
+	return mime.FormatMediaType(mediaType, params), nil
+}
+
+// normalizeExtension returns the extension in lower case with a leading dot.
+func normalizeExtension(extension string) string {
+	return "." + strings.ToLower(strings.TrimPrefix(extension, "."))
+}
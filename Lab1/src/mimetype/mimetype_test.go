@@ -0,0 +1,77 @@
+package mimetype
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	registry := New()
+	err := registry.Load(strings.NewReader(`
+# comment line
+text/html;charset=iso-8859-1  html htm   # trailing comment
+application/json              json
+`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	tests := map[string]string{
+		"site.html":           "text/html; charset=iso-8859-1",
+		"old/INDEX.HTM":       "text/html; charset=iso-8859-1",
+		"data.json":           "application/json",
+		"dog.jpeg":            "image/jpeg",
+		"styles.css":          "text/css; charset=utf-8",
+		"archive.unknownext":  "",
+		"no_extension_at_all": "",
+	}
+	for path, expected := range tests {
+		if contentType, _ := registry.TypeByPath(path); contentType != expected {
+			t.Errorf("TypeByPath(%q) = %q, expected %q", path, contentType, expected)
+		}
+	}
+
+	if contentType, ok := registry.Lookup("Application/JSON; charset=utf-8"); !ok || contentType != "application/json" {
+		t.Errorf("Lookup of application/json gave %q, %v", contentType, ok)
+	}
+	if _, ok := registry.Lookup("application/x-unknown"); ok {
+		t.Errorf("Expected application/x-unknown to be unknown")
+	}
+	if err := registry.Load(strings.NewReader("not-a-type ext")); err == nil {
+		t.Errorf("Expected an error for a type without subtype")
+	}
+}
+
+func TestOverrides(t *testing.T) {
+	registry := New()
+	registry.AddOverride("files/downloads", "html", "text/plain")
+
+	if contentType, _ := registry.TypeByPath("files/downloads/page.html"); contentType != "text/plain" {
+		t.Errorf("Expected the override in the directory, got %q", contentType)
+	}
+	if contentType, _ := registry.TypeByPath("files/downloads/old/page.html"); !strings.HasPrefix(contentType, "text/plain") {
+		t.Errorf("Expected the override in a subdirectory, got %q", contentType)
+	}
+	if contentType, _ := registry.TypeByPath("files/page.html"); !strings.HasPrefix(contentType, "text/html") {
+		t.Errorf("Expected no override outside the directory, got %q", contentType)
+	}
+}
+
+func TestDetectFile(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "page"), []byte("<!DOCTYPE html><html><body>hi</body></html>"), 0644)
+	os.WriteFile(filepath.Join(dir, "blob"), []byte{0x00, 0x01, 0x02, 0xff}, 0644)
+	registry := New()
+
+	if contentType, ok, err := registry.DetectFile(filepath.Join(dir, "page")); err != nil || !ok || MediaType(contentType) != "text/html" {
+		t.Errorf("Expected html to be sniffed, got %q, %v, %v", contentType, ok, err)
+	}
+	if contentType, ok, err := registry.DetectFile(filepath.Join(dir, "blob")); err != nil || ok {
+		t.Errorf("Expected binary data to be unknown, got %q, %v, %v", contentType, ok, err)
+	}
+	if _, _, err := registry.DetectFile(filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("Expected an error for a missing file")
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// errBadPath is returned by resolvePath for a request URI that is not a valid path inside the document root.
+var errBadPath = errors.New("invalid request path")
+
+// errForbiddenPath is returned by resolvePath when a symbolic link leads outside the document root.
+var errForbiddenPath = errors.New("request path leaves the document root")
+
+/*
+resolvePath turns a request URI into the path of a file inside root, the path from cleanPath below root.
+A path with a NUL byte, or with ".." segments that climb above root, returns errBadPath.
+Symbolic links are followed, and if the file (or for a new file the directory it would be created in)
+is outside root errForbiddenPath is returned. Both GET and upload requests use this, so no request
+can read or write a file outside the document root.
+*/
+func resolvePath(root string, requestURI string) (string, error) {
+	cleaned, err := cleanPath(requestURI)
+	if err != nil {
+		return "", err
+	}
+	fullPath := filepath.Join(root, filepath.FromSlash(strings.TrimPrefix(cleaned, "/")))
+
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	realPath, err := evalExistingSymlinks(fullPath)
+	if err != nil {
+		return "", err
+	}
+	if !isWithin(realRoot, realPath) {
+		return "", errForbiddenPath
+	}
+	return fullPath, nil
+}
+
+/*
+cleanPath returns the path of a request URI with the query string removed, percent-decoded and
+its dot segments cleaned, "//x/../private%2Fnotes.txt" becomes "/private/notes.txt".
+A path with a NUL byte, or with ".." segments that climb above the root, returns errBadPath.
+*/
+func cleanPath(requestURI string) (string, error) {
+	rawPath, _, _ := strings.Cut(requestURI, "?")
+	if strings.Contains(rawPath, "://") {
+		// Absolute form "http://host/path", as sent to proxies
+		parsed, err := url.Parse(rawPath)
+		if err != nil {
+			return "", errBadPath
+		}
+		rawPath = parsed.EscapedPath()
+	}
+
+	decoded, err := url.PathUnescape(rawPath)
+	if err != nil || !strings.HasPrefix(decoded, "/") || strings.ContainsRune(decoded, 0) {
+		return "", errBadPath
+	}
+
+	// Clean the path relative to the root, so ".." segments that leave the root remain visible
+	relative := path.Clean(strings.TrimLeft(decoded, "/"))
+	if relative == ".." || strings.HasPrefix(relative, "../") {
+		return "", errBadPath
+	}
+	if relative == "." {
+		return "/", nil
+	}
+	return "/" + relative, nil
+}
+
+/*
+requestPath returns the path the rules for paths are matched against, the cleaned path of the file
+the request is for. A path resolvePath refuses is returned as it was sent, the request is refused later anyway.
+*/
+func requestPath(request *http.Request) string {
+	cleaned, err := cleanPath(request.RequestURI)
+	if err != nil {
+		return request.URL.Path
+	}
+	return cleaned
+}
+
+/*
+evalExistingSymlinks follows the symbolic links in the longest part of filePath that exists,
+and appends the rest, that does not exist yet and so can not be a link.
+*/
+func evalExistingSymlinks(filePath string) (string, error) {
+	realPath, err := filepath.EvalSymlinks(filePath)
+	if err == nil {
+		return realPath, nil
+	}
+	if !isNotExist(err) {
+		return "", err
+	}
+	parent := filepath.Dir(filePath)
+	if parent == filePath {
+		return filePath, nil
+	}
+	realParent, err := evalExistingSymlinks(parent)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(realParent, filepath.Base(filePath)), nil
+}
+
+/*
+isNotExist reports whether err says that a file does not exist. Besides a missing file this is a path
+that goes through a regular file, such as "site.html/x.txt", which fails with ENOTDIR.
+*/
+func isNotExist(err error) bool {
+	return os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR)
+}
+
+// isWithin reports whether filePath is root or a path below root.
+func isWithin(root string, filePath string) bool {
+	relative, err := filepath.Rel(root, filePath)
+	if err != nil {
+		return false
+	}
+	return relative != ".." && !strings.HasPrefix(relative, ".."+string(filepath.Separator))
+}
+
+// pathErrorStatus returns the status code to answer for an error from resolvePath.
+func pathErrorStatus(err error) int {
+	switch err {
+	case errBadPath:
+		return 400
+	case errForbiddenPath:
+		return 403
+	default:
+		return 500
+	}
+}
+
+// isHiddenPath reports whether a file or directory below root on the path has a name starting with a dot.
+func isHiddenPath(root string, filePath string) bool {
+	relative, err := filepath.Rel(root, filePath)
+	if err != nil || relative == "." {
+		return false
+	}
+	for _, name := range strings.Split(filepath.ToSlash(relative), "/") {
+		if strings.HasPrefix(name, ".") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxRanges is the most ranges accepted in one Range header, more are answered with the whole file.
+const maxRanges = 100
+
+// errNoOverlap is returned by parseRange when none of the requested ranges is inside the file.
+var errNoOverlap = errors.New("invalid range: failed to overlap")
+
+// byteRange is a part of a file, starting at start and length bytes long.
+type byteRange struct {
+	start  int64
+	length int64
+}
+
+// contentRange returns the value for the Content-Range header of the range in a file of size bytes.
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+/*
+parseRange parses a Range header such as "bytes=0-99,200-,-50" for a file of size bytes.
+Ranges that start after the end of the file are dropped, and errNoOverlap is returned if no range is left.
+A header with invalid syntax, also one without any range, returns another error, the header must then be ignored
+and the whole file sent.
+*/
+func parseRange(header string, size int64) ([]byteRange, error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) {
+		return nil, errors.New("invalid range: unknown unit")
+	}
+	var ranges []byteRange
+	specs := 0
+	overlaps := false
+	for _, part := range strings.Split(header[len(prefix):], ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		specs++
+		first, last, found := strings.Cut(part, "-")
+		if !found {
+			return nil, errors.New("invalid range: missing '-'")
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+		var r byteRange
+		if first == "" {
+			// Suffix range "-n" means the last n bytes
+			n, err := parsePosition(last)
+			if err != nil || n < 0 {
+				return nil, errors.New("invalid range: bad suffix length")
+			}
+			if n > size {
+				n = size
+			}
+			if n == 0 {
+				continue // "-0", or any suffix of an empty file, is not satisfiable
+			}
+			r = byteRange{start: size - n, length: n}
+		} else {
+			start, err := parsePosition(first)
+			if err != nil || start < 0 {
+				return nil, errors.New("invalid range: bad start")
+			}
+			end := size - 1
+			if last != "" {
+				end, err = parsePosition(last)
+				if err != nil || end < start {
+					return nil, errors.New("invalid range: bad end")
+				}
+			}
+			if start >= size {
+				continue // Not satisfiable, but other ranges may be
+			}
+			if end >= size {
+				end = size - 1
+			}
+			r = byteRange{start: start, length: end - start + 1}
+		}
+		overlaps = true
+		ranges = append(ranges, r)
+	}
+	if specs == 0 {
+		return nil, errors.New("invalid range: no ranges")
+	}
+	if !overlaps {
+		return nil, errNoOverlap
+	}
+	return ranges, nil
+}
+
+// parsePosition reads a byte position of a range. A number too large for an int64 is beyond the end
+// of any file, it becomes math.MaxInt64 and is clamped to the size like any other position past the end.
+func parsePosition(text string) (int64, error) {
+	n, err := strconv.ParseInt(text, 10, 64)
+	if errors.Is(err, strconv.ErrRange) && !strings.HasPrefix(text, "-") {
+		return math.MaxInt64, nil
+	}
+	return n, err
+}
+
+/*
+checkIfRange reports whether the Range header should be used, according to the If-Range header.
+Without If-Range it always is. An entity tag must be the strong tag of the file,
+a date must be the exact modification time of the file.
+*/
+func checkIfRange(request *http.Request, etag string, modTime time.Time) bool {
+	value := request.Header.Get("If-Range")
+	if value == "" {
+		return true
+	}
+	if strings.HasPrefix(value, `"`) || strings.HasPrefix(value, "W/") {
+		return etagsEqual(value, etag, true)
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return false
+	}
+	return date.Equal(modTime.Truncate(time.Second))
+}
+
+/*
+sendFileContents streams an open file as the response to a GET request.
+Without a usable Range header the whole file is sent with 200 OK. A single range is sent as 206 Partial Content
+with a Content-Range header, several ranges as a multipart/byteranges body. Ranges outside the file give 416.
+The bytes are copied from the file to the connection without reading the whole file into memory.
+*/
+func sendFileContents(response http.ResponseWriter, request *http.Request, file *os.File, size int64, contentType string, etag string, modTime time.Time) error {
+	response.Header().Set("Accept-Ranges", "bytes")
+
+	var ranges []byteRange
+	if rangeHeader := request.Header.Get("Range"); rangeHeader != "" && checkIfRange(request, etag, modTime) {
+		var err error
+		ranges, err = parseRange(rangeHeader, size)
+		if err == errNoOverlap {
+			response.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			return giveResponse(response, 416)
+		}
+		if err != nil || len(ranges) > maxRanges || sumRanges(ranges) > size {
+			ranges = nil // Ignore the header and send everything
+		}
+	}
+
+	switch len(ranges) {
+	case 0:
+		response.Header().Set("Content-Type", contentType)
+		response.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		response.WriteHeader(200)
+		return sendResponseFile(response, file, byteRange{start: 0, length: size})
+
+	case 1:
+		r := ranges[0]
+		response.Header().Set("Content-Type", contentType)
+		response.Header().Set("Content-Range", r.contentRange(size))
+		response.Header().Set("Content-Length", strconv.FormatInt(r.length, 10))
+		response.WriteHeader(206)
+		return sendResponseFile(response, file, r)
+
+	default:
+		// The length of the multipart body is found by writing it once without the file contents
+		boundary := multipart.NewWriter(io.Discard).Boundary()
+		counter := &countingWriter{}
+		if err := writeByteRanges(counter, boundary, ranges, size, contentType, nil); err != nil {
+			return err
+		}
+
+		response.Header().Set("Content-Type", "multipart/byteranges; boundary="+boundary)
+		response.Header().Set("Content-Length", strconv.FormatInt(counter.count, 10))
+		response.WriteHeader(206)
+		return writeByteRanges(response, boundary, ranges, size, contentType, file)
+	}
+}
+
+/*
+writeByteRanges writes the ranges of a file as a multipart/byteranges body.
+If file is nil only the part headers are written and the ranges are counted, which gives the body length.
+*/
+func writeByteRanges(writer io.Writer, boundary string, ranges []byteRange, size int64, contentType string, file *os.File) error {
+	counter, counting := writer.(*countingWriter)
+	parts := multipart.NewWriter(writer)
+	parts.SetBoundary(boundary)
+	for _, r := range ranges {
+		part, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":  {contentType},
+			"Content-Range": {r.contentRange(size)},
+		})
+		if err != nil {
+			return err
+		}
+		if counting {
+			counter.count += r.length
+		} else if _, err := io.Copy(part, io.NewSectionReader(file, r.start, r.length)); err != nil {
+			return err
+		}
+	}
+	return parts.Close()
+}
+
+// countingWriter counts the bytes written to it and throws them away.
+type countingWriter struct {
+	count int64
+}
+
+func (w *countingWriter) Write(data []byte) (int, error) {
+	w.count += int64(len(data))
+	return len(data), nil
+}
+
+// sumRanges returns the number of bytes in all ranges together.
+func sumRanges(ranges []byteRange) int64 {
+	var sum int64
+	for _, r := range ranges {
+		sum += r.length
+	}
+	return sum
+}
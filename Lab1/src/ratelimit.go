@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"http_server/ratelimit"
+)
+
+/*
+rateLimit is how fast a client may make requests below a path prefix, and send upload bytes.
+Requests is the number per second with at most Burst at once, UploadRate the bytes per second with
+UploadBurst at once. A zero rate leaves that limit out.
+*/
+type rateLimit struct {
+	Requests    float64  `json:"requests"`
+	Burst       int      `json:"burst"`
+	UploadRate  byteSize `json:"upload_rate,omitempty"`
+	UploadBurst byteSize `json:"upload_burst,omitempty"`
+}
+
+// String writes the limit as "requests:burst", with ":upload rate:upload burst" when uploads are limited.
+func (l rateLimit) String() string {
+	text := strconv.FormatFloat(l.Requests, 'f', -1, 64) + ":" + strconv.Itoa(l.Burst)
+	if l.UploadRate != 0 {
+		text += ":" + l.UploadRate.String() + ":" + l.UploadBurst.String()
+	}
+	return text
+}
+
+/*
+rateLimitMap maps path prefixes to rate limits, written as "/=10:20,/upload=2:5:1MB:10MB" on the command line:
+10 requests per second with bursts of 20 for the whole site, and below /upload 2 per second with bursts of 5
+and 1MB per second of uploads with bursts of 10MB. The longest prefix that matches a path decides.
+*/
+type rateLimitMap map[string]rateLimit
+
+func (m *rateLimitMap) String() string {
+	var items []string
+	for prefix, limit := range *m {
+		items = append(items, prefix+"="+limit.String())
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
+
+func (m *rateLimitMap) Set(value string) error {
+	*m = rateLimitMap{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		prefix, text, found := strings.Cut(item, "=")
+		parts := strings.Split(text, ":")
+		if !found || (len(parts) != 2 && len(parts) != 4) {
+			return fmt.Errorf("invalid rate limit %q, expected path=requests:burst or path=requests:burst:upload rate:upload burst", item)
+		}
+		var limit rateLimit
+		var err error
+		if limit.Requests, err = strconv.ParseFloat(strings.TrimSpace(parts[0]), 64); err != nil {
+			return fmt.Errorf("invalid rate limit %q: %v", item, err)
+		}
+		if limit.Burst, err = strconv.Atoi(strings.TrimSpace(parts[1])); err != nil {
+			return fmt.Errorf("invalid rate limit %q: %v", item, err)
+		}
+		if len(parts) == 4 {
+			if err := limit.UploadRate.Set(parts[2]); err != nil {
+				return err
+			}
+			if err := limit.UploadBurst.Set(parts[3]); err != nil {
+				return err
+			}
+		}
+		(*m)[strings.TrimSpace(prefix)] = limit
+	}
+	return nil
+}
+
+// validateRateLimits checks the rate limits and returns all problems found.
+func (c serverConfig) validateRateLimits() []error {
+	var errs []error
+	for prefix, limit := range c.RateLimits {
+		if !strings.HasPrefix(prefix, "/") {
+			errs = append(errs, fmt.Errorf("rate limit path must start with /, got %q", prefix))
+		}
+		if limit.Requests < 0 || (limit.Requests > 0 && limit.Burst < 1) {
+			errs = append(errs, fmt.Errorf("rate limit for %s: requests can not be negative and the burst must be at least 1, got %s", prefix, limit))
+		}
+		if limit.UploadRate < 0 || (limit.UploadRate > 0 && limit.UploadBurst < 1) {
+			errs = append(errs, fmt.Errorf("rate limit for %s: upload rate can not be negative and the upload burst must be positive, got %s", prefix, limit))
+		}
+	}
+	return errs
+}
+
+// rateLimiter holds the buckets of the clients for the requests and upload bytes below a path prefix.
+type rateLimiter struct {
+	prefix   string
+	requests *ratelimit.Limiter // nil when requests are not limited
+	uploads  *ratelimit.Limiter // nil when upload bytes are not limited
+}
+
+/*
+rateLimiters are the limiters of the configuration, set up by main, with the longest prefix first,
+the order they are matched in.
+*/
+var rateLimiters []*rateLimiter
+
+// newRateLimiters creates the limiters of the rate limits in c.
+func newRateLimiters(c serverConfig) []*rateLimiter {
+	var limiters []*rateLimiter
+	for prefix, limit := range c.RateLimits {
+		limiter := &rateLimiter{prefix: prefix}
+		if limit.Requests > 0 {
+			limiter.requests = ratelimit.New(limit.Requests, float64(limit.Burst))
+		}
+		if limit.UploadRate > 0 {
+			limiter.uploads = ratelimit.New(float64(limit.UploadRate), float64(limit.UploadBurst))
+		}
+		limiters = append(limiters, limiter)
+	}
+	sort.Slice(limiters, func(i, j int) bool {
+		return len(limiters[i].prefix) > len(limiters[j].prefix)
+	})
+	return limiters
+}
+
+// findRateLimiter returns the limiter with the longest prefix of path, or nil when no limit applies.
+func findRateLimiter(path string) *rateLimiter {
+	for _, limiter := range rateLimiters {
+		if matchesPrefix(path, limiter.prefix) {
+			return limiter
+		}
+	}
+	return nil
+}
+
+/*
+allowRate counts a request against the rate limits of its cleaned path and reports whether it may go on.
+A request made by an authenticated user is counted for that user, others for the IP address of the client.
+The RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers tell the client about its request limit.
+A client over a limit gets 429 Too Many Requests with a Retry-After header.
+An upload takes as many tokens as its Content-Length from the bucket of upload bytes, and one without a length
+takes its bytes as they arrive. A bucket that has been used up must refill before the next upload may start,
+a single upload larger than the burst is allowed from a full bucket and leaves it in debt.
+*/
+func allowRate(response http.ResponseWriter, request *http.Request, user string) bool {
+	limiter := findRateLimiter(requestPath(request))
+	if limiter == nil {
+		return true
+	}
+	key := "ip:" + clientIP(request)
+	if user != "" {
+		key = "user:" + user
+	}
+	if limiter.requests != nil {
+		decision := limiter.requests.Allow(key, 1)
+		header := response.Header()
+		header.Set("RateLimit-Limit", strconv.FormatFloat(decision.Limit, 'f', 0, 64))
+		header.Set("RateLimit-Remaining", strconv.FormatFloat(math.Floor(decision.Remaining), 'f', 0, 64))
+		header.Set("RateLimit-Reset", strconv.Itoa(seconds(decision.Reset)))
+		if !decision.Allowed {
+			return tooManyRequests(response, request, key, "requests", decision.RetryAfter)
+		}
+	}
+	if limiter.uploads != nil && (request.Method == "POST" || request.Method == "PUT") {
+		size := max(request.ContentLength, 0)
+		decision := limiter.uploads.Allow(key, float64(size))
+		if !decision.Allowed {
+			response.Header().Set("Connection", "close") // The client may still be sending the body
+			return tooManyRequests(response, request, key, "upload_bytes", decision.RetryAfter)
+		}
+		if request.ContentLength < 0 {
+			request.Body = &meteredBody{ReadCloser: request.Body, limiter: limiter.uploads, key: key}
+		}
+	}
+	return true
+}
+
+// tooManyRequests answers 429 Too Many Requests to a client over a limit, which may try again after retryAfter.
+func tooManyRequests(response http.ResponseWriter, request *http.Request, key string, limit string, retryAfter time.Duration) bool {
+	requestLogger(request).Info("Rate limit reached", "client", key, "limit", limit, "retry_after", retryAfter)
+	rateLimited.Inc(limit)
+	response.Header().Set("Retry-After", strconv.Itoa(max(seconds(retryAfter), 1)))
+	giveResponse(response, 429)
+	return false
+}
+
+// seconds returns a duration in whole seconds, rounded up as the headers of rate limits are.
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// meteredBody is the body of an upload without a Content-Length, whose bytes are taken from a bucket as they are read.
+type meteredBody struct {
+	io.ReadCloser
+	limiter *ratelimit.Limiter
+	key     string
+}
+
+// Read reads from the body and takes the bytes read from the bucket of the client.
+func (b *meteredBody) Read(data []byte) (int, error) {
+	n, err := b.ReadCloser.Read(data)
+	if n > 0 {
+		b.limiter.Take(b.key, float64(n))
+	}
+	return n, err
+}
@@ -0,0 +1,146 @@
+/*
+Package ratelimit limits how fast clients may make requests or send bytes, with a token bucket per client.
+
+A bucket holds at most Burst tokens and refills at Rate tokens per second. A request takes tokens from
+the bucket of its client, and is refused while there are not enough, with the time after which there will be.
+Buckets of clients that have been idle long enough to be full again are removed, a full bucket is the same as none,
+so the memory a Limiter uses grows with the clients that are active, not with all clients ever seen.
+*/
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// DefaultSweepInterval is how often a Limiter looks for buckets to remove, at most.
+const DefaultSweepInterval = time.Minute
+
+/*
+Limiter holds a token bucket for every client key, such as an IP address or a user name.
+It is safe for concurrent use.
+*/
+type Limiter struct {
+	Rate          float64 // tokens added per second
+	Burst         float64 // most tokens a bucket holds
+	SweepInterval time.Duration
+
+	now func() time.Time // the clock, replaced by tests
+
+	mutex   sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time // when full buckets were last removed
+}
+
+// bucket is the state of one client: its tokens at the time of the last update.
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// Decision is the outcome of Allow, with what the RateLimit headers of a response tell the client.
+type Decision struct {
+	Allowed    bool
+	Limit      float64       // tokens of a full bucket
+	Remaining  float64       // tokens left after the request, 0 when it was refused or the bucket is in debt
+	Reset      time.Duration // until the bucket is full again
+	RetryAfter time.Duration // until the request would be allowed, 0 when it was
+}
+
+// New returns a Limiter whose buckets hold burst tokens and refill at rate tokens per second.
+func New(rate float64, burst float64) *Limiter {
+	return &Limiter{
+		Rate:          rate,
+		Burst:         burst,
+		SweepInterval: DefaultSweepInterval,
+		now:           time.Now,
+		buckets:       make(map[string]*bucket),
+	}
+}
+
+/*
+Allow takes n tokens from the bucket of key if it has them, or as many as a full bucket has when n is more,
+so a cost larger than the burst is allowed from a full bucket and leaves it in debt for the rest.
+A refused request takes no tokens.
+*/
+func (l *Limiter) Allow(key string, n float64) Decision {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.now()
+	l.sweep(now)
+	b := l.bucket(key, now)
+
+	needed := math.Min(n, l.Burst)
+	if b.tokens < needed {
+		return Decision{
+			Limit:      l.Burst,
+			Reset:      l.duration(l.Burst - b.tokens),
+			RetryAfter: l.duration(needed - b.tokens),
+		}
+	}
+	b.tokens -= n
+	return Decision{
+		Allowed:   true,
+		Limit:     l.Burst,
+		Remaining: math.Max(0, b.tokens),
+		Reset:     l.duration(l.Burst - b.tokens),
+	}
+}
+
+/*
+Take takes n tokens from the bucket of key whether it has them or not, for a cost that is only known as it comes in,
+such as the bytes of an upload without a Content-Length. The bucket may go into debt, which later requests wait for.
+*/
+func (l *Limiter) Take(key string, n float64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	b := l.bucket(key, l.now())
+	b.tokens -= n
+}
+
+// Len returns the number of clients that have a bucket.
+func (l *Limiter) Len() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return len(l.buckets)
+}
+
+// bucket returns the bucket of key, refilled until now. A client without one gets a full bucket.
+func (l *Limiter) bucket(key string, now time.Time) *bucket {
+	b, found := l.buckets[key]
+	if !found {
+		b = &bucket{tokens: l.Burst, updated: now}
+		l.buckets[key] = b
+		return b
+	}
+	if elapsed := now.Sub(b.updated).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(l.Burst, b.tokens+elapsed*l.Rate)
+		b.updated = now
+	}
+	return b
+}
+
+// duration returns how long the bucket takes to refill tokens.
+func (l *Limiter) duration(tokens float64) time.Duration {
+	if tokens <= 0 {
+		return 0
+	}
+	if l.Rate <= 0 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(tokens / l.Rate * float64(time.Second))
+}
+
+// sweep removes the buckets that are full again, at most once per SweepInterval.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < l.SweepInterval {
+		return
+	}
+	l.swept = now
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.updated).Seconds()*l.Rate >= l.Burst {
+			delete(l.buckets, key)
+		}
+	}
+}
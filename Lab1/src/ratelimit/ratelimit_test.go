@@ -0,0 +1,86 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// clock is a time that the tests move forward by hand.
+type clock struct {
+	time time.Time
+}
+
+func (c *clock) now() time.Time {
+	return c.time
+}
+
+// newTestLimiter returns a Limiter that runs on a clock of the test.
+func newTestLimiter(rate float64, burst float64) (*Limiter, *clock) {
+	c := &clock{time: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	l := New(rate, burst)
+	l.now = c.now
+	return l, c
+}
+
+func TestAllow(t *testing.T) {
+	l, c := newTestLimiter(2, 3)
+	for i := 0; i < 3; i++ {
+		if d := l.Allow("a", 1); !d.Allowed || d.Remaining != float64(2-i) || d.Limit != 3 {
+			t.Fatalf("Expected request %d of the burst to be allowed, got %+v", i, d)
+		}
+	}
+	d := l.Allow("a", 1)
+	if d.Allowed || d.RetryAfter != 500*time.Millisecond || d.Reset != 1500*time.Millisecond {
+		t.Errorf("Expected the fourth request to wait half a second, got %+v", d)
+	}
+	if d := l.Allow("b", 1); !d.Allowed {
+		t.Errorf("Expected another client to have a bucket of its own")
+	}
+
+	c.time = c.time.Add(500 * time.Millisecond)
+	if d := l.Allow("a", 1); !d.Allowed || d.Remaining != 0 {
+		t.Errorf("Expected a token after half a second, got %+v", d)
+	}
+	c.time = c.time.Add(time.Hour)
+	if d := l.Allow("a", 1); !d.Allowed || d.Remaining != 2 {
+		t.Errorf("Expected the bucket to refill to the burst and no further, got %+v", d)
+	}
+}
+
+func TestDebt(t *testing.T) {
+	l, c := newTestLimiter(100, 1000)
+	if d := l.Allow("a", 1500); !d.Allowed || d.Remaining != 0 || d.Reset != 15*time.Second {
+		t.Fatalf("Expected a cost over the burst to be allowed from a full bucket, got %+v", d)
+	}
+	if d := l.Allow("a", 1); d.Allowed || d.RetryAfter != 5010*time.Millisecond {
+		t.Errorf("Expected the debt to be paid off first, got %+v", d)
+	}
+	c.time = c.time.Add(6 * time.Second)
+	l.Take("a", 200)
+	if d := l.Allow("a", 1); d.Allowed {
+		t.Errorf("Expected the bytes taken to count, got %+v", d)
+	}
+}
+
+func TestSweep(t *testing.T) {
+	l, c := newTestLimiter(1, 2)
+	l.SweepInterval = time.Second
+	l.Allow("a", 1)
+	l.Allow("b", 2)
+	if l.Len() != 2 {
+		t.Fatalf("Expected two buckets, got %d", l.Len())
+	}
+	c.time = c.time.Add(1500 * time.Millisecond)
+	l.Allow("c", 1) // a is full again, b is not
+	if l.Len() != 2 {
+		t.Errorf("Expected the full bucket to be removed, got %d buckets", l.Len())
+	}
+	if d := l.Allow("b", 2); d.Allowed {
+		t.Errorf("Expected b to keep its state, got %+v", d)
+	}
+	c.time = c.time.Add(time.Hour)
+	l.Allow("d", 1)
+	if l.Len() != 1 {
+		t.Errorf("Expected only the new bucket to be left, got %d", l.Len())
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/*
+responseWriter writes a single HTTP/1.1 response to a connection.
+It implements http.ResponseWriter so the request handling code does not need to
+know how the status line and headers are put on the wire.
+It also keeps track of whether the connection can be reused for another request:
+a response without a Content-Length has to be delimited by closing the connection.
+*/
+type responseWriter struct {
+	writer        *bufio.Writer
+	request       *http.Request
+	header        http.Header
+	status        int
+	wroteHeader   bool
+	keepAlive     bool
+	contentLength int64 // -1 if the handler did not set a Content-Length
+	written       int64
+	err           error
+	continued     *continueReader // set when the client waits for 100 Continue before sending the body
+}
+
+// newResponseWriter creates a responseWriter for the given request that writes to writer.
+func newResponseWriter(writer *bufio.Writer, request *http.Request) *responseWriter {
+	return &responseWriter{
+		writer:        writer,
+		request:       request,
+		header:        make(http.Header),
+		keepAlive:     shouldKeepAlive(request),
+		contentLength: -1,
+	}
+}
+
+// Header returns the header map that will be sent by WriteHeader.
+func (w *responseWriter) Header() http.Header {
+	return w.header
+}
+
+/*
+WriteHeader sends the status line and the headers. Only the first call has an effect.
+The Connection header is added here, "close" when the connection will be closed after
+this response and "keep-alive" when an HTTP/1.0 client asked to keep it open.
+*/
+func (w *responseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.status = status
+
+	if length, err := strconv.ParseInt(w.header.Get("Content-Length"), 10, 64); err == nil {
+		w.contentLength = length
+	} else if w.hasBody() {
+		w.keepAlive = false // No length known, the end of the body is marked by closing the connection
+	}
+
+	if strings.EqualFold(w.header.Get("Connection"), "close") {
+		w.keepAlive = false // The handler asked to close the connection after this response
+	}
+	if w.continued != nil && !w.continued.sent {
+		// The client was not told to send its body, it is unknown whether it will, so nothing more can be read
+		w.keepAlive = false
+	}
+	if !w.keepAlive {
+		w.header.Set("Connection", "close")
+	} else if !w.request.ProtoAtLeast(1, 1) {
+		w.header.Set("Connection", "keep-alive")
+	}
+
+	_, err := fmt.Fprintf(w.writer, "HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+	if err == nil {
+		err = w.header.Write(w.writer)
+	}
+	if err == nil {
+		_, err = w.writer.WriteString("\r\n")
+	}
+	w.setError(err)
+}
+
+/*
+Write sends a part of the response body, sending the headers first if that has not been done.
+The body of a response to a HEAD request is counted as written but not sent.
+*/
+func (w *responseWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !bodyAllowed(w.status) {
+		return 0, http.ErrBodyNotAllowed
+	}
+	if w.request.Method == "HEAD" {
+		return len(data), nil
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.writer.Write(data)
+	w.written += int64(n)
+	w.setError(err)
+	return n, err
+}
+
+/*
+ReadFrom copies the response body from source. The buffered headers are flushed first,
+so that the connection's own ReadFrom is used, which sends files with the sendfile system call.
+*/
+func (w *responseWriter) ReadFrom(source io.Reader) (int64, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !bodyAllowed(w.status) {
+		return 0, http.ErrBodyNotAllowed
+	}
+	if w.request.Method == "HEAD" {
+		return 0, nil
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	if err := w.writer.Flush(); err != nil {
+		w.setError(err)
+		return 0, err
+	}
+	n, err := w.writer.ReadFrom(source)
+	w.written += n
+	w.setError(err)
+	return n, err
+}
+
+/*
+finish completes the response after the handler has returned.
+If nothing was written an empty 200 OK is sent. If the body did not match the
+announced Content-Length the client can not find the next response, so the
+connection is marked to be closed.
+*/
+func (w *responseWriter) finish() {
+	if !w.wroteHeader {
+		w.header.Set("Content-Length", "0")
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.hasBody() && w.contentLength >= 0 && w.written != w.contentLength {
+		w.keepAlive = false
+	}
+}
+
+/*
+expectContinue replaces the body of a request with "Expect: 100-continue" by a reader that sends
+"100 Continue" the first time it is read. The client only sends the body once the handler has accepted
+the request and starts reading it; a request that is rejected before is answered without its body.
+*/
+func (w *responseWriter) expectContinue(request *http.Request) {
+	w.continued = &continueReader{response: w, body: request.Body}
+	request.Body = w.continued
+}
+
+// continueReader is the body of a request that waits for 100 Continue.
+type continueReader struct {
+	response *responseWriter
+	body     io.ReadCloser
+	sent     bool
+}
+
+func (r *continueReader) Read(data []byte) (int, error) {
+	if !r.sent && !r.response.wroteHeader {
+		r.sent = true
+		_, err := r.response.writer.WriteString("HTTP/1.1 100 Continue\r\n\r\n")
+		if err == nil {
+			err = r.response.writer.Flush()
+		}
+		if err != nil {
+			r.response.setError(err)
+			return 0, err
+		}
+	}
+	return r.body.Read(data)
+}
+
+func (r *continueReader) Close() error {
+	return r.body.Close()
+}
+
+// hasBody reports whether a body is sent after the headers of the response.
+func (w *responseWriter) hasBody() bool {
+	return bodyAllowed(w.status) && w.request.Method != "HEAD"
+}
+
+// setError remembers the first write error, after which the connection can not be reused.
+func (w *responseWriter) setError(err error) {
+	if err != nil && w.err == nil {
+		w.err = err
+		w.keepAlive = false
+	}
+}
+
+/*
+shouldKeepAlive reports whether the connection may stay open after the request.
+HTTP/1.1 connections are persistent unless the client sends "Connection: close",
+HTTP/1.0 connections are closed unless the client sends "Connection: keep-alive".
+http.ReadRequest already evaluates these rules into request.Close.
+*/
+func shouldKeepAlive(request *http.Request) bool {
+	return !request.Close
+}
+
+// bodyAllowed reports whether a response with the given status may have a body.
+func bodyAllowed(status int) bool {
+	if status >= 100 && status <= 199 {
+		return false
+	}
+	return status != http.StatusNoContent && status != http.StatusNotModified
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// errShutdownTimeout is returned by shutdown when connections were still busy at the end of the grace period.
+var errShutdownTimeout = errors.New("connections were still busy when the shutdown timeout ran out")
+
+/*
+shutdown stops the server gracefully. The listeners are closed so no new connections are accepted,
+connections waiting for admission are answered 503, and idle keep-alive connections are closed.
+Connections in the middle of a request may finish it, and are closed after the response.
+If they have not finished within timeout, they are closed as well and errShutdownTimeout is returned.
+An upload that is cut off this way leaves the file as it was, since uploads are renamed into place when complete.
+*/
+func (s *server) shutdown(timeout time.Duration) error {
+	s.mutex.Lock()
+	s.closing = true
+	for _, listener := range s.listeners {
+		listener.Close()
+	}
+	for connection, idle := range s.connections {
+		if idle {
+			// Ends the wait for the next request, the handler then closes the connection
+			connection.SetReadDeadline(time.Now())
+		}
+	}
+	s.mutex.Unlock()
+	s.cancel()
+	if s.http2 != nil {
+		s.http2.shutdown()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.waitGroup.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return nil
+	case <-timer.C:
+		s.closeConnections()
+		<-done
+		return errShutdownTimeout
+	}
+}
+
+// closeConnections closes all connections at once, whatever they are doing.
+func (s *server) closeConnections() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for connection := range s.connections {
+		connection.Close()
+	}
+}
+
+// addListener registers a listener to be closed by shutdown. It returns false if the server is already shutting down.
+func (s *server) addListener(listener net.Listener) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closing {
+		return false
+	}
+	s.listeners = append(s.listeners, listener)
+	return true
+}
+
+/*
+track registers a new connection, which shutdown waits for. It returns false, and closes the
+connection, if the server is already shutting down.
+*/
+func (s *server) track(connection net.Conn) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closing {
+		connection.Close()
+		return false
+	}
+	s.connections[connection] = false
+	s.waitGroup.Add(1)
+	return true
+}
+
+// untrack removes a connection that has been closed.
+func (s *server) untrack(connection net.Conn) {
+	s.mutex.Lock()
+	delete(s.connections, connection)
+	s.mutex.Unlock()
+	s.waitGroup.Done()
+}
+
+// isClosing reports whether the server is shutting down.
+func (s *server) isClosing() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.closing
+}
+
+/*
+setIdle marks a connection as waiting for its next request or as handling one.
+It returns false if the server is shutting down, then an idle connection should be closed
+and a request that was just read should be the last one on the connection.
+*/
+func (s *server) setIdle(connection net.Conn, idle bool) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.connections[connection] = idle
+	return !s.closing
+}
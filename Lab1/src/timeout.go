@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// errRequestTimeout is returned when reading a request body took longer than the body timeout allows.
+var errRequestTimeout = errors.New("request body timed out")
+
+// writeChunkSize is how much of a file is sent with one write deadline.
+const writeChunkSize = 256 << 10
+
+/*
+timeoutConn is a connection whose writes may stall for at most the write timeout.
+The deadline is moved before every write, so a slow download is not cut off while it makes progress,
+but a client that stops reading can not keep the connection forever.
+*/
+type timeoutConn struct {
+	net.Conn
+	writeTimeout time.Duration
+}
+
+// Write writes data with a deadline of the write timeout from now.
+func (c *timeoutConn) Write(data []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	return c.Conn.Write(data)
+}
+
+/*
+ReadFrom copies a file to the connection in chunks, with a new write deadline for every chunk.
+The chunks are io.LimitedReaders of the file, so the connection still uses sendfile.
+*/
+func (c *timeoutConn) ReadFrom(source io.Reader) (int64, error) {
+	limited, ok := source.(*io.LimitedReader)
+	if !ok {
+		limited = &io.LimitedReader{R: source, N: 1<<63 - 1}
+	}
+	var total int64
+	for limited.N > 0 {
+		chunk := &io.LimitedReader{R: limited.R, N: min(limited.N, writeChunkSize)}
+		c.Conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+		written, err := io.Copy(c.Conn, chunk)
+		total += written
+		limited.N -= written
+		if err != nil || chunk.N > 0 {
+			return total, err // Error, or the end of the source
+		}
+	}
+	return total, nil
+}
+
+/*
+timeoutBody is a request body that must keep arriving. A read waits at most the body timeout for data,
+and with a minimum rate the whole body must arrive at least that fast on average: the body may take
+the body timeout plus one second for every minRate bytes, as a client trickling a body one byte at a time
+would hold its connection for as long as it likes otherwise.
+A read that runs out of time returns errRequestTimeout.
+*/
+type timeoutBody struct {
+	io.ReadCloser
+	connection readDeadliner
+	timeout    time.Duration
+	minRate    int64
+	start      time.Time
+	read       int64
+}
+
+/*
+readDeadliner sets the deadline for reading a request body: a net.Conn for HTTP/1.1,
+an http.ResponseController for a stream of HTTP/2.
+*/
+type readDeadliner interface {
+	SetReadDeadline(deadline time.Time) error
+}
+
+// newTimeoutBody limits how long the body of a request on connection may take, with the configured timeouts.
+func newTimeoutBody(body io.ReadCloser, connection readDeadliner) *timeoutBody {
+	return &timeoutBody{
+		ReadCloser: body,
+		connection: connection,
+		timeout:    config.BodyTimeout.Duration,
+		minRate:    int64(config.MinBodyRate),
+	}
+}
+
+// Read reads from the body with a deadline of the body timeout, or earlier when the body is too slow.
+func (b *timeoutBody) Read(data []byte) (int, error) {
+	now := time.Now()
+	if b.start.IsZero() {
+		// The clock starts at the first read, after the handler accepted the request
+		b.start = now
+	}
+	deadline := now.Add(b.timeout)
+	if b.minRate > 0 {
+		allowed := b.timeout + time.Duration(float64(b.read)/float64(b.minRate)*float64(time.Second))
+		if rateDeadline := b.start.Add(allowed); rateDeadline.Before(deadline) {
+			deadline = rateDeadline
+		}
+	}
+	b.connection.SetReadDeadline(deadline)
+
+	n, err := b.ReadCloser.Read(data)
+	b.read += int64(n)
+	if isTimeout(err) {
+		err = fmt.Errorf("%w after %d bytes in %s", errRequestTimeout, b.read, time.Since(b.start).Round(time.Millisecond))
+	}
+	return n, err
+}
+
+// isTimeout reports whether err is a network timeout.
+func isTimeout(err error) bool {
+	var netError net.Error
+	return errors.As(err, &netError) && netError.Timeout()
+}
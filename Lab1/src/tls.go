@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"http_server/tlsconfig"
+)
+
+/*
+newTLSConfig creates the TLS configuration of the server from its settings. The certificate is read from
+the -tls-cert and -tls-key files and reloaded when they change, or with -dev-tls created for localhost.
+*/
+func newTLSConfig(c serverConfig) (*tls.Config, error) {
+	minVersion, _ := tlsconfig.ParseVersion(c.TLSMinVersion)          // Checked with the configuration
+	cipherSuites, _ := tlsconfig.ParseCipherSuites(c.TLSCipherSuites) // Checked with the configuration
+	tlsConfig := &tls.Config{
+		MinVersion:   minVersion,
+		CipherSuites: cipherSuites,
+		NextProtos:   []string{"http/1.1"},
+	}
+	if c.HTTP2 {
+		tlsConfig.NextProtos = []string{"h2", "http/1.1"} // Clients that can choose HTTP/2
+	}
+	if c.DevTLS {
+		certificate, err := tlsconfig.SelfSigned("localhost", "127.0.0.1", "::1")
+		if err != nil {
+			return nil, err
+		}
+		slog.Warn("Serving HTTPS with a self-signed certificate for development, clients have to trust it explicitly",
+			"fingerprint", tlsconfig.Fingerprint(certificate))
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+		return tlsConfig, nil
+	}
+	reloader, err := tlsconfig.NewReloader(c.TLSCert, c.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.GetCertificate = reloader.GetCertificate
+	return tlsConfig, nil
+}
+
+// redirectListener accepts the connections of the plain HTTP listener, whose requests are redirected to HTTPS.
+type redirectListener struct {
+	net.Listener
+}
+
+// Accept returns the next connection, marked as one to redirect.
+func (l redirectListener) Accept() (net.Conn, error) {
+	connection, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return redirectConn{connection}, nil
+}
+
+// redirectConn is a connection to the plain HTTP listener.
+type redirectConn struct {
+	net.Conn
+}
+
+/*
+serveRedirect answers a request to the plain HTTP listener with 308 Permanent Redirect to the same URL over HTTPS,
+which keeps the method and body of the request. Liveness and readiness probes are answered as they are,
+so they can be sent without TLS. The connection is closed after the redirect.
+*/
+func serveRedirect(writer *bufio.Writer, request *http.Request) bool {
+	if request.URL.Path == healthPath || request.URL.Path == readyPath {
+		return serveRequest(writer, request)
+	}
+	start := time.Now()
+	request.Close = true // The body is not read, the client sends it again to the new URL
+	response := newResponseWriter(writer, request)
+	response.Header().Set("Location", httpsURL(request))
+	giveResponse(response, 308)
+	response.finish()
+	logAccess(request, response.status, response.written, start)
+	recordRequest(request, response.status, response.written, start)
+	return false
+}
+
+// httpsURL returns the URL of a request on the HTTPS port, for the host the client asked for.
+func httpsURL(request *http.Request) string {
+	host := request.Host
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	if config.Port != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(config.Port))
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]" // An IPv6 address
+	}
+	return "https://" + host + request.URL.RequestURI()
+}
@@ -0,0 +1,184 @@
+/*
+Package tlsconfig provides what the server needs to serve HTTPS: certificates that are reloaded
+when their files change, self-signed certificates for development, and the parsing of
+TLS versions and cipher suites from the configuration.
+*/
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"http_server/filewatch"
+)
+
+// versions are the TLS versions by the names the configuration uses.
+var versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseVersion returns the TLS version with the name "1.0", "1.1", "1.2" or "1.3".
+func ParseVersion(name string) (uint16, error) {
+	version, found := versions[strings.TrimPrefix(strings.TrimSpace(name), "TLS")]
+	if !found {
+		return 0, fmt.Errorf("unknown TLS version %q, expected 1.0, 1.1, 1.2 or 1.3", name)
+	}
+	return version, nil
+}
+
+/*
+ParseCipherSuites returns the IDs of cipher suites by their names, such as TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256.
+Only suites that Go considers secure are accepted. The suites of TLS 1.3 can not be chosen, Go always uses all of them,
+so the list only applies to TLS 1.2 and older. No names give nil, which lets Go choose.
+*/
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	known := make(map[string]*tls.CipherSuite)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite
+	}
+	insecure := make(map[string]bool)
+	for _, suite := range tls.InsecureCipherSuites() {
+		insecure[suite.Name] = true
+	}
+	var ids []uint16
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		suite, found := known[name]
+		switch {
+		case insecure[name]:
+			return nil, fmt.Errorf("cipher suite %s is insecure", name)
+		case !found:
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		case len(suite.SupportedVersions) == 1 && suite.SupportedVersions[0] == tls.VersionTLS13:
+			return nil, fmt.Errorf("cipher suite %s is one of TLS 1.3, which can not be configured", name)
+		}
+		ids = append(ids, suite.ID)
+	}
+	return ids, nil
+}
+
+/*
+SelfSigned creates a certificate and key for the hosts, names or IP addresses, signed by itself.
+It is valid for a year and can be trusted as its own certificate authority, which makes it fit for
+development, but browsers and clients warn about it unless it is trusted explicitly.
+*/
+func SelfSigned(hosts ...string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"http_server development"}},
+		NotBefore:             now.Add(-time.Hour), // Allows for clocks that are a little behind
+		NotAfter:              now.AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	if len(hosts) > 0 {
+		template.Subject.CommonName = hosts[0]
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// Fingerprint returns the SHA-256 fingerprint of the first certificate of a chain, to compare with what a client is shown.
+func Fingerprint(certificate tls.Certificate) string {
+	if len(certificate.Certificate) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(certificate.Certificate[0])
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+/*
+Reloader serves a certificate and key from files, and loads them again when they change, so a renewed
+certificate is used without restarting the server. The files are checked during handshakes, at most
+once per CheckInterval. When the new files can not be loaded, for example because only one of them
+has been replaced yet, the old certificate is kept and the files are tried again at the next check.
+It is safe for concurrent use.
+*/
+type Reloader struct {
+	filewatch.Watcher
+
+	certFile string
+	keyFile  string
+
+	mutex       sync.Mutex
+	certificate *tls.Certificate
+}
+
+// NewReloader loads the certificate and key from the files, which must be in PEM format.
+func NewReloader(certFile string, keyFile string) (*Reloader, error) {
+	r := &Reloader{Watcher: filewatch.New(certFile, keyFile), certFile: certFile, keyFile: keyFile}
+	if err := r.Load(r.load); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate returns the current certificate, for tls.Config.GetCertificate.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	reloaded, err := r.Reload(r.load)
+	switch {
+	case err != nil && !reloaded:
+		slog.Error("Checking the TLS certificate files", "err", err)
+	case err != nil:
+		slog.Error("Reloading the TLS certificate, keeping the old one", "cert", r.certFile, "err", err)
+	case reloaded:
+		slog.Info("Reloaded the TLS certificate", "cert", r.certFile, "fingerprint", Fingerprint(*r.certificate))
+	}
+	return r.certificate, nil
+}
+
+// load reads the files, and when they make a valid certificate uses it from now on.
+func (r *Reloader) load() error {
+	certificate, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.certificate = &certificate
+	return nil
+}
@@ -0,0 +1,112 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeFiles saves a certificate and its key as PEM files.
+func writeFiles(t *testing.T, certificate tls.Certificate, certFile string, keyFile string) {
+	t.Helper()
+	key, err := x509.MarshalPKCS8PrivateKey(certificate.PrivateKey)
+	if err != nil {
+		t.Fatalf("Error encoding the key: %v", err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Certificate[0]})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})
+	if os.WriteFile(certFile, certPEM, 0644) != nil || os.WriteFile(keyFile, keyPEM, 0600) != nil {
+		t.Fatalf("Error writing the certificate files")
+	}
+}
+
+func TestSelfSigned(t *testing.T) {
+	certificate, err := SelfSigned("localhost", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("Error creating the certificate: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(certificate.Leaf)
+	for _, host := range []string{"localhost", "127.0.0.1"} {
+		if _, err := certificate.Leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: roots}); err != nil {
+			t.Errorf("Expected the certificate to be valid for %s: %v", host, err)
+		}
+	}
+	if _, err := certificate.Leaf.Verify(x509.VerifyOptions{DNSName: "example.com", Roots: roots}); err == nil {
+		t.Errorf("Expected the certificate not to be valid for example.com")
+	}
+	if len(Fingerprint(certificate)) != 64 {
+		t.Errorf("Unexpected fingerprint %q", Fingerprint(certificate))
+	}
+}
+
+func TestReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	first, _ := SelfSigned("localhost")
+	writeFiles(t, first, certFile, keyFile)
+
+	reloader, err := NewReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Error loading the certificate: %v", err)
+	}
+	reloader.CheckInterval = 0
+	current := func() string {
+		certificate, _ := reloader.GetCertificate(nil)
+		return Fingerprint(*certificate)
+	}
+	if current() != Fingerprint(first) {
+		t.Fatalf("Expected the first certificate")
+	}
+
+	// Only the certificate is replaced, it does not match the key, so the old one is kept
+	second, _ := SelfSigned("localhost")
+	writeFiles(t, second, certFile, filepath.Join(dir, "other-key.pem"))
+	later := time.Now().Add(time.Second)
+	os.Chtimes(certFile, later, later)
+	if current() != Fingerprint(first) {
+		t.Errorf("Expected the old certificate to be kept while the key does not match")
+	}
+
+	// Both files are replaced
+	writeFiles(t, second, certFile, keyFile)
+	later = later.Add(time.Second)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+	if current() != Fingerprint(second) {
+		t.Errorf("Expected the new certificate after both files changed")
+	}
+
+	if _, err := NewReloader(filepath.Join(dir, "missing.pem"), keyFile); err == nil {
+		t.Errorf("Expected an error for a missing certificate file")
+	}
+}
+
+func TestParse(t *testing.T) {
+	if version, err := ParseVersion("1.2"); err != nil || version != tls.VersionTLS12 {
+		t.Errorf("ParseVersion(1.2) = %v, %v", version, err)
+	}
+	if version, err := ParseVersion("TLS1.3"); err != nil || version != tls.VersionTLS13 {
+		t.Errorf("ParseVersion(TLS1.3) = %v, %v", version, err)
+	}
+	if _, err := ParseVersion("2.0"); err == nil {
+		t.Errorf("ParseVersion accepted 2.0")
+	}
+
+	ids, err := ParseCipherSuites([]string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", " TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256"})
+	if err != nil || len(ids) != 2 || ids[0] != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 {
+		t.Errorf("Unexpected cipher suites %v, %v", ids, err)
+	}
+	for _, name := range []string{"TLS_RSA_WITH_RC4_128_SHA", "TLS_AES_128_GCM_SHA256", "NO_SUCH_SUITE"} {
+		if _, err := ParseCipherSuites([]string{name}); err == nil {
+			t.Errorf("Expected %s to be refused", name)
+		}
+	}
+	if ids, err := ParseCipherSuites(nil); ids != nil || err != nil {
+		t.Errorf("Expected no suites to leave the choice to Go, got %v, %v", ids, err)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// uploadFileMode is the permission of uploaded files, readable by everyone and writable by the server.
+const uploadFileMode = 0644
+
+// uploadTempPrefix starts the names of the temporary files uploads are written to.
+const uploadTempPrefix = ".upload-"
+
+// errTooLarge is returned by saveFile when the body is larger than the upload limit.
+var errTooLarge = errors.New("upload is larger than the limit")
+
+// errNoDirectory is returned by saveFile when the directory of the upload does not exist.
+var errNoDirectory = errors.New("directory of the upload does not exist")
+
+// errPreconditionFailed is returned by saveFile when the check before the rename refuses the upload.
+var errPreconditionFailed = errors.New("precondition failed")
+
+/*
+saveFile saves the contents of a POST or PUT request to a file.
+The body is streamed to a temporary file in the same directory, which is synced to disk and then
+renamed over the destination. A request reading the file at the same time sees either the old or the
+new file, never a part of it, and a crash leaves the old file as it was. Only the rename is done
+with the path locked for writing, so a slow upload does not keep others waiting.
+At most limit bytes are accepted, a larger body stops the upload with errTooLarge while it is streamed,
+also when the client did not send a Content-Length. A directory at url returns errIsDirectory before anything is written.
+When check is not nil it is called with the path locked, right before the rename, and an error it returns
+stops the upload. Two uploads to the same path can not both pass a check of the file they replace.
+*/
+func saveFile(request *http.Request, url string, limit int64, check func() error) error {
+	// A directory can not be replaced, and the upload root itself would put the temporary file outside the root
+	if info, err := os.Stat(url); err == nil && info.IsDir() {
+		return errIsDirectory
+	}
+	temp, err := os.CreateTemp(filepath.Dir(url), uploadTempPrefix+"*.tmp")
+	if isNotExist(err) {
+		return errNoDirectory
+	}
+	if err != nil {
+		return err
+	}
+	// Remove the temporary file unless it has been renamed
+	defer os.Remove(temp.Name())
+
+	written, err := io.Copy(temp, io.LimitReader(request.Body, limit+1))
+	if err == nil && written > limit {
+		err = errTooLarge
+	}
+	if err == nil {
+		err = temp.Sync()
+	}
+	if err == nil {
+		err = temp.Chmod(uploadFileMode)
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	unlock := locks.writeLock(url)
+	if check != nil {
+		err = check()
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), url)
+	}
+	unlock()
+	if err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(url))
+	uploadSizes.Observe(float64(written))
+	return nil
+}
+
+/*
+checkUploadSize answers 413 Payload Too Large if the Content-Length of an upload is over the limit,
+so the body is never read. The connection is closed after the response, as the client may still be sending the body.
+It returns true if the upload was rejected.
+*/
+func checkUploadSize(response http.ResponseWriter, request *http.Request, limit int64) (bool, error) {
+	if request.ContentLength > limit {
+		requestLogger(request).Info("Upload is larger than the limit", "size", request.ContentLength, "limit", limit)
+		response.Header().Set("Connection", "close")
+		return true, giveResponse(response, 413)
+	}
+	return false, nil
+}
+
+/*
+uploadErrorResponse answers an upload that saveFile failed to save: 413 Payload Too Large for a body over the limit,
+412 Precondition Failed when the file changed while the body arrived, 409 Conflict when there is no directory to save it in or a directory in its place,
+408 Request Timeout for a body that arrived too slowly, and 500 Internal Server Error otherwise.
+After a timeout the rest of the body may still be on its way, so the connection is closed.
+*/
+func uploadErrorResponse(response http.ResponseWriter, request *http.Request, err error) error {
+	logger := requestLogger(request)
+	switch {
+	case err == errTooLarge:
+		logger.Info("Upload is larger than the limit")
+		return giveResponse(response, 413)
+	case err == errPreconditionFailed:
+		return giveResponse(response, 412)
+	case err == errNoDirectory, err == errIsDirectory:
+		return giveResponse(response, 409)
+	case errors.Is(err, errRequestTimeout):
+		logger.Info("Upload timed out", "err", err)
+		response.Header().Set("Connection", "close")
+		return giveResponse(response, 408)
+	default:
+		logger.Error("Saving upload", "err", err)
+		return giveResponse(response, 500)
+	}
+}
+
+// syncDir syncs a directory to disk, so that a rename in it survives a crash.
+func syncDir(dir string) {
+	directory, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	directory.Sync() // Not supported for directories on all systems, then the rename is only as safe as the file system makes it
+	directory.Close()
+}
+
+/*
+removeOrphanedUploads removes temporary upload files left in dir and its subdirectories,
+by uploads that were interrupted by a crash. It is called at startup, before any upload can be running.
+*/
+func removeOrphanedUploads(dir string) error {
+	return filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() && isUploadTempFile(path) {
+			if err := os.Remove(path); err != nil {
+				slog.Warn("Removing orphaned upload", "path", path, "err", err)
+			}
+		}
+		return nil
+	})
+}
+
+// isUploadTempFile reports whether path is the name of a temporary upload file.
+func isUploadTempFile(path string) bool {
+	name := filepath.Base(path)
+	return strings.HasPrefix(name, uploadTempPrefix) && strings.HasSuffix(name, ".tmp")
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"http_server/mimetype"
+)
+
+/*
+siteConfig holds the settings of a virtual host, a site that is served for the host names in the Host header.
+Settings that are left out are those of the server, only the document root must be given.
+The upload directory defaults to the document root of the site.
+*/
+type siteConfig struct {
+	Root          string     `json:"root"`
+	UploadDir     string     `json:"upload_dir,omitempty"`
+	AllowedTypes  stringList `json:"allowed_types,omitempty"`
+	MimeTypes     string     `json:"mime_types,omitempty"`
+	MaxUploadSize byteSize   `json:"max_upload_size,omitempty"`
+	UploadLimits  sizeMap    `json:"upload_limits,omitempty"`
+}
+
+// apply returns the configuration of the server c with the settings of the site.
+func (s siteConfig) apply(c serverConfig) serverConfig {
+	c.Root = s.Root
+	c.UploadDir = s.UploadDir
+	if c.UploadDir == "" {
+		c.UploadDir = s.Root
+	}
+	if len(s.AllowedTypes) > 0 {
+		c.AllowedTypes = s.AllowedTypes
+	}
+	if s.MimeTypes != "" {
+		c.MimeTypes = s.MimeTypes
+	}
+	if s.MaxUploadSize != 0 {
+		c.MaxUploadSize = s.MaxUploadSize
+	}
+	if s.UploadLimits != nil {
+		c.UploadLimits = s.UploadLimits
+	}
+	return c
+}
+
+/*
+siteMap maps host names to sites, written as "example.com=/srv/example,*.example.org=/srv/org" on the command line,
+where only the document roots can be given. A name "*.example.org" is a wildcard for all subdomains of example.org.
+*/
+type siteMap map[string]siteConfig
+
+func (m *siteMap) String() string {
+	var items []string
+	for name, site := range *m {
+		items = append(items, name+"="+site.Root)
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
+
+func (m *siteMap) Set(value string) error {
+	*m = siteMap{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		name, root, found := strings.Cut(item, "=")
+		if !found {
+			return fmt.Errorf("invalid site %q, expected host=root", item)
+		}
+		(*m)[hostName(name)] = siteConfig{Root: strings.TrimSpace(root)}
+	}
+	return nil
+}
+
+// validateSites checks the names and settings of the virtual hosts and returns all problems found.
+func (c serverConfig) validateSites() []error {
+	var errs []error
+	for name, site := range c.Sites {
+		if !validHostPattern(name) {
+			errs = append(errs, fmt.Errorf("site %q is not a host name or a wildcard such as *.example.com", name))
+		}
+		if site.Root == "" {
+			errs = append(errs, fmt.Errorf("site %s: a root must be given", name))
+			continue
+		}
+		siteConfig := site.apply(c)
+		for setting, dir := range map[string]string{"root": siteConfig.Root, "upload directory": siteConfig.UploadDir} {
+			if err := checkDir(dir); err != nil {
+				errs = append(errs, fmt.Errorf("site %s: %s: %v", name, setting, err))
+			}
+		}
+		if siteConfig.MaxUploadSize <= 0 {
+			errs = append(errs, fmt.Errorf("site %s: max upload size must be positive, got %s", name, siteConfig.MaxUploadSize))
+		}
+		for contentType, limit := range siteConfig.UploadLimits {
+			if limit <= 0 {
+				errs = append(errs, fmt.Errorf("site %s: upload limit for %s must be positive, got %s", name, contentType, limit))
+			}
+		}
+	}
+	if c.UnknownHost != "default" && c.UnknownHost != "reject" {
+		errs = append(errs, fmt.Errorf(`unknown host must be "default" or "reject", got %q`, c.UnknownHost))
+	}
+	return errs
+}
+
+// validHostPattern reports whether name is a host name, an IP address or a wildcard "*." followed by a host name.
+func validHostPattern(name string) bool {
+	if net.ParseIP(name) != nil {
+		return true
+	}
+	name = strings.TrimPrefix(name, "*.")
+	return name != "" && !strings.ContainsAny(name, ":/*[] ")
+}
+
+// virtualHost is a site of the server with the configuration and MIME types it is served with.
+type virtualHost struct {
+	name      string // the host name of the site, "*.example.com" for its subdomains, "" for the default site
+	config    *serverConfig
+	mimeTypes *mimetype.Registry
+}
+
+/*
+virtualHosts are the sites of the server other than the default one, set up by main.
+The exact host names come first, then the wildcards with the longest first, the order they are matched in.
+*/
+var virtualHosts []*virtualHost
+
+// newVirtualHosts sets up the sites of the configuration, each with the MIME types of its own document root.
+func newVirtualHosts(c serverConfig) ([]*virtualHost, error) {
+	var hosts []*virtualHost
+	for name, site := range c.Sites {
+		siteConfig := site.apply(c)
+		registry, err := newMimeRegistry(siteConfig)
+		if err != nil {
+			return nil, fmt.Errorf("site %s: %v", name, err)
+		}
+		hosts = append(hosts, &virtualHost{name: hostName(name), config: &siteConfig, mimeTypes: registry})
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		wildcardI, wildcardJ := strings.HasPrefix(hosts[i].name, "*."), strings.HasPrefix(hosts[j].name, "*.")
+		if wildcardI != wildcardJ {
+			return wildcardJ
+		}
+		if len(hosts[i].name) != len(hosts[j].name) {
+			return len(hosts[i].name) > len(hosts[j].name)
+		}
+		return hosts[i].name < hosts[j].name
+	})
+	return hosts, nil
+}
+
+// defaultHost returns the default site, which is served with the settings of the server itself.
+func defaultHost() *virtualHost {
+	return &virtualHost{config: &config, mimeTypes: mimeTypes}
+}
+
+// hostName returns the host name of a Host header in lower case, without the port and a trailing dot.
+func hostName(host string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	return strings.TrimSuffix(strings.Trim(host, "[]"), ".")
+}
+
+// matches reports whether the site is served for a host name, a wildcard for the names below its domain.
+func (h *virtualHost) matches(name string) bool {
+	if domain, wildcard := strings.CutPrefix(h.name, "*"); wildcard {
+		return strings.HasSuffix(name, domain) && len(name) > len(domain)
+	}
+	return name == h.name
+}
+
+/*
+findVirtualHost returns the site for the Host of a request: the site of that name, or else the wildcard
+with the longest match. Other hosts get the default site, or nil when the configuration refuses unknown hosts.
+*/
+func findVirtualHost(request *http.Request) *virtualHost {
+	name := hostName(request.Host)
+	for _, host := range virtualHosts {
+		if host.matches(name) {
+			return host
+		}
+	}
+	if config.UnknownHost == "reject" {
+		return nil
+	}
+	return defaultHost()
+}